@@ -1,20 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -28,34 +50,545 @@ type SmartAttribute struct {
 	Worst  int                    `json:"worst"`
 	Thresh int                    `json:"thresh"`
 	Raw    map[string]interface{} `json:"raw"`
-	Flags  map[string]bool        `json:"flags"`
+	Flags  map[string]interface{} `json:"flags"`
 }
 
 // SmartData represents the JSON output from smartctl
 type SmartData struct {
+	JSONFormatVersion []int `json:"json_format_version"`
+	Smartctl          struct {
+		Version []int `json:"version"`
+	} `json:"smartctl"`
 	ATASmartAttributes struct {
 		Table []SmartAttribute `json:"table"`
 	} `json:"ata_smart_attributes"`
 	ModelName    string `json:"model_name"`
 	SerialNumber string `json:"serial_number"`
+
+	// Reported by "smartctl -a/-x --json"; used to identify drives when reading
+	// pre-captured output instead of running smartctl -i
+	WWN struct {
+		NAA int   `json:"naa"`
+		OUI int   `json:"oui"`
+		ID  int64 `json:"id"`
+	} `json:"wwn"`
+	SmartSupport struct {
+		Enabled bool `json:"enabled"`
+	} `json:"smart_support"`
+	ATASecurity struct {
+		String string `json:"string"`
+		Locked bool   `json:"locked"`
+	} `json:"ata_security"`
+	RotationRate *int `json:"rotation_rate"` // 0 for solid state
+	UserCapacity struct {
+		Bytes int64 `json:"bytes"`
+	} `json:"user_capacity"`
+	NVMeTotalCapacity int64 `json:"nvme_total_capacity"`
+	FormFactor        struct {
+		Name string `json:"name"`
+	} `json:"form_factor"`
+	LogicalBlockSize int64 `json:"logical_block_size"`
+
+	// Reported with -c (and -a/-x); attributes not updated online are only
+	// refreshed by offline data collection, so its status says if they are current
+	ATASmartData struct {
+		OfflineDataCollection struct {
+			Status struct {
+				Value  *int   `json:"value"`
+				String string `json:"string"`
+			} `json:"status"`
+		} `json:"offline_data_collection"`
+		SelfTest struct {
+			Status struct {
+				Value            *int   `json:"value"`
+				String           string `json:"string"`
+				RemainingPercent *int   `json:"remaining_percent"`
+			} `json:"status"`
+		} `json:"self_test"`
+	} `json:"ata_smart_data"`
+
+	// Reported with -A (and -a/-x) for NVMe drives in place of an attribute table
+	NVMeHealthLog *NVMeHealthLog `json:"nvme_smart_health_information_log"`
+
+	// SCSI (SAS) drives have no attribute table either: -A reports the grown
+	// defect list, temperature and start-stop counters, and -l error the error
+	// counter log. scsiAttributes maps them onto the ATA attributes they match.
+	Device struct {
+		Protocol string `json:"protocol"` // "ATA", "SCSI" or "NVMe"
+	} `json:"device"`
+	SCSIVendor          string               `json:"scsi_vendor"`
+	SCSIProduct         string               `json:"scsi_product"`
+	SCSIGrownDefectList *int64               `json:"scsi_grown_defect_list"`
+	SCSIErrorCounterLog *SCSIErrorCounterLog `json:"scsi_error_counter_log"`
+	SCSIStartStop       struct {
+		StartStopCycles  *int64 `json:"accumulated_start_stop_cycles"`
+		LoadUnloadCycles *int64 `json:"accumulated_load_unload_cycles"`
+	} `json:"scsi_start_stop_cycle_counter"`
+	Temperature struct {
+		Current *int64 `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours *int64 `json:"hours"`
+	} `json:"power_on_time"`
+
+	// raw is the smartctl output this was parsed from, for -raw-archive-dir
+	raw []byte
+}
+
+// NVMeHealthLog is the part of an NVMe drive's SMART/Health Information log
+// page that the monitor reads
+type NVMeHealthLog struct {
+	CriticalWarning int `json:"critical_warning"`
+
+	// Minutes spent at or above the warning and critical composite temperature
+	// thresholds, and the transitions into and seconds spent in host-controlled
+	// thermal management (1 light, 2 heavy throttling)
+	WarningTempTime             int64 `json:"warning_temp_time"`
+	CriticalCompTime            int64 `json:"critical_comp_time"`
+	ThermalTemp1TransitionCount int64 `json:"thermal_temp1_transition_count"`
+	ThermalTemp2TransitionCount int64 `json:"thermal_temp2_transition_count"`
+	ThermalTemp1TotalTime       int64 `json:"thermal_temp1_total_time"`
+	ThermalTemp2TotalTime       int64 `json:"thermal_temp2_total_time"`
+}
+
+// SCSIErrorCounterLog is a SCSI drive's error counter log, per direction
+type SCSIErrorCounterLog struct {
+	Read   *SCSIErrorCounters `json:"read"`
+	Write  *SCSIErrorCounters `json:"write"`
+	Verify *SCSIErrorCounters `json:"verify"`
+}
+
+// SCSIErrorCounters are the counters of one direction of the error counter log
+type SCSIErrorCounters struct {
+	TotalErrorsCorrected   int64 `json:"total_errors_corrected"`
+	TotalUncorrectedErrors int64 `json:"total_uncorrected_errors"`
+}
+
+// DeviceStatistics represents the JSON output of smartctl -l devstat, the
+// vendor-neutral ATA device statistics log
+type DeviceStatistics struct {
+	ATADeviceStatistics struct {
+		Pages []struct {
+			Number int    `json:"number"`
+			Name   string `json:"name"`
+			Table  []struct {
+				Offset int    `json:"offset"`
+				Name   string `json:"name"`
+				Value  *int64 `json:"value"`
+				Flags  struct {
+					Valid *bool `json:"valid"`
+				} `json:"flags"`
+			} `json:"table"`
+		} `json:"pages"`
+	} `json:"ata_device_statistics"`
+}
+
+// HealthStatus represents the JSON output of smartctl -H, the drive's own
+// overall-health self-assessment
+type HealthStatus struct {
+	SmartStatus struct {
+		Passed *bool `json:"passed"`
+	} `json:"smart_status"`
 }
 
+// devstatPages are the device statistics pages that are stored: general,
+// rotating media, general errors, temperature and solid state
+var devstatPages = map[int]bool{1: true, 3: true, 4: true, 5: true, 7: true}
+
 // DeviceInfo holds basic device information
 type DeviceInfo struct {
-	Device       string
-	SerialNumber string
-	Model        string
-	IsMounted    bool
-	SmartEnabled bool
+	Device        string // current /dev path; an alias that can change across reboots
+	SerialNumber  string
+	Model         string
+	WWN           string // World Wide Name, empty if the drive does not report one
+	IsMounted     bool
+	SmartEnabled  bool
+	SecurityState string // ATA security line from smartctl -i, empty if not reported
+	Locked        bool   // self-encrypting drive is locked; attributes are unreadable
+	Bay           string // physical bay from the -slot-map, empty if not mapped
+	MediaType     string // "hdd" or "ssd", empty if smartctl -i does not say
+	RotationRate  int    // rpm, 0 for solid state or when not reported
+	CapacityBytes int64  // user capacity, 0 if not reported
+	FormFactor    string // e.g. "3.5 inches", empty if not reported
+
+	LogicalSectorSize int64 // bytes per LBA, 0 if not reported
+}
+
+// ID returns the stable identity used to key a drive's history: its serial,
+// else its WWN, and only as a last resort the current device path
+func (d *DeviceInfo) ID() string {
+	switch {
+	case d.SerialNumber != "":
+		return d.SerialNumber
+	case d.WWN != "":
+		return "wwn-0x" + d.WWN
+	default:
+		return d.Device
+	}
 }
 
 // HealthAlert represents a health alert
 type HealthAlert struct {
-	Device        string
-	AttributeName string
-	AlertType     string
-	Message       string
-	Timestamp     time.Time
+	Device        string    `json:"device"`
+	DeviceID      string    `json:"device_id,omitempty"`
+	AttributeName string    `json:"attribute_name"`
+	AlertType     string    `json:"alert_type"`
+	Severity      string    `json:"severity"`
+	Message       string    `json:"message"`
+	FirstSeen     time.Time `json:"first_seen"`
+	Timestamp     time.Time `json:"timestamp"`
+	Maintenance   bool      `json:"maintenance"` // raised during a maintenance window; recorded but not notified
+	Suppressed    bool      `json:"suppressed"`  // an accepted condition of the drive; recorded but not notified
+	Bay           string    `json:"bay,omitempty"`
+	EscalatedFrom string    `json:"escalated_from,omitempty"` // the severity before an escalation
+}
+
+// Location names where the alerted drive is: its bay and device path when the
+// bay is known, else the path
+func (a HealthAlert) Location() string {
+	if a.Bay == "" {
+		return a.Device
+	}
+	return fmt.Sprintf("bay %s (%s)", a.Bay, a.Device)
+}
+
+// Alert severity levels, in ascending order of urgency
+const (
+	SeverityInfo     = "INFO"
+	SeverityWarn     = "WARN"
+	SeverityCritical = "CRITICAL"
+)
+
+var severityRank = map[string]int{
+	SeverityInfo:     0,
+	SeverityWarn:     1,
+	SeverityCritical: 2,
+}
+
+// logLevels ranks the -log-level values. Errors and alerts go to errLogger and
+// always print; warnLogger is silenced at error
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// logLevel is the rank of the configured -log-level
+var logLevel = logLevels["info"]
+
+// levelWriter returns w if messages at level are shown at the configured
+// -log-level, and discards them otherwise
+func levelWriter(w io.Writer, level string) io.Writer {
+	if logLevels[level] < logLevel {
+		return ioutil.Discard
+	}
+	return w
+}
+
+// counterAttribs are attributes whose raw value only accumulates, so the change
+// since the install baseline measures wear
+var counterAttribs = map[int]bool{
+	4: true, 5: true, 9: true, 12: true, 187: true, 188: true, 191: true, 192: true,
+	193: true, 196: true, 198: true, 199: true, 222: true, 240: true, 241: true, 242: true,
+}
+
+// vendorEncodedAttribs are error-rate attributes whose raw value packs vendor
+// specific fields (Seagate's hold operation counts alongside errors), so it
+// cannot be read as a count. Their normalized value is tracked instead.
+var vendorEncodedAttribs = map[int]bool{1: true, 7: true}
+
+// placeholderNormalized is the lowest normalized value firmware uses to mean
+// "not computed yet". New Seagate drives report 253 for their error rates
+// until enough data has been read, so such a value is no baseline.
+const placeholderNormalized = 253
+
+// initialSeverity maps alert types to the severity they are raised with
+var initialSeverity = map[string]string{
+	"THRESHOLD_VIOLATION":   SeverityCritical,
+	"THRESHOLD_APPROACHING": SeverityWarn,
+	"CRITICAL_VALUE":        SeverityInfo,
+	"HIGH_TEMPERATURE":      SeverityWarn,
+	"POH_REGRESSION":        SeverityWarn,
+	"DRIVE_LOCKED":          SeverityWarn,
+	"RAPID_REALLOCATION":    SeverityCritical,
+	"PENDING_REALLOCATED":   SeverityCritical,
+	"DUPLICATE_SERIAL":      SeverityWarn,
+	"HEALTH_FAILED":         SeverityCritical,
+	"REALLOCATED_COUNT":     SeverityWarn,
+	"PROLONGED_STANDBY":     SeverityWarn,
+	"SELF_TEST_ABORTED":     SeverityWarn,
+	"PORT_MULTIPLIER_FAULT": SeverityWarn,
+	"SMART_DISABLED":        SeverityWarn,
+
+	"NVME_SPARE_LOW":            SeverityCritical,
+	"NVME_TEMPERATURE":          SeverityWarn,
+	"NVME_RELIABILITY_DEGRADED": SeverityCritical,
+	"NVME_READ_ONLY":            SeverityCritical,
+	"NVME_BACKUP_FAILED":        SeverityCritical,
+	"NVME_THROTTLING":           SeverityWarn,
+	"NVME_CRITICAL_TEMPERATURE": SeverityCritical,
+
+	"UNCORRECTABLE_INCREASE": SeverityWarn,
+	"PREDICTED_FAILURE":      SeverityCritical,
+
+	"OLD_AGE_THRESHOLD":   SeverityWarn,
+	"OLD_AGE_APPROACHING": SeverityInfo,
+	"BAY_CHANGED":         SeverityWarn,
+
+	"RATED_LIMIT":        SeverityWarn,
+	"ERROR_RATE_DECLINE": SeverityWarn,
+}
+
+// smartctlRunner executes smartctl and returns its standard output. It is the
+// single point where the monitor shells out, so alternative runners can supply
+// canned output in place of real devices.
+type smartctlRunner interface {
+	Run(args ...string) ([]byte, error)
+}
+
+// execRunner runs the smartctl binary found in PATH, through prefix when set,
+// e.g. ["sudo", "-n"] so only smartctl runs privileged
+type execRunner struct {
+	prefix []string
+}
+
+// Run executes smartctl with the given arguments. A failed run's error carries
+// smartctl's own explanation; the output is returned either way.
+func (r execRunner) Run(args ...string) ([]byte, error) {
+	cmd := exec.Command("smartctl", args...)
+	if len(r.prefix) > 0 {
+		command := append([]string{}, r.prefix[1:]...)
+		command = append(command, "smartctl")
+		cmd = exec.Command(r.prefix[0], append(command, args...)...)
+	}
+
+	output, err := cmd.Output()
+	if err != nil {
+		err = diagnoseSmartctl(err, output)
+	}
+	return output, err
+}
+
+// smartctlError is a failed smartctl run together with the reason smartctl
+// (or the -command-prefix) printed, so that logs say why rather than just
+// "exit status 2"
+type smartctlError struct {
+	err        error  // from running the command
+	detail     string // e.g. "Smartctl open device: /dev/sda failed: Permission denied"
+	permission bool   // access to the device, or to sudo, was refused
+	inquiry    bool   // the device did not answer a SCSI INQUIRY
+}
+
+func (e *smartctlError) Error() string {
+	switch {
+	case e.permission:
+		return fmt.Sprintf("permission denied (%s) - run as root, or allow this user to run smartctl through sudo and set -command-prefix \"sudo -n\"", e.detail)
+	case e.inquiry:
+		return fmt.Sprintf("%s - the device did not answer; it may be absent or powered off, or a USB bridge that needs -device-types", e.detail)
+	default:
+		return fmt.Sprintf("%v: %s", e.err, e.detail)
+	}
+}
+
+func (e *smartctlError) Unwrap() error { return e.err }
+
+// permissionMessages are printed by smartctl when it may not open a device, and
+// by sudo -n when it would have to ask for a password
+var permissionMessages = []string{"Permission denied", "Operation not permitted", "Access is denied",
+	"a password is required", "a terminal is required"}
+
+// diagnoseSmartctl looks for the reason a smartctl run failed in its output and
+// error stream, returning err unchanged when there is none to add
+func diagnoseSmartctl(err error, output []byte) error {
+	text := string(output)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		text += "\n" + string(exitErr.Stderr)
+	}
+
+	e := &smartctlError{err: err}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		for _, message := range permissionMessages {
+			if strings.Contains(line, message) && !e.permission {
+				e.permission, e.detail = true, line
+			}
+		}
+		switch {
+		case e.permission:
+		case strings.Contains(line, "INQUIRY failed"):
+			e.inquiry, e.detail = true, line
+		case e.detail == "" && strings.Contains(line, "failed"):
+			e.detail = line
+		}
+	}
+	if e.detail == "" {
+		return err
+	}
+	return e
+}
+
+// isPermissionError reports whether err is smartctl being refused access
+func isPermissionError(err error) bool {
+	var e *smartctlError
+	return errors.As(err, &e) && e.permission
+}
+
+// deviceTypeRule gives the smartctl -d type for devices whose path matches pattern
+type deviceTypeRule struct {
+	pattern    string
+	deviceType string
+}
+
+// parseDeviceTypes parses a comma-separated list of pattern=type pairs such as
+// "/dev/sd[a-x]=sat,/dev/sg*=scsi"; patterns use filepath.Match syntax
+func parseDeviceTypes(list string) ([]deviceTypeRule, error) {
+	var rules []deviceTypeRule
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid device type mapping %q, expected pattern=type", field)
+		}
+		if _, err := filepath.Match(parts[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid device pattern %q: %v", parts[0], err)
+		}
+		rules = append(rules, deviceTypeRule{pattern: parts[0], deviceType: parts[1]})
+	}
+	return rules, nil
+}
+
+// typedRunner passes smartctl the -d type of the first rule matching the device,
+// which is always the last argument, so smartctl does not have to autodetect
+// it. Devices that match no rule get the type detected for their USB bridge, if
+// any, and are otherwise left to autodetection. A call that already gives -d is
+// passed through unchanged.
+type typedRunner struct {
+	runner   smartctlRunner
+	rules    []deviceTypeRule
+	detected *sync.Map // device path -> usbDeviceType, filled by detectUSBTypes
+}
+
+// ruleType returns the -d type of the first rule matching device, or ""
+func (r typedRunner) ruleType(device string) string {
+	for _, rule := range r.rules {
+		if ok, _ := filepath.Match(rule.pattern, device); ok {
+			return rule.deviceType
+		}
+	}
+	return ""
+}
+
+// Run executes smartctl with the device's -d type inserted before the device
+func (r typedRunner) Run(args ...string) ([]byte, error) {
+	if len(args) == 0 {
+		return r.runner.Run(args...)
+	}
+	for _, arg := range args {
+		if arg == "-d" {
+			return r.runner.Run(args...)
+		}
+	}
+
+	device := args[len(args)-1]
+	deviceType := r.ruleType(device)
+	if deviceType == "" && r.detected != nil {
+		if known, ok := r.detected.Load(device); ok {
+			deviceType = known.(usbDeviceType).deviceType
+		}
+	}
+	if deviceType == "" {
+		return r.runner.Run(args...)
+	}
+
+	typed := append([]string{}, args[:len(args)-1]...)
+	return r.runner.Run(append(typed, "-d", deviceType, device)...)
+}
+
+// errWriteQueueFull is returned when a write could not be queued before the backpressure timeout
+var errWriteQueueFull = errors.New("database write queue full")
+
+// writeOp is a unit of database work run by the writer goroutine
+type writeOp struct {
+	name string
+	fn   func() error
+	done chan error // nil for fire-and-forget writes
+}
+
+// dbWriter funnels every database write through a single goroutine, so writes
+// never contend with each other and each runs as one serialized unit
+type dbWriter struct {
+	ops     chan writeOp
+	stopped chan struct{}
+	timeout time.Duration
+	logger  *log.Logger
+}
+
+// newDBWriter starts a writer goroutine with a queue of the given size
+func newDBWriter(size int, timeout time.Duration, logger *log.Logger) *dbWriter {
+	w := &dbWriter{
+		ops:     make(chan writeOp, size),
+		stopped: make(chan struct{}),
+		timeout: timeout,
+		logger:  logger,
+	}
+	go w.run()
+	return w
+}
+
+// run executes queued writes in order until the queue is closed
+func (w *dbWriter) run() {
+	defer close(w.stopped)
+	for op := range w.ops {
+		err := op.fn()
+		if op.done != nil {
+			op.done <- err
+		} else if err != nil {
+			w.logger.Printf("Queued %s write failed: %v", op.name, err)
+		}
+	}
+}
+
+// submit queues op, blocking for up to the writer timeout when the queue is full
+func (w *dbWriter) submit(op writeOp) error {
+	select {
+	case w.ops <- op:
+		return nil
+	default:
+	}
+
+	w.logger.Printf("Database write queue full (%d pending), waiting for %s write", len(w.ops), op.name)
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+
+	select {
+	case w.ops <- op:
+		return nil
+	case <-timer.C:
+		return errWriteQueueFull
+	}
+}
+
+// do runs fn on the writer goroutine and waits for its result
+func (w *dbWriter) do(name string, fn func() error) error {
+	done := make(chan error, 1)
+	if err := w.submit(writeOp{name: name, fn: fn, done: done}); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// async queues fn on the writer goroutine without waiting; failures are logged
+func (w *dbWriter) async(name string, fn func() error) {
+	if err := w.submit(writeOp{name: name, fn: fn}); err != nil {
+		w.logger.Printf("Dropped %s write: %v", name, err)
+	}
+}
+
+// close drains the remaining queued writes and stops the writer goroutine
+func (w *dbWriter) close() {
+	close(w.ops)
+	<-w.stopped
 }
 
 // MAIDSmartMonitor is the main monitoring system
@@ -63,11 +596,216 @@ type MAIDSmartMonitor struct {
 	db            *sql.DB
 	dbPath        string
 	targetAttribs map[int]string
-	logger        *log.Logger
+	logger        *log.Logger // informational messages, to stdout
+	debugLogger   *log.Logger // routine per-device messages, to stdout at -log-level=debug
+	warnLogger    *log.Logger // warnings, to stderr unless -log-level=error
+	errLogger     *log.Logger // alerts and errors, to stderr
+	runner        smartctlRunner
+	inputDir      string // read pre-captured smartctl --json output from here instead of running smartctl
+	discovery     driveDiscoverer
+	sysPath       string   // sysfs root, for hwmon temperatures, sg/bsg mapping and USB IDs
+	usbTypes      sync.Map // device path -> usbDeviceType found for drives behind USB bridges
+	extraDevices  []string
+	store         Store // what the monitoring cycle stores and reads back; the SQLite database unless replaced
+	writes        *dbWriter
+	tempUnit      string // display/export unit; temperatures are stored in Celsius
+	exportFormat  string // "csv" or "gob"
+
+	// cycleMu serializes monitoring cycles; stateMu guards the fields below it,
+	// which are written by the cycle and read concurrently by API front-ends
+	cycleMu        sync.Mutex
+	stateMu        sync.RWMutex
+	lastCycleStart time.Time
+	lastCycleEnd   time.Time
+	cycleRunning   bool
+	lastSummary    *cycleSummary
+
+	cycleAlerts int // alerts raised so far in the running cycle; only touched by the cycle
+
+	// Devices whose collection keeps failing are skipped for a doubling number of
+	// cycles, up to maxBackoffCycles; keyed by device path, only touched by the cycle
+	backoff          map[string]*deviceBackoff
+	maxBackoffCycles int
+
+	// Adaptive polling, enabled by adaptiveWarm: a drive at or above it is polled
+	// every adaptiveMin, one at or below adaptiveCool every adaptiveMax, and the
+	// rest every pollInterval. Keyed by device path, only touched by the cycle.
+	adaptiveWarm, adaptiveCool int
+	adaptiveMin, adaptiveMax   time.Duration
+	pollInterval               time.Duration
+	polls                      map[string]*devicePoll
+	lastFleetCycle             time.Time // start of the last cycle that did the fleet work; see fleetDue
+
+	notifiers []Notifier
+	notifyWG  sync.WaitGroup // notifications in flight
+
+	// events streams attribute changes, alerts and cycle summaries to
+	// /api/events clients
+	events eventHub
+
+	// alertTemplates render alert messages by alert type, falling back to the
+	// "default" template and then to the built-in message
+	alertTemplates map[string]*template.Template
+
+	// slotMap maps physical bays to the serial or /dev path of the drive they
+	// hold, so alerts and summaries say which drive to pull
+	slotMap map[string]string
+
+	collectDevstat bool // also collect the -l devstat device statistics log
+	collectHealth  bool // also read the -H overall-health self-assessment
+	hashChain      bool // chain each cycle's stored readings into cycle_log
+
+	// collectAttributes false never runs smartctl -A; drives are still discovered
+	// and checked for standby, and temperatures come from hwmon instead
+	collectAttributes bool
+
+	// collectAll stores every attribute a drive reports, not only targetAttribs
+	collectAll bool
+
+	// collectSmartctl false skips discovery and the smartctl collector, leaving
+	// only the external collectors
+	collectSmartctl bool
+	collectors      []collector
+
+	// deviceStagger is the upper bound of a random pause between devices within a
+	// cycle, spreading spin-up power draw (0 polls back to back)
+	deviceStagger time.Duration
+
+	// parallel is how many devices a cycle reads at once. spindles bounds how
+	// many of those may be reading a drive that is spinning, independently of
+	// parallel, so standby probes do not hold up the power budget; it is nil
+	// when -max-active-spindles is not set.
+	parallel int
+	spindles chan struct{}
+
+	// pollOrder is "active-first" to poll spinning drives before those found in
+	// standby, or "discovery" to poll in the order drives were found
+	pollOrder string
+
+	// inStandby remembers the drives a cycle's standby probes found in standby,
+	// so ordering and then reading a drive probes it once. Reads run in
+	// parallel, hence standbyMu; it is emptied at the start of each cycle.
+	standbyMu sync.Mutex
+	inStandby map[string]bool
+
+	// Disk space guard: below minFreeBytes on the database filesystem old data is
+	// pruned early, and if that is not enough new readings are not stored
+	retention    time.Duration // smart_data older than this is pruned (0 keeps everything)
+	minFreeBytes uint64
+	lowDiskSpace bool // guarded by stateMu
+
+	// alertRetention prunes resolved alerts last seen longer ago than this;
+	// unresolved ones are kept however old (0 keeps everything)
+	alertRetention time.Duration
+
+	// Readings whose write failed are kept in memory, oldest first, and retried at
+	// the start of each cycle; beyond maxBuffered the oldest are dropped. Only
+	// the cycle touches buffered.
+	buffered    []bufferedReading
+	maxBuffered int
+
+	// storeOnChangeOnly skips an attribute row whose values match the last row
+	// stored for that device and attribute, unless that row is older than
+	// storeHeartbeat, so a stable attribute still gets a row that often
+	storeOnChangeOnly bool
+	storeHeartbeat    time.Duration
+
+	// vendorThresholds caches thresholds read from the brief attribute table,
+	// keyed by serial (device path without one) then attribute ID; thresholds
+	// are fixed per drive
+	vendorMu         sync.Mutex
+	vendorThresholds map[string]map[int]int
+
+	// smartctlVersion is asked for once; releases before 7.0 have no --json,
+	// so their attribute tables are read from the text output of -A
+	versionOnce     sync.Once
+	smartctlVersion []int
+
+	// criticalAttrs raise CRITICAL_VALUE whenever their raw value is nonzero
+	criticalAttrs map[int]bool
+
+	// classifyMedia drops attributes that do not apply to a drive's media type,
+	// as classified from its rotation rate
+	classifyMedia bool
+
+	// rawArchiveDir keeps each drive's smartctl JSON output, one gzip file per
+	// drive and day, indexed in raw_archive (empty disables)
+	rawArchiveDir string
+
+	// modelProfiles give the rated limits of drive families, the first whose
+	// pattern matches a drive's model applying: -model-profiles, then built-ins
+	modelProfiles []modelProfile
+
+	// thresholdMargin raises THRESHOLD_APPROACHING once a normalized value is
+	// within this much of its threshold, ahead of THRESHOLD_VIOLATION (0 disables)
+	thresholdMargin int
+
+	// weightPrefail raises old-age attributes (prefail flag clear) that reach
+	// their threshold as OLD_AGE_THRESHOLD rather than THRESHOLD_VIOLATION, and
+	// warns of them approaching within oldAgeMargin instead of thresholdMargin
+	weightPrefail bool
+	oldAgeMargin  int
+
+	// reallocatedLimit raises REALLOCATED_COUNT once attribute 5's raw count
+	// exceeds it, whatever the normalized value says (0 disables)
+	reallocatedLimit int64
+
+	// errorRateDecline raises ERROR_RATE_DECLINE once a vendor-encoded error
+	// rate attribute's normalized value falls this far below its install
+	// baseline (0 disables)
+	errorRateDecline int
+
+	// replacement decides which drives the summary recommends replacing
+	replacement replacementCriteria
+
+	// maxStandby raises PROLONGED_STANDBY for a device in standby that has not
+	// been seen spinning for longer than this (0 disables)
+	maxStandby time.Duration
+
+	// ignoreStale skips the threshold checks for attributes only updated by
+	// offline data collection while that collection has not completed
+	ignoreStale bool
+
+	// Unresolved alerts older than these durations are escalated (0 disables)
+	escalateWarnAfter     time.Duration
+	escalateCriticalAfter time.Duration
+
+	// RAPID_REALLOCATION fires when a reallocation counter grows by more than
+	// reallocationLimit within reallocationWindow (0 window disables)
+	reallocationWindow time.Duration
+	reallocationLimit  int64
+
+	// PREDICTED_FAILURE fires when attribute 187 rises in uncorrectableIncreases
+	// readings within uncorrectableWindow (0 window disables the trend check)
+	uncorrectableWindow    time.Duration
+	uncorrectableIncreases int
+}
+
+// dbDurability holds the SQLite journal_mode and synchronous pragmas the
+// database is opened with
+type dbDurability struct {
+	journalMode string // DELETE or WAL
+	synchronous string // FULL, NORMAL or OFF
+}
+
+// defaultDBDurability is SQLite's own default: a rollback journal, synced on
+// every commit
+var defaultDBDurability = dbDurability{journalMode: "DELETE", synchronous: "FULL"}
+
+// parseDBDurability validates the -db-journal-mode and -db-synchronous values
+func parseDBDurability(journalMode, synchronous string) (dbDurability, error) {
+	d := dbDurability{journalMode: strings.ToUpper(journalMode), synchronous: strings.ToUpper(synchronous)}
+	if d.journalMode != "DELETE" && d.journalMode != "WAL" {
+		return d, fmt.Errorf("-db-journal-mode %q: must be DELETE or WAL", journalMode)
+	}
+	if d.synchronous != "FULL" && d.synchronous != "NORMAL" && d.synchronous != "OFF" {
+		return d, fmt.Errorf("-db-synchronous %q: must be FULL, NORMAL or OFF", synchronous)
+	}
+	return d, nil
 }
 
 // NewMAIDSmartMonitor creates a new monitor instance
-func NewMAIDSmartMonitor(dbPath string) (*MAIDSmartMonitor, error) {
+func NewMAIDSmartMonitor(dbPath string, durability dbDurability) (*MAIDSmartMonitor, error) {
 	// Target SMART attributes for monitoring
 	targetAttribs := map[int]string{
 		1:   "Raw_Read_Error_Rate",
@@ -92,29 +830,161 @@ func NewMAIDSmartMonitor(dbPath string) (*MAIDSmartMonitor, error) {
 		240: "Head_Flying_Hours",
 		241: "Total_LBAs_Written",
 		242: "Total_LBAs_Read",
+
+		// SSD wear: the normalized value counts down from 100 as rated
+		// endurance is used, whichever of these the vendor reports
+		177: "Wear_Leveling_Count",
+		231: "SSD_Life_Left",
+		233: "Media_Wearout_Indicator",
+	}
+
+	if dbPath != ":memory:" {
+		resolved, err := prepareDBPath(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		dbPath = resolved
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	// The busy timeout makes API reads and cycle writes wait on each other
+	// instead of failing with "database is locked". The driver applies the
+	// durability pragmas to every pooled connection, as synchronous is set per
+	// connection. Incremental auto-vacuum lets pruning hand space back to the
+	// filesystem; it takes effect on new databases, and on existing ones at
+	// their first VACUUM.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=5000&_journal_mode=%s&_synchronous=%s&_auto_vacuum=incremental",
+		dbPath, durability.journalMode, durability.synchronous))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
+	if dbPath == ":memory:" {
+		// Each connection to :memory: is a separate database, so keep to one
+		db.SetMaxOpenConns(1)
+	}
 
 	monitor := &MAIDSmartMonitor{
 		db:            db,
 		dbPath:        dbPath,
 		targetAttribs: targetAttribs,
-		logger:        log.New(os.Stdout, "[MAID-SMART] ", log.LstdFlags),
+		logger:        log.New(levelWriter(os.Stdout, "info"), "[MAID-SMART] ", log.LstdFlags),
+		debugLogger:   log.New(levelWriter(os.Stdout, "debug"), "[MAID-SMART] ", log.LstdFlags),
+		warnLogger:    log.New(levelWriter(os.Stderr, "warn"), "[MAID-SMART] ", log.LstdFlags),
+		errLogger:     log.New(os.Stderr, "[MAID-SMART] ", log.LstdFlags),
+		runner:        execRunner{},
+		discovery:     defaultDiscoverer(execRunner{}),
+		sysPath:       "/sys",
+		tempUnit:      "C",
+		exportFormat:  "csv",
+		pollOrder:     "active-first",
+
+		vendorThresholds: make(map[string]map[int]int),
+		criticalAttrs:    map[int]bool{5: true, 187: true, 196: true, 197: true, 198: true},
+		modelProfiles:    builtinModelProfiles,
+
+		escalateWarnAfter:     24 * time.Hour,
+		escalateCriticalAfter: 7 * 24 * time.Hour,
+
+		reallocationWindow: 24 * time.Hour,
+		reallocationLimit:  10,
+
+		uncorrectableWindow:    7 * 24 * time.Hour,
+		uncorrectableIncreases: 3,
+
+		errorRateDecline: 30,
+
+		replacement: defaultReplacementCriteria,
+
+		minFreeBytes:   100 << 20,
+		maxBuffered:    500,
+		storeHeartbeat: time.Hour,
+
+		backoff:          make(map[string]*deviceBackoff),
+		maxBackoffCycles: 32,
+
+		adaptiveMin: time.Minute,
+		adaptiveMax: time.Hour,
+		polls:       make(map[string]*devicePoll),
+
+		collectDevstat:    true,
+		collectHealth:     true,
+		collectAttributes: true,
+		collectSmartctl:   true,
+		classifyMedia:     true,
 	}
+	monitor.store = sqliteStore{monitor}
+	monitor.notifiers = []Notifier{logNotifier{monitor.errLogger}}
 
 	if err := monitor.initDatabase(); err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %v", err)
 	}
 
+	// SQLite keeps the old journal mode if it cannot switch, e.g. to WAL on a
+	// filesystem without shared memory support, and in-memory databases have none
+	var journalMode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		return nil, fmt.Errorf("failed to read journal mode: %v", err)
+	}
+	if dbPath != ":memory:" && !strings.EqualFold(journalMode, durability.journalMode) {
+		monitor.warnLogger.Printf("Database journal mode is %s; %s could not be set", journalMode, durability.journalMode)
+	}
+
+	monitor.writes = newDBWriter(writeQueueSize, 30*time.Second, monitor.errLogger)
+
 	return monitor, nil
 }
 
+// writeQueueSize bounds the number of database writes waiting for the writer goroutine
+const writeQueueSize = 256
+
+// prepareDBPath expands a leading ~, makes the path absolute, creates the parent
+// directory and confirms the database can be written, so a bad -db fails at
+// startup with a clear message instead of on the first insert
+func prepareDBPath(dbPath string) (string, error) {
+	if dbPath == "~" || strings.HasPrefix(dbPath, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("cannot expand %s: %v", dbPath, err)
+		}
+		dbPath = filepath.Join(home, strings.TrimPrefix(dbPath, "~"))
+	}
+
+	absPath, err := filepath.Abs(dbPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve database path %s: %v", dbPath, err)
+	}
+
+	dir := filepath.Dir(absPath)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", fmt.Errorf("cannot create database directory %s: %v", dir, err)
+	}
+
+	if _, err := os.Stat(absPath); err == nil {
+		f, err := os.OpenFile(absPath, os.O_RDWR, 0)
+		if err != nil {
+			return "", fmt.Errorf("database %s is not writable: %v", absPath, err)
+		}
+		f.Close()
+	} else {
+		f, err := ioutil.TempFile(dir, ".maid-smart-write-test-")
+		if err != nil {
+			return "", fmt.Errorf("database directory %s is not writable: %v", dir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	return absPath, nil
+}
+
 // Close closes the database connection
 func (m *MAIDSmartMonitor) Close() error {
+	m.notifyWG.Wait()
+	if len(m.buffered) > 0 {
+		m.errLogger.Printf("Discarding %d buffered readings that could not be stored", len(m.buffered))
+	}
+	if m.writes != nil {
+		m.writes.close()
+	}
 	return m.db.Close()
 }
 
@@ -134,28 +1004,108 @@ func (m *MAIDSmartMonitor) initDatabase() error {
 			threshold INTEGER,
 			worst_value INTEGER,
 			flags TEXT,
+			prefailure BOOLEAN,
+			updated_online BOOLEAN,
+			temp_min INTEGER,
+			temp_max INTEGER,
+			offline_status TEXT,
+			stale BOOLEAN,
+			smartctl_version TEXT,
+			json_format_version TEXT,
+			device_id TEXT,
+			raw_encoded BOOLEAN,
 			UNIQUE(device, timestamp, attribute_id)
 		)`,
-		`CREATE TABLE IF NOT EXISTS device_status (
-			device TEXT PRIMARY KEY,
-			serial_number TEXT,
-			model TEXT,
-			last_seen DATETIME,
-			is_mounted BOOLEAN,
-			mount_point TEXT,
-			smart_enabled BOOLEAN,
-			last_smart_check DATETIME,
-			spin_up_count INTEGER DEFAULT 0
-		)`,
+		deviceStatusSchema,
 		`CREATE TABLE IF NOT EXISTS health_alerts (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			device TEXT NOT NULL,
+			device_id TEXT,
 			attribute_name TEXT NOT NULL,
 			alert_type TEXT NOT NULL,
+			severity TEXT,
 			message TEXT NOT NULL,
+			first_seen DATETIME,
+			timestamp DATETIME NOT NULL,
+			resolved BOOLEAN DEFAULT FALSE,
+			resolved_at DATETIME,
+			maintenance BOOLEAN DEFAULT FALSE,
+			suppressed BOOLEAN DEFAULT FALSE
+		)`,
+		`CREATE TABLE IF NOT EXISTS alert_suppressions (
+			serial_number TEXT NOT NULL,
+			match TEXT NOT NULL,
+			reason TEXT,
+			created DATETIME NOT NULL,
+			PRIMARY KEY (serial_number, match)
+		)`,
+		`CREATE TABLE IF NOT EXISTS maintenance_windows (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device TEXT,
+			starts DATETIME NOT NULL,
+			ends DATETIME NOT NULL,
+			reason TEXT
+		)`,
+		`CREATE TABLE IF NOT EXISTS device_baselines (
+			serial_number TEXT NOT NULL,
+			attribute_id INTEGER NOT NULL,
+			attribute_name TEXT NOT NULL,
+			raw_value INTEGER,
+			normalized_value INTEGER,
+			timestamp DATETIME NOT NULL,
+			PRIMARY KEY(serial_number, attribute_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_smart_data_serial_attr ON smart_data(serial_number, attribute_id, timestamp)`,
+		`CREATE TABLE IF NOT EXISTS device_statistics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device_id TEXT NOT NULL,
+			device TEXT NOT NULL,
+			timestamp DATETIME NOT NULL,
+			page INTEGER NOT NULL,
+			page_name TEXT,
+			offset INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			value INTEGER,
+			UNIQUE(device_id, timestamp, page, offset)
+		)`,
+		`CREATE TABLE IF NOT EXISTS device_notes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			serial_number TEXT NOT NULL,
+			note TEXT NOT NULL,
+			timestamp DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_notes_serial ON device_notes(serial_number, timestamp)`,
+		`CREATE TABLE IF NOT EXISTS cycle_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL DEFAULT 'cycle',
+			started DATETIME NOT NULL,
+			finished DATETIME NOT NULL,
+			first_id INTEGER NOT NULL,
+			last_id INTEGER NOT NULL,
+			record_count INTEGER NOT NULL,
+			data_hash TEXT NOT NULL,
+			prev_hash TEXT NOT NULL,
+			hash TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS monitor_counters (
+			name TEXT PRIMARY KEY,
+			value INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS usb_device_types (
+			usb_id TEXT PRIMARY KEY,
+			device_type TEXT NOT NULL,
+			timestamp DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS raw_archive (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device_id TEXT NOT NULL,
+			device TEXT NOT NULL,
 			timestamp DATETIME NOT NULL,
-			resolved BOOLEAN DEFAULT FALSE
+			archive_path TEXT NOT NULL,
+			offset INTEGER NOT NULL,
+			length INTEGER NOT NULL
 		)`,
+		`CREATE INDEX IF NOT EXISTS idx_raw_archive_device_id ON raw_archive(device_id, timestamp)`,
 	}
 
 	for _, query := range queries {
@@ -164,477 +1114,9258 @@ func (m *MAIDSmartMonitor) initDatabase() error {
 		}
 	}
 
-	m.logger.Printf("Database initialized: %s", m.dbPath)
-	return nil
-}
-
-// getMountedDrives returns list of currently mounted drives to avoid spinning up idle disks
-func (m *MAIDSmartMonitor) getMountedDrives() ([]string, error) {
-	content, err := ioutil.ReadFile("/proc/mounts")
-	if err != nil {
-		return nil, fmt.Errorf("failed to read /proc/mounts: %v", err)
+	// Bring databases created by older versions up to the current schema
+	columns := []struct{ table, column, definition string }{
+		{"smart_data", "smartctl_version", "TEXT"},
+		{"smart_data", "json_format_version", "TEXT"},
+		{"device_status", "security_state", "TEXT"},
+		{"device_status", "is_locked", "BOOLEAN DEFAULT FALSE"},
+		{"health_alerts", "maintenance", "BOOLEAN DEFAULT FALSE"},
+		{"device_status", "wwn", "TEXT"},
+		{"smart_data", "device_id", "TEXT"},
+		{"health_alerts", "device_id", "TEXT"},
+		{"health_alerts", "severity", "TEXT"},
+		{"health_alerts", "first_seen", "DATETIME"},
+		{"smart_data", "prefailure", "BOOLEAN"},
+		{"smart_data", "updated_online", "BOOLEAN"},
+		{"smart_data", "temp_min", "INTEGER"},
+		{"smart_data", "temp_max", "INTEGER"},
+		{"smart_data", "offline_status", "TEXT"},
+		{"smart_data", "stale", "BOOLEAN"},
+		{"smart_data", "raw_encoded", "BOOLEAN"},
+		{"device_status", "health_status", "TEXT"},
+		{"device_status", "last_health_check", "DATETIME"},
+		{"device_status", "last_active", "DATETIME"},
+		{"device_status", "self_test_status", "TEXT"},
+		{"device_status", "self_test_code", "INTEGER"},
+		{"device_status", "self_test_percent", "INTEGER"},
+		{"health_alerts", "suppressed", "BOOLEAN DEFAULT FALSE"},
+		{"device_status", "bay", "TEXT"},
+		{"device_status", "media_type", "TEXT"},
+		{"device_status", "rotation_rate", "INTEGER"},
+		{"device_status", "capacity_bytes", "INTEGER"},
+		{"device_status", "form_factor", "TEXT"},
+		{"device_status", "logical_sector_size", "INTEGER"},
+		{"device_status", "written_unit_bytes", "INTEGER"},
+		{"device_status", "read_unit_bytes", "INTEGER"},
+		{"device_status", "nvme_warning_temp_time", "INTEGER"},
+		{"device_status", "nvme_critical_temp_time", "INTEGER"},
+		{"device_status", "nvme_throttle_count", "INTEGER"},
+		{"device_status", "nvme_throttle_time", "INTEGER"},
+		{"cycle_log", "kind", "TEXT NOT NULL DEFAULT 'cycle'"},
+		{"health_alerts", "resolved_at", "DATETIME"},
+	}
+	for _, c := range columns {
+		if err := m.addColumnIfMissing(c.table, c.column, c.definition); err != nil {
+			return err
+		}
 	}
 
-	var mountedDrives []string
-	deviceMap := make(map[string]bool)
-
-	// Regex to match device names like /dev/sda1, /dev/nvme0n1p1, etc.
-	deviceRegex := regexp.MustCompile(`^(/dev/[a-z]+)`)
+	if err := m.rekeyDeviceStatus(); err != nil {
+		return err
+	}
 
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) >= 2 {
-			device := fields[0]
-			if strings.HasPrefix(device, "/dev/sd") || strings.HasPrefix(device, "/dev/nvme") {
-				// Extract base device name (e.g., /dev/sda1 -> /dev/sda)
-				matches := deviceRegex.FindStringSubmatch(device)
-				if len(matches) > 1 {
-					baseDevice := matches[1]
-					// Remove partition numbers for SATA drives
-					baseDeviceClean := regexp.MustCompile(`\d+$`).ReplaceAllString(baseDevice, "")
-					if !deviceMap[baseDeviceClean] {
-						deviceMap[baseDeviceClean] = true
-						mountedDrives = append(mountedDrives, baseDeviceClean)
-					}
-				}
-			}
+	upgrades := []string{
+		`UPDATE health_alerts SET first_seen = timestamp WHERE first_seen IS NULL`,
+		`UPDATE device_status SET last_active = last_seen WHERE last_active IS NULL`,
+		`UPDATE health_alerts SET severity = 'WARN' WHERE severity IS NULL`,
+		`UPDATE smart_data SET device_id = COALESCE(NULLIF(serial_number, ''), device) WHERE device_id IS NULL`,
+		`UPDATE health_alerts SET device_id = COALESCE(
+			(SELECT device_id FROM device_status WHERE device_status.device = health_alerts.device), device)
+		 WHERE device_id IS NULL`,
+		// Older rows hold flags as a printed Go map, e.g. "map[prefailure:true ...]"
+		`UPDATE smart_data SET prefailure = (flags LIKE '%prefailure:true%'),
+			updated_online = (flags LIKE '%updated_online:true%')
+		 WHERE prefailure IS NULL AND flags LIKE 'map[%'`,
+		`CREATE INDEX IF NOT EXISTS idx_smart_data_device_id ON smart_data(device_id, attribute_id, timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_health_alerts_device_id ON health_alerts(device_id, resolved)`,
+	}
+	for _, query := range upgrades {
+		if _, err := m.db.Exec(query); err != nil {
+			return fmt.Errorf("failed to execute query: %v", err)
 		}
 	}
 
-	m.logger.Printf("Found %d mounted drives: %v", len(mountedDrives), mountedDrives)
-	return mountedDrives, nil
+	m.debugLogger.Printf("Database initialized: %s", m.dbPath)
+	return nil
 }
 
-// checkSmartSupport checks if device supports SMART without spinning it up
-func (m *MAIDSmartMonitor) checkSmartSupport(device string) bool {
-	cmd := exec.Command("smartctl", "--nocheck=standby", "-i", device)
-	output, err := cmd.Output()
-	if err != nil {
-		m.logger.Printf("SMART support check failed for %s: %v", device, err)
-		return false
-	}
-
-	return strings.Contains(string(output), "SMART support is: Enabled")
-}
+// deviceStatusSchema keys device status by stable device identity; device holds
+// the /dev path the drive was last seen at
+const deviceStatusSchema = `CREATE TABLE IF NOT EXISTS device_status (
+			device_id TEXT PRIMARY KEY,
+			device TEXT,
+			serial_number TEXT,
+			model TEXT,
+			wwn TEXT,
+			last_seen DATETIME,
+			is_mounted BOOLEAN,
+			mount_point TEXT,
+			smart_enabled BOOLEAN,
+			last_smart_check DATETIME,
+			spin_up_count INTEGER DEFAULT 0,
+			security_state TEXT,
+			is_locked BOOLEAN DEFAULT FALSE,
+			health_status TEXT,
+			last_health_check DATETIME,
+			last_active DATETIME,
+			self_test_status TEXT,
+			self_test_code INTEGER,
+			self_test_percent INTEGER,
+			bay TEXT,
+			media_type TEXT,
+			rotation_rate INTEGER,
+			capacity_bytes INTEGER,
+			form_factor TEXT,
+			logical_sector_size INTEGER,
+			written_unit_bytes INTEGER,
+			read_unit_bytes INTEGER,
+			nvme_warning_temp_time INTEGER,
+			nvme_critical_temp_time INTEGER,
+			nvme_throttle_count INTEGER,
+			nvme_throttle_time INTEGER
+		)`
 
-// getDeviceInfo gets device serial number and model without spinning up
-func (m *MAIDSmartMonitor) getDeviceInfo(device string) (string, string, error) {
-	cmd := exec.Command("smartctl", "--nocheck=standby", "-i", device)
-	output, err := cmd.Output()
+// columnExists reports whether table has the named column
+func (m *MAIDSmartMonitor) columnExists(table, column string) (bool, error) {
+	rows, err := m.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return "", "", fmt.Errorf("failed to get device info: %v", err)
+		return false, fmt.Errorf("failed to read schema of %s: %v", table, err)
 	}
+	defer rows.Close()
 
-	var serial, model string
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "Serial Number:") {
-			parts := strings.Split(line, "Serial Number:")
-			if len(parts) > 1 {
-				serial = strings.TrimSpace(parts[1])
-			}
-		} else if strings.Contains(line, "Device Model:") || strings.Contains(line, "Model Number:") {
-			parts := strings.Split(line, ":")
-			if len(parts) > 1 {
-				model = strings.TrimSpace(parts[1])
-			}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue interface{}
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, fmt.Errorf("failed to scan schema of %s: %v", table, err)
+		}
+		if name == column {
+			return true, nil
 		}
 	}
 
-	return serial, model, nil
-}
-
-// isDeviceInStandby checks if device is in standby mode
-func (m *MAIDSmartMonitor) isDeviceInStandby(device string) bool {
-	cmd := exec.Command("smartctl", "--nocheck=standby", "-n", "standby", device)
-	output, err := cmd.Output()
-	if err != nil {
-		return false
-	}
-
-	return strings.Contains(string(output), "STANDBY")
+	return false, rows.Err()
 }
 
-// collectSmartData collects SMART data from a device (only if already spinning)
-func (m *MAIDSmartMonitor) collectSmartData(device string) (*SmartData, error) {
-	// First check if device is in standby mode
-	if m.isDeviceInStandby(device) {
-		m.logger.Printf("Device %s is in standby mode - skipping to avoid spin-up", device)
-		return nil, nil
-	}
-
-	// Device is already spinning, safe to collect SMART data
-	cmd := exec.Command("smartctl", "-A", "--json", device)
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to collect SMART data: %v", err)
-	}
-
-	var smartData SmartData
-	if err := json.Unmarshal(output, &smartData); err != nil {
-		return nil, fmt.Errorf("failed to parse SMART JSON: %v", err)
+// addColumnIfMissing adds a column to an existing table unless it is already present
+func (m *MAIDSmartMonitor) addColumnIfMissing(table, column, definition string) error {
+	exists, err := m.columnExists(table, column)
+	if err != nil || exists {
+		return err
 	}
 
-	return &smartData, nil
-}
-
-// parseSmartAttributes parses and filters SMART attributes for target IDs
-func (m *MAIDSmartMonitor) parseSmartAttributes(smartData *SmartData, device string) []map[string]interface{} {
-	var attributes []map[string]interface{}
-
-	for _, attr := range smartData.ATASmartAttributes.Table {
-		if name, exists := m.targetAttribs[attr.ID]; exists {
-			rawValue := int64(0)
-			if val, ok := attr.Raw["value"]; ok {
-				switch v := val.(type) {
-				case float64:
-					rawValue = int64(v)
-				case int64:
-					rawValue = v
-				case string:
-					if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
-						rawValue = parsed
-					}
-				}
-			}
-
-			attributes = append(attributes, map[string]interface{}{
-				"device":           device,
-				"attribute_id":     attr.ID,
-				"attribute_name":   name,
-				"raw_value":        rawValue,
-				"normalized_value": attr.Value,
-				"threshold":        attr.Thresh,
-				"worst_value":      attr.Worst,
-				"flags":            fmt.Sprintf("%+v", attr.Flags),
-			})
-		}
+	if _, err := m.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
 	}
-
-	return attributes
+	return nil
 }
 
-// storeSmartData stores SMART attributes in database
-func (m *MAIDSmartMonitor) storeSmartData(attributes []map[string]interface{}, serial, model string) error {
-	if len(attributes) == 0 {
-		return nil
+// rekeyDeviceStatus rebuilds a device_status table created by older versions,
+// which was keyed by /dev path, so that it is keyed by device identity instead
+func (m *MAIDSmartMonitor) rekeyDeviceStatus() error {
+	rekeyed, err := m.columnExists("device_status", "device_id")
+	if err != nil || rekeyed {
+		return err
 	}
 
-	timestamp := time.Now()
-
 	tx, err := m.db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(`
-		INSERT OR REPLACE INTO smart_data 
-		(device, serial_number, model, timestamp, attribute_id, attribute_name,
-		 raw_value, normalized_value, threshold, worst_value, flags)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %v", err)
+	statements := []string{
+		`ALTER TABLE device_status RENAME TO device_status_old`,
+		deviceStatusSchema,
+		`INSERT OR REPLACE INTO device_status
+		 (device_id, device, serial_number, model, wwn, last_seen, is_mounted, mount_point,
+		  smart_enabled, last_smart_check, spin_up_count, security_state, is_locked)
+		 SELECT COALESCE(NULLIF(serial_number, ''), device), device, serial_number, model, wwn,
+		        last_seen, is_mounted, mount_point, smart_enabled, last_smart_check,
+		        spin_up_count, security_state, is_locked
+		 FROM device_status_old ORDER BY last_seen`,
+		`DROP TABLE device_status_old`,
 	}
-	defer stmt.Close()
-
-	for _, attr := range attributes {
-		_, err := stmt.Exec(
-			attr["device"], serial, model, timestamp,
-			attr["attribute_id"], attr["attribute_name"],
-			attr["raw_value"], attr["normalized_value"],
-			attr["threshold"], attr["worst_value"], attr["flags"],
-		)
-		if err != nil {
-			return fmt.Errorf("failed to insert attribute: %v", err)
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to re-key device_status: %v", err)
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return fmt.Errorf("failed to commit device_status re-key: %v", err)
 	}
 
-	m.logger.Printf("Stored %d SMART attributes for %s", len(attributes), attributes[0]["device"])
+	m.logger.Println("Re-keyed device_status by device identity")
 	return nil
 }
 
-// updateDeviceStatus updates device status in database
-func (m *MAIDSmartMonitor) updateDeviceStatus(device, serial, model string, isMounted, smartEnabled bool) error {
-	_, err := m.db.Exec(`
-		INSERT OR REPLACE INTO device_status
-		(device, serial_number, model, last_seen, is_mounted, 
-		 smart_enabled, last_smart_check)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, device, serial, model, time.Now(), isMounted, smartEnabled, time.Now())
-
-	return err
+// driveDiscoverer lists the drives to monitor. Each platform has a default (see
+// defaultDiscoverer in the platform files); -discovery overrides it.
+type driveDiscoverer interface {
+	Drives() ([]string, error)
 }
 
-// checkHealthThresholds checks for potential health issues and generates alerts
-func (m *MAIDSmartMonitor) checkHealthThresholds(attributes []map[string]interface{}) {
-	criticalAttrs := map[int]bool{5: true, 187: true, 196: true, 197: true, 198: true}
+// mountsDiscoverer finds drives with a mounted partition in a mount table such as
+// /proc/mounts, to avoid spinning up idle disks
+type mountsDiscoverer struct {
+	path string
+}
 
-	for _, attr := range attributes {
-		attrID := attr["attribute_id"].(int)
-		device := attr["device"].(string)
-		rawValue := attr["raw_value"].(int64)
-		normalizedValue := attr["normalized_value"].(int)
-		threshold := attr["threshold"].(int)
-		attrName := attr["attribute_name"].(string)
+// Drives returns the whole-disk devices of the mounted partitions
+func (d mountsDiscoverer) Drives() ([]string, error) {
+	content, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", d.path, err)
+	}
 
-		// Check for threshold violations
-		if threshold > 0 && normalizedValue <= threshold {
-			m.createAlert(device, attrName, "THRESHOLD_VIOLATION",
-				fmt.Sprintf("Value %d below threshold %d", normalizedValue, threshold))
-		}
+	var mountedDrives []string
+	deviceMap := make(map[string]bool)
 
-		// Check critical attributes
-		if criticalAttrs[attrID] && rawValue > 0 {
-			m.createAlert(device, attrName, "CRITICAL_VALUE",
-				fmt.Sprintf("Non-zero critical value: %d", rawValue))
-		}
+	// Regex to match device names like /dev/sda1, /dev/nvme0n1p1, etc.
+	deviceRegex := regexp.MustCompile(`^(/dev/sd[a-z]+|/dev/nvme\d+n\d+)(p?\d+)?$`)
 
-		// Temperature warnings
-		if (attrID == 190 || attrID == 194) && rawValue > 60 {
-			m.createAlert(device, attrName, "HIGH_TEMPERATURE",
-				fmt.Sprintf("High temperature: %d°C", rawValue))
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			device := fields[0]
+			// Device-mapper volumes (LVM, multipath) are resolved to their
+			// drives by canonicalDevice
+			baseDevice := ""
+			if strings.HasPrefix(device, "/dev/mapper/") || strings.HasPrefix(device, "/dev/dm-") {
+				baseDevice = device
+			} else if matches := deviceRegex.FindStringSubmatch(device); len(matches) > 1 {
+				// Extract base device name (e.g., /dev/sda1 -> /dev/sda)
+				baseDevice = matches[1]
+			}
+			if baseDevice != "" && !deviceMap[baseDevice] {
+				deviceMap[baseDevice] = true
+				mountedDrives = append(mountedDrives, baseDevice)
+			}
 		}
 	}
-}
-
-// createAlert creates health alert in database
-func (m *MAIDSmartMonitor) createAlert(device, attribute, alertType, message string) {
-	_, err := m.db.Exec(`
-		INSERT INTO health_alerts 
-		(device, attribute_name, alert_type, message, timestamp)
-		VALUES (?, ?, ?, ?, ?)
-	`, device, attribute, alertType, message, time.Now())
 
-	if err != nil {
-		m.logger.Printf("Failed to create alert: %v", err)
-	} else {
-		m.logger.Printf("HEALTH ALERT - %s: %s - %s", device, attribute, message)
-	}
+	return mountedDrives, nil
 }
 
-// runMonitoringCycle runs a single monitoring cycle
-func (m *MAIDSmartMonitor) runMonitoringCycle() error {
-	m.logger.Println("Starting SMART monitoring cycle...")
+// scanDiscoverer lists every drive smartctl --scan reports, mounted or not. With
+// physicalDrives set, smartctl's /dev/sdX names are turned into the /dev/pdN
+// form, which smartctl on Windows maps to \\.\PhysicalDriveN.
+type scanDiscoverer struct {
+	runner         smartctlRunner
+	physicalDrives bool
+}
 
-	mountedDrives, err := m.getMountedDrives()
+// Drives returns the device names from "smartctl --scan" lines such as
+// "/dev/sda -d ata # /dev/sda, ATA device"
+func (d scanDiscoverer) Drives() ([]string, error) {
+	output, err := d.runner.Run("--scan")
 	if err != nil {
-		return fmt.Errorf("failed to get mounted drives: %v", err)
+		return nil, fmt.Errorf("failed to scan for drives: %v", err)
 	}
 
-	for _, device := range mountedDrives {
-		m.logger.Printf("Processing device: %s", device)
-
-		// Get device info without spinning up
-		serial, model, err := m.getDeviceInfo(device)
-		if err != nil {
-			m.logger.Printf("Failed to get device info for %s: %v", device, err)
+	var drives []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
 			continue
 		}
+		device := fields[0]
+		if d.physicalDrives {
+			device = physicalDriveName(device)
+		}
+		drives = append(drives, device)
+	}
 
-		smartEnabled := m.checkSmartSupport(device)
+	return drives, nil
+}
 
-		// Update device status
-		if err := m.updateDeviceStatus(device, serial, model, true, smartEnabled); err != nil {
-			m.logger.Printf("Failed to update device status for %s: %v", device, err)
-		}
+// physicalDriveName converts smartctl's /dev/sdX naming of Windows disks into
+// /dev/pdN, where sda is PhysicalDrive0, sdb PhysicalDrive1, ..., sdaa PhysicalDrive26
+func physicalDriveName(device string) string {
+	letters := strings.TrimPrefix(device, "/dev/sd")
+	if letters == device || letters == "" {
+		return device
+	}
 
-		if !smartEnabled {
-			m.logger.Printf("SMART not supported/enabled on %s", device)
-			continue
+	n := 0
+	for _, c := range letters {
+		if c < 'a' || c > 'z' {
+			return device
 		}
+		n = n*26 + int(c-'a'+1)
+	}
+	return fmt.Sprintf("/dev/pd%d", n-1)
+}
 
-		// Collect SMART data (only if device is already spinning)
-		smartData, err := m.collectSmartData(device)
-		if err != nil {
-			m.logger.Printf("Error collecting SMART data for %s: %v", device, err)
-			continue
-		}
+// getDrives returns the drives found by the configured discoverer, each
+// canonicalized and listed once
+func (m *MAIDSmartMonitor) getDrives() ([]string, error) {
+	found, err := m.discovery.Drives()
+	if err != nil {
+		return nil, err
+	}
 
-		if smartData != nil {
-			attributes := m.parseSmartAttributes(smartData, device)
-			if len(attributes) > 0 {
-				if err := m.storeSmartData(attributes, serial, model); err != nil {
-					m.logger.Printf("Failed to store SMART data for %s: %v", device, err)
-				} else {
-					m.checkHealthThresholds(attributes)
-				}
-			} else {
-				m.logger.Printf("No target SMART attributes found for %s", device)
+	var drives []string
+	seen := make(map[string]bool)
+	for _, found := range found {
+		for _, device := range m.canonicalDevices(found) {
+			if strings.HasPrefix(device, "/dev/mapper/") || strings.HasPrefix(device, "/dev/dm-") {
+				m.debugLogger.Printf("Skipping %s: not on a drive smartctl can read", device)
+				continue
+			}
+			if !seen[device] {
+				seen[device] = true
+				drives = append(drives, device)
 			}
-		} else {
-			m.logger.Printf("No SMART data collected for %s (likely in standby)", device)
 		}
 	}
 
-	m.logger.Println("Monitoring cycle completed")
-	return nil
+	m.debugLogger.Printf("Found %d drives: %v", len(drives), drives)
+	return drives, nil
 }
 
-// getHealthSummary gets health summary from database
-func (m *MAIDSmartMonitor) getHealthSummary() (map[string]interface{}, error) {
-	// Get alerts by device
-	rows, err := m.db.Query(`
-		SELECT device, COUNT(*) as alert_count
-		FROM health_alerts 
-		WHERE resolved = FALSE 
-		GROUP BY device
-	`)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query alerts: %v", err)
+// withExtraDevices appends the -devices list to the discovered drives, each
+// canonicalized and skipped if the same drive is already listed
+func (m *MAIDSmartMonitor) withExtraDevices(drives []string) []string {
+	if len(m.extraDevices) == 0 {
+		return drives
 	}
-	defer rows.Close()
 
-	alertsByDevice := make(map[string]int)
-	for rows.Next() {
-		var device string
-		var count int
-		if err := rows.Scan(&device, &count); err != nil {
-			return nil, fmt.Errorf("failed to scan alert row: %v", err)
+	devices := append([]string{}, drives...)
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		seen[device] = true
+	}
+	for _, extra := range m.extraDevices {
+		for _, device := range m.canonicalDevices(extra) {
+			if !seen[device] {
+				seen[device] = true
+				devices = append(devices, device)
+			}
 		}
-		alertsByDevice[device] = count
 	}
+	return devices
+}
 
-	// Get device count
-	var deviceCount int
-	err = m.db.QueryRow("SELECT COUNT(DISTINCT device) FROM device_status").Scan(&deviceCount)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get device count: %v", err)
+// nvmeNamespaceRegex matches NVMe namespaces (nvme0n1), their partitions
+// (nvme0n1p2) and native multipath's per-controller paths (nvme0c1n1)
+var nvmeNamespaceRegex = regexp.MustCompile(`^/dev/nvme(\d+)(?:c(\d+))?n\d+(?:p\d+)?$`)
+
+// canonicalDevices maps a discovered path to the drives under it, each by the
+// single path canonicalDevice gives it. A device-mapper volume (/dev/dm-N,
+// /dev/mapper/NAME) maps to the drives of all its members, so an LVM volume
+// spanning several disks monitors each of them; a multipath device's members
+// are paths to one drive, so it maps to its first. A volume whose members
+// cannot be resolved is returned unchanged.
+func (m *MAIDSmartMonitor) canonicalDevices(device string) []string {
+	if !strings.HasPrefix(device, "/dev/dm-") && !strings.HasPrefix(device, "/dev/mapper/") {
+		return []string{m.canonicalDevice(device)}
 	}
 
-	return map[string]interface{}{
-		"total_devices":       deviceCount,
-		"devices_with_alerts": len(alertsByDevice),
-		"alerts_by_device":    alertsByDevice,
-	}, nil
+	members := m.deviceMapperMembers(device)
+	if len(members) == 0 {
+		return []string{device}
+	}
+	var devices []string
+	for _, member := range members {
+		devices = append(devices, m.canonicalDevices(member)...)
+	}
+	return devices
 }
 
-// exportData exports SMART data to CSV for analysis
-func (m *MAIDSmartMonitor) exportData(outputFile string, days int) error {
-	rows, err := m.db.Query(`
-		SELECT * FROM smart_data 
-		WHERE timestamp >= datetime('now', '-' || ? || ' days')
-		ORDER BY device, timestamp, attribute_id
-	`, days)
-	if err != nil {
-		return fmt.Errorf("failed to query data: %v", err)
+// canonicalDevice maps the several paths of one drive to a single one so that it
+// is not tracked (or its health counted) twice:
+//   - SCSI generic (/dev/sgN) and bsg (/dev/bsg/H:C:T:L) nodes, through which SAS
+//     drives are often addressed, map to the drive's block device
+//   - NVMe namespaces and their partitions map to the controller (/dev/nvme0n2 to
+//     /dev/nvme0), whose SMART/health log covers every namespace
+//
+// Paths that cannot be resolved, such as enclosures or drives without an sd
+// driver, are returned unchanged.
+func (m *MAIDSmartMonitor) canonicalDevice(device string) string {
+	if matches := nvmeNamespaceRegex.FindStringSubmatch(device); matches != nil {
+		if matches[2] != "" {
+			return "/dev/nvme" + matches[2]
+		}
+		return "/dev/nvme" + matches[1]
 	}
-	defer rows.Close()
 
-	file, err := os.Create(outputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+	var class string
+	switch {
+	case strings.HasPrefix(device, "/dev/sg"):
+		class = "scsi_generic"
+	case strings.HasPrefix(device, "/dev/bsg/"):
+		class = "bsg"
+	default:
+		return device
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write header
-	columns, err := rows.Columns()
-	if err != nil {
-		return fmt.Errorf("failed to get columns: %v", err)
+	matches, _ := filepath.Glob(filepath.Join(m.sysPath, "class", class, filepath.Base(device), "device", "block", "*"))
+	if len(matches) == 0 {
+		return device
 	}
-	writer.Write(columns)
+	return "/dev/" + filepath.Base(matches[0])
+}
 
-	// Write data
-	for rows.Next() {
-		values := make([]interface{}, len(columns))
-		valuePtrs := make([]interface{}, len(columns))
-		for i := range values {
-			valuePtrs[i] = &values[i]
+// deviceMapperMembers returns the whole-disk devices under the members (in sysfs
+// "slaves") of a device-mapper volume, each once and skipping those that are not
+// drives, as for LVM on software RAID. For a multipath device only the first
+// member is returned, since every member is a path to the same drive.
+func (m *MAIDSmartMonitor) deviceMapperMembers(device string) []string {
+	name := filepath.Base(device)
+	if strings.HasPrefix(device, "/dev/mapper/") {
+		// /dev/mapper names are aliases; sysfs records each dm-N's name
+		name = ""
+		nameFiles, _ := filepath.Glob(filepath.Join(m.sysPath, "block", "dm-*", "dm", "name"))
+		for _, nameFile := range nameFiles {
+			if content, err := ioutil.ReadFile(nameFile); err == nil && strings.TrimSpace(string(content)) == filepath.Base(device) {
+				name = filepath.Base(filepath.Dir(filepath.Dir(nameFile)))
+				break
+			}
 		}
-
-		if err := rows.Scan(valuePtrs...); err != nil {
-			return fmt.Errorf("failed to scan row: %v", err)
+		if name == "" {
+			return nil
 		}
+	}
 
-		record := make([]string, len(columns))
-		for i, val := range values {
-			if val != nil {
-				record[i] = fmt.Sprintf("%v", val)
+	members, _ := filepath.Glob(filepath.Join(m.sysPath, "block", name, "slaves", "*"))
+	sort.Strings(members)
+	if uuid, err := ioutil.ReadFile(filepath.Join(m.sysPath, "block", name, "dm", "uuid")); err == nil &&
+		strings.HasPrefix(string(uuid), "mpath-") && len(members) > 1 {
+		members = members[:1]
+	}
+
+	var disks []string
+	seen := make(map[string]bool)
+	for _, member := range members {
+		member = filepath.Base(member)
+
+		// A partition's sysfs directory sits inside its disk's
+		if _, err := os.Stat(filepath.Join(m.sysPath, "class", "block", member, "partition")); err == nil {
+			if dir, err := filepath.EvalSymlinks(filepath.Join(m.sysPath, "class", "block", member)); err == nil {
+				member = filepath.Base(filepath.Dir(dir))
 			}
 		}
-		writer.Write(record)
+		if !strings.HasPrefix(member, "sd") && !strings.HasPrefix(member, "nvme") && !strings.HasPrefix(member, "dm-") {
+			continue
+		}
+		if !seen[member] {
+			seen[member] = true
+			disks = append(disks, "/dev/"+member)
+		}
 	}
-
-	m.logger.Printf("Data exported to %s", outputFile)
-	return nil
+	return disks
 }
 
-func main() {
-	var (
-		dbPath   = flag.String("db", "maid_smart_data.db", "Database file path")
-		interval = flag.Int("interval", 300, "Monitoring interval in seconds")
-		daemon   = flag.Bool("daemon", false, "Run as daemon")
-		export   = flag.String("export", "", "Export data to CSV file")
-		summary  = flag.Bool("summary", false, "Show health summary")
-	)
-	flag.Parse()
+// deviceAccess is whether smartctl can reach a device well enough to collect from it
+type deviceAccess struct {
+	Device     string
+	DeviceType string // the -d type smartctl used, set by -device-types or autodetected
+	Serial     string
+	Standby    bool   // not checked, to avoid spinning it up
+	Problem    string // empty if collection will work
+}
 
-	monitor, err := NewMAIDSmartMonitor(*dbPath)
+// checkDeviceAccess makes the identification calls of a monitoring cycle against
+// every discovered and -devices drive and reports which would fail and why.
+// Drives in standby are reported as such rather than woken.
+func (m *MAIDSmartMonitor) checkDeviceAccess() ([]deviceAccess, error) {
+	drives, err := m.getDrives()
 	if err != nil {
-		log.Fatalf("Failed to create monitor: %v", err)
+		return nil, fmt.Errorf("failed to get drives: %v", err)
 	}
-	defer monitor.Close()
 
-	if *export != "" {
-		if err := monitor.exportData(*export, 30); err != nil {
-			log.Fatalf("Failed to export data: %v", err)
-		}
-		return
-	}
+	devices := m.withExtraDevices(drives)
+	m.detectUSBTypes(devices)
 
-	if *summary {
-		summary, err := monitor.getHealthSummary()
-		if err != nil {
-			log.Fatalf("Failed to get health summary: %v", err)
+	var results []deviceAccess
+	for _, device := range devices {
+		result := deviceAccess{Device: device}
+		if m.isDeviceInStandby(device) {
+			result.Standby = true
+			results = append(results, result)
+			continue
 		}
 
-		fmt.Println("MAID SMART Health Summary:")
-		fmt.Printf("Total devices: %v\n", summary["total_devices"])
-		fmt.Printf("Devices with alerts: %v\n", summary["devices_with_alerts"])
-
-		if alerts, ok := summary["alerts_by_device"].(map[string]int); ok {
-			for device, count := range alerts {
-				fmt.Printf("  %s: %d alerts\n", device, count)
-			}
+		var message string
+		result.DeviceType, message = m.probeDevice(device)
+		info, err := m.getDeviceInfo(device)
+		var enabled bool
+		if err == nil {
+			enabled, err = m.checkSmartSupport(device)
 		}
-		return
+		switch {
+		case err != nil && message != "":
+			result.Problem = message
+		case err != nil:
+			result.Problem = err.Error()
+		case !enabled:
+			result.Serial = info.SerialNumber
+			result.Problem = "SMART not supported or not enabled"
+		default:
+			result.Serial = info.SerialNumber
+		}
+		results = append(results, result)
 	}
 
-	if *daemon {
+	return results, nil
+}
+
+// printDeviceAccess writes a table of access check results and returns how many failed
+func printDeviceAccess(w io.Writer, results []deviceAccess) int {
+	failed := 0
+	fmt.Fprintf(w, "%-20s %-10s %-24s %s\n", "DEVICE", "TYPE", "SERIAL", "RESULT")
+	for _, r := range results {
+		result := "OK"
+		switch {
+		case r.Standby:
+			result = "standby, not checked"
+		case r.Problem != "":
+			result = "FAILED: " + r.Problem
+			failed++
+		}
+		deviceType := r.DeviceType
+		if deviceType == "" {
+			deviceType = "-"
+		}
+		serial := r.Serial
+		if serial == "" {
+			serial = "-"
+		}
+		fmt.Fprintf(w, "%-20s %-10s %-24s %s\n", r.Device, deviceType, serial, result)
+	}
+	return failed
+}
+
+// defaultSetupFile is where -setup offers to write its settings, for the
+// systemd unit's EnvironmentFile
+const defaultSetupFile = "/etc/default/maid-smart-monitor"
+
+// setupPrompter asks the -setup questions, offering a default for each
+type setupPrompter struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// ask prints question and returns the trimmed answer, or def if it is blank
+func (p setupPrompter) ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	if !p.in.Scan() {
+		return def
+	}
+	if answer := strings.TrimSpace(p.in.Text()); answer != "" {
+		return answer
+	}
+	return def
+}
+
+// confirm asks a yes/no question
+func (p setupPrompter) confirm(question string, def bool) bool {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer := strings.ToLower(p.ask(question+" ("+hint+")", ""))
+	if answer == "" {
+		return def
+	}
+	return strings.HasPrefix(answer, "y")
+}
+
+// runSetup is the -setup first-run wizard. It checks that smartctl is installed
+// and can read every drive, asks for the few settings a home NAS needs, and
+// writes them as MAID_SMART_ARGS in an environment file for the systemd unit.
+func (m *MAIDSmartMonitor) runSetup(in io.Reader, out io.Writer) error {
+	p := setupPrompter{in: bufio.NewScanner(in), out: out}
+
+	// With -command-prefix smartctl may only be in the PATH the prefix uses
+	version, _ := m.runner.Run("--version")
+	path, err := exec.LookPath("smartctl")
+	if err != nil && len(version) == 0 {
+		fmt.Fprintln(out, "smartctl was not found in PATH. Install smartmontools (e.g. apt install smartmontools) and run -setup again.")
+		return fmt.Errorf("smartctl not installed")
+	} else if err != nil {
+		path = "smartctl"
+	}
+	fmt.Fprintf(out, "Using %s: %s\n\n", path, strings.SplitN(strings.TrimSpace(string(version)), "\n", 2)[0])
+
+	mounted, err := m.discovery.Drives()
+	if err != nil {
+		return fmt.Errorf("failed to find mounted drives: %v", err)
+	}
+	scanner := scanDiscoverer{runner: m.runner, physicalDrives: runtime.GOOS == "windows"}
+	scanned, err := scanner.Drives()
+	if err != nil {
+		return fmt.Errorf("failed to scan for drives: %v", err)
+	}
+	isMounted := make(map[string]bool)
+	for _, device := range mounted {
+		isMounted[device] = true
+	}
+	var unmounted []string
+	for _, device := range scanned {
+		if !isMounted[device] {
+			unmounted = append(unmounted, device)
+		}
+	}
+	fmt.Fprintf(out, "Found %d drives with a mounted filesystem: %s\n", len(mounted), strings.Join(mounted, " "))
+
+	var extra []string
+	if len(unmounted) > 0 {
+		fmt.Fprintf(out, "and %d more without one: %s\n", len(unmounted), strings.Join(unmounted, " "))
+		if p.confirm("Monitor those too", true) {
+			m.discovery = scanner
+			extra = append(extra, "-discovery", "scan")
+		}
+	}
+
+	fmt.Fprintln(out, "\nChecking that every drive can be read (drives in standby are not woken):")
+	results, err := m.checkDeviceAccess()
+	if err != nil {
+		return err
+	}
+	if printDeviceAccess(out, results) > 0 {
+		fmt.Fprintln(out, "Some drives cannot be read. \"Permission denied\" means the monitor must run as root")
+		fmt.Fprintln(out, "(as the systemd unit does) or as a user with access to the disk devices.")
+	}
+
+	fmt.Fprintln(out, "\nThe standard attribute set is monitored. Reallocated, reported uncorrectable,")
+	fmt.Fprintln(out, "reallocation event, pending and offline uncorrectable sectors alert on any nonzero")
+	fmt.Fprintln(out, "value, and drives above 60°C raise a temperature warning.")
+	fmt.Fprintln(out)
+
+	db := p.ask("Database file", m.dbPath)
+	interval := p.ask("Seconds between checks", "600")
+	if n, err := strconv.Atoi(interval); err != nil || n <= 0 {
+		return fmt.Errorf("invalid interval %q", interval)
+	}
+	unit := strings.ToUpper(p.ask("Temperature unit, C or F", "C"))
+	if unit != "C" && unit != "F" {
+		return fmt.Errorf("invalid temperature unit %q", unit)
+	}
+	limit := p.ask("Warn once more than this many sectors are reallocated (0 disables)", "0")
+	if _, err := strconv.ParseInt(limit, 10, 64); err != nil {
+		return fmt.Errorf("invalid reallocated sector limit %q", limit)
+	}
+	webhook := p.ask("Webhook URL for alerts (blank for none; alerts are always logged)", "")
+	if webhook != "" {
+		if _, err := parseWebhookURLs([]string{webhook}); err != nil {
+			return err
+		}
+	}
+
+	args := append([]string{"-daemon", "-db", db, "-interval", interval}, extra...)
+	if unit != "C" {
+		args = append(args, "-temp-unit", unit)
+	}
+	if limit != "0" {
+		args = append(args, "-reallocated-limit", limit)
+	}
+	if webhook != "" {
+		args = append(args, "-webhook-url", webhook)
+	}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t\"'\\$") {
+			return fmt.Errorf("%q cannot be passed through an environment file; avoid spaces, quotes and $", arg)
+		}
+	}
+
+	file := p.ask("\nWrite settings to", defaultSetupFile)
+	if _, err := os.Stat(file); err == nil && !p.confirm(file+" exists, overwrite", false) {
+		return fmt.Errorf("not overwriting %s", file)
+	}
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "# maid-smart-monitor settings, written by -setup on %s\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(&content, "# Read by the systemd unit through EnvironmentFile=%s with\n", file)
+	fmt.Fprintln(&content, "# ExecStart=/usr/local/bin/maid-smart-monitor $MAID_SMART_ARGS")
+	if webhook == "" {
+		fmt.Fprintln(&content, "# To send alerts on, add e.g. -webhook-url https://hooks.example.com/smart")
+		fmt.Fprintln(&content, "# or -pagerduty-routing-key KEY to MAID_SMART_ARGS.")
+	}
+	fmt.Fprintf(&content, "MAID_SMART_ARGS=\"%s\"\n", strings.Join(args, " "))
+	if err := ioutil.WriteFile(file, content.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", file, err)
+	}
+
+	fmt.Fprintf(out, "\nWrote %s. In the systemd unit (see README), use:\n\n", file)
+	fmt.Fprintf(out, "  EnvironmentFile=%s\n", file)
+	fmt.Fprintln(out, "  ExecStart=/usr/local/bin/maid-smart-monitor $MAID_SMART_ARGS")
+	return nil
+}
+
+// probeDevice asks smartctl which -d type it uses for device, and for its error
+// message if it cannot open it (e.g. "Permission denied")
+func (m *MAIDSmartMonitor) probeDevice(device string) (string, string) {
+	if m.inputDir != "" {
+		return "capture", ""
+	}
+
+	output, _ := m.runner.Run("--nocheck=standby", "-i", "--json", device)
+	var probe struct {
+		Device struct {
+			Type string `json:"type"`
+		} `json:"device"`
+		Smartctl struct {
+			Messages []struct {
+				String   string `json:"string"`
+				Severity string `json:"severity"`
+			} `json:"messages"`
+		} `json:"smartctl"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return "", ""
+	}
+
+	for _, msg := range probe.Smartctl.Messages {
+		if msg.Severity == "error" {
+			return probe.Device.Type, msg.String
+		}
+	}
+	return probe.Device.Type, ""
+}
+
+// usbQuirks lists, by USB vendor:product ID, the smartctl -d types that reach the
+// drive behind common USB-SATA bridges, in the order they are tried. Bridges not
+// listed are left to smartctl's autodetection (or -device-types).
+var usbQuirks = map[string][]string{
+	"174c:55aa": {"sat", "sat,12"},              // ASMedia ASM1051E/ASM1053E/ASM1153E
+	"174c:1153": {"sat", "sat,12"},              // ASMedia ASM1153
+	"174c:5106": {"sat,12", "sat"},              // ASMedia ASM1051
+	"152d:0567": {"sat", "sat,12"},              // JMicron JMS567
+	"152d:0578": {"sat", "sat,12"},              // JMicron JMS578
+	"152d:2329": {"usbjmicron", "sat"},          // JMicron JM20329
+	"152d:2336": {"usbjmicron"},                 // JMicron JM20336
+	"152d:2338": {"usbjmicron", "sat"},          // JMicron JM20337/JM20338
+	"152d:2339": {"usbjmicron,x", "usbjmicron"}, // JMicron JM20339
+	"04fc:0c15": {"usbsunplus"},                 // Sunplus SPIF215
+	"04fc:0c25": {"usbsunplus"},                 // Sunplus SPIF225
+	"04b4:6830": {"usbcypress"},                 // Cypress CY7C68300
+	"067b:2507": {"usbprolific", "sat"},         // Prolific PL2507
+}
+
+// usbDeviceType is the -d type that worked for a device path, with the ID of the
+// USB bridge it was found for, so a path reused by another enclosure is redetected
+type usbDeviceType struct {
+	usbID      string
+	deviceType string
+}
+
+// usbID returns the vendor:product ID of the USB device a block device sits
+// behind, read from sysfs, or "" if it is not attached over USB
+func (m *MAIDSmartMonitor) usbID(device string) string {
+	dir, err := filepath.EvalSymlinks(filepath.Join(m.sysPath, "block", filepath.Base(device), "device"))
+	if err != nil {
+		return ""
+	}
+	for ; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		vendor, err := ioutil.ReadFile(filepath.Join(dir, "idVendor"))
+		if err != nil {
+			continue
+		}
+		product, err := ioutil.ReadFile(filepath.Join(dir, "idProduct"))
+		if err != nil {
+			continue
+		}
+		return strings.ToLower(strings.TrimSpace(string(vendor)) + ":" + strings.TrimSpace(string(product)))
+	}
+	return ""
+}
+
+// detectUSBTypes finds the -d type for each device behind a USB bridge in
+// usbQuirks that no -device-types rule covers: the type stored in
+// usb_device_types if one worked for that bridge before, else the first quirk
+// type with which smartctl can identify the drive. typedRunner then passes it on
+// every call. A drive in standby fails every type and is tried again next cycle.
+func (m *MAIDSmartMonitor) detectUSBTypes(devices []string) {
+	if m.inputDir != "" {
+		return
+	}
+
+	typed, _ := m.runner.(typedRunner)
+	for _, device := range devices {
+		id := m.usbID(device)
+		if known, ok := m.usbTypes.Load(device); ok && known.(usbDeviceType).usbID == id {
+			continue
+		}
+		m.usbTypes.Delete(device)
+		if id == "" || typed.ruleType(device) != "" {
+			continue
+		}
+
+		var stored string
+		err := m.db.QueryRow(`SELECT device_type FROM usb_device_types WHERE usb_id = ?`, id).Scan(&stored)
+		if err == nil {
+			m.usbTypes.Store(device, usbDeviceType{usbID: id, deviceType: stored})
+			continue
+		}
+		if err != sql.ErrNoRows {
+			m.errLogger.Printf("Failed to read stored device type for USB %s: %v", id, err)
+			continue
+		}
+
+		for _, deviceType := range usbQuirks[id] {
+			output, err := m.runner.Run("--nocheck=standby", "-i", "-d", deviceType, device)
+			if err != nil || !strings.Contains(string(output), "Serial Number:") {
+				m.debugLogger.Printf("USB bridge %s on %s does not work with -d %s", id, device, deviceType)
+				continue
+			}
+
+			m.logger.Printf("USB bridge %s on %s works with -d %s", id, device, deviceType)
+			m.usbTypes.Store(device, usbDeviceType{usbID: id, deviceType: deviceType})
+			err = m.writes.do("USB device type", func() error {
+				_, err := m.db.Exec(`INSERT OR REPLACE INTO usb_device_types (usb_id, device_type, timestamp)
+					VALUES (?, ?, ?)`, id, deviceType, time.Now())
+				return err
+			})
+			if err != nil {
+				m.errLogger.Printf("Failed to store device type for USB %s: %v", id, err)
+			}
+			break
+		}
+	}
+}
+
+// checkSmartSupport checks if device supports SMART without spinning it up. It
+// returns false only when smartctl says SMART is disabled or unavailable; a
+// failed or inconclusive check is an error, so it never reads as SMART turned off.
+func (m *MAIDSmartMonitor) checkSmartSupport(device string) (bool, error) {
+	if m.inputDir != "" {
+		data, err := m.readCapture(device)
+		if err != nil {
+			return false, fmt.Errorf("failed to check SMART support: %v", err)
+		}
+		return data.SmartSupport.Enabled || len(data.attributeTable()) > 0 || data.NVMeHealthLog != nil, nil
+	}
+
+	output, err := m.runner.Run("--nocheck=standby", "-i", device)
+	if err != nil {
+		return false, fmt.Errorf("failed to check SMART support: %v", err)
+	}
+
+	// NVMe drives always have the health log and smartctl -i prints no SMART
+	// support line for them. SCSI output pads its values into a column
+	// ("SMART support is:     Enabled"), so spacing is ignored.
+	text := strings.Join(strings.Fields(string(output)), " ")
+	switch {
+	case strings.Contains(text, "SMART support is: Enabled"),
+		strings.HasPrefix(device, "/dev/nvme"), strings.Contains(text, "NVMe Version:"):
+		return true, nil
+	case strings.Contains(text, "SMART support is: Disabled"),
+		strings.Contains(text, "SMART support is: Unavailable"):
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check SMART support: smartctl -i reported no SMART support state")
+}
+
+// getDeviceInfo gets device serial number, model and security state without spinning up
+func (m *MAIDSmartMonitor) getDeviceInfo(device string) (*DeviceInfo, error) {
+	if m.inputDir != "" {
+		return m.captureDeviceInfo(device)
+	}
+
+	output, err := m.runner.Run("--nocheck=standby", "-i", device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device info: %v", err)
+	}
+
+	// SCSI drives print "Serial number:" and give the model as "Vendor:" and
+	// "Product:" lines, with their values padded into a column
+	info := &DeviceInfo{Device: device}
+	var vendor, product string
+	lines := strings.Split(string(output), "\n")
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if strings.Contains(line, "Serial Number:") || strings.HasPrefix(line, "Serial number:") {
+			parts := strings.SplitN(line, ":", 2)
+			info.SerialNumber = strings.TrimSpace(parts[1])
+		} else if strings.HasPrefix(line, "Vendor:") {
+			vendor = strings.TrimSpace(strings.TrimPrefix(line, "Vendor:"))
+		} else if strings.HasPrefix(line, "Product:") {
+			product = strings.TrimSpace(strings.TrimPrefix(line, "Product:"))
+		} else if strings.Contains(line, "Device Model:") || strings.Contains(line, "Model Number:") {
+			parts := strings.Split(line, ":")
+			if len(parts) > 1 {
+				info.Model = strings.TrimSpace(parts[1])
+			}
+		} else if strings.Contains(line, "LU WWN Device Id:") || strings.Contains(line, "Logical Unit id:") {
+			// "5 000c50 0a1b2c3d4" (ATA) or "0x5000c5000a1b2c3d" (SCSI)
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) > 1 {
+				wwn := strings.ReplaceAll(strings.TrimSpace(parts[1]), " ", "")
+				info.WWN = strings.ToLower(strings.TrimPrefix(wwn, "0x"))
+			}
+		} else if strings.Contains(line, "ATA Security is:") {
+			// e.g. "ENABLED, PW level HIGH, **LOCKED** [SEC4]" vs "..., not locked, not frozen [SEC5]"
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) > 1 {
+				info.SecurityState = strings.TrimSpace(parts[1])
+				info.Locked = strings.Contains(info.SecurityState, "LOCKED")
+			}
+		} else if strings.Contains(line, "Rotation Rate:") {
+			// "7200 rpm" or "Solid State Device"
+			parts := strings.SplitN(line, ":", 2)
+			value := strings.TrimSpace(parts[1])
+			if strings.Contains(value, "Solid State") {
+				info.MediaType = "ssd"
+			} else if fields := strings.Fields(value); len(fields) > 0 {
+				if rpm, err := strconv.Atoi(fields[0]); err == nil && rpm > 0 {
+					info.MediaType, info.RotationRate = "hdd", rpm
+				}
+			}
+		} else if strings.Contains(line, "User Capacity:") || strings.Contains(line, "Total NVM Capacity:") {
+			parts := strings.SplitN(line, ":", 2)
+			info.CapacityBytes = parseCapacity(parts[1])
+		} else if strings.Contains(line, "Form Factor:") {
+			parts := strings.SplitN(line, ":", 2)
+			info.FormFactor = strings.TrimSpace(parts[1])
+		} else if strings.Contains(line, "Sector Size:") || strings.Contains(line, "Sector Sizes:") ||
+			strings.Contains(line, "Formatted LBA Size:") || strings.HasPrefix(line, "Logical block size:") {
+			// "512 bytes logical/physical", "512 bytes logical, 4096 bytes physical" or "512" (NVMe)
+			parts := strings.SplitN(line, ":", 2)
+			if fields := strings.Fields(parts[1]); len(fields) > 0 {
+				if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+					info.LogicalSectorSize = size
+				}
+			}
+		} else if strings.Contains(line, "NVMe Version:") {
+			info.MediaType = "ssd"
+		}
+	}
+	if info.Model == "" && product != "" {
+		info.Model = strings.TrimSpace(vendor + " " + product)
+	}
+
+	return info, nil
+}
+
+// parseCapacity reads the byte count of a capacity line such as
+// "4,000,787,030,016 bytes [4.00 TB]"; the digit grouping follows the locale
+func parseCapacity(value string) int64 {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0
+	}
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, fields[0])
+	bytes, _ := strconv.ParseInt(digits, 10, 64)
+	return bytes
+}
+
+// isDeviceInStandby checks if device is in standby mode
+func (m *MAIDSmartMonitor) isDeviceInStandby(device string) bool {
+	// Captured output was taken by another process; whether that woke the drive
+	// is its concern, reading the file never does
+	if m.inputDir != "" {
+		return false
+	}
+
+	// smartctl exits with status 2 when it skips a drive for its power mode, so
+	// the output is checked before the error. SLEEP is deeper than STANDBY and
+	// just as much woken by a read.
+	output, _ := m.runner.Run("--nocheck=standby", "-n", "standby", device)
+	return strings.Contains(string(output), "STANDBY") || strings.Contains(string(output), "SLEEP")
+}
+
+// standbyThisCycle is isDeviceInStandby, answered from the cycle's earlier
+// probe of the device when that found it in standby. A drive found spinning is
+// probed again, since reading one that spun down meanwhile would wake it.
+func (m *MAIDSmartMonitor) standbyThisCycle(device string) bool {
+	m.standbyMu.Lock()
+	cached := m.inStandby[device]
+	m.standbyMu.Unlock()
+	if cached {
+		return true
+	}
+
+	if !m.isDeviceInStandby(device) {
+		return false
+	}
+	m.standbyMu.Lock()
+	if m.inStandby != nil {
+		m.inStandby[device] = true
+	}
+	m.standbyMu.Unlock()
+	return true
+}
+
+// collectSmartData collects SMART data from a device; it must only be called
+// for a device that is already spinning, which readDevice checks first
+func (m *MAIDSmartMonitor) collectSmartData(device string) (*SmartData, error) {
+	if m.inputDir != "" {
+		return m.readCapture(device)
+	}
+
+	// Device is already spinning, safe to collect SMART data
+	version := m.detectSmartctlVersion()
+	if !smartctlHasJSON(version) {
+		m.debugLogger.Printf("Reading %s attributes as text: smartctl %s has no --json", device, formatVersion(version))
+		return m.collectSmartText(device, version)
+	}
+
+	output, err := m.runner.Run("-A", "-c", "--json", device)
+	var smartData SmartData
+	if jsonErr := json.Unmarshal(output, &smartData); jsonErr != nil {
+		if isPermissionError(err) {
+			return nil, fmt.Errorf("failed to collect SMART data: %v", err)
+		}
+		m.logger.Printf("smartctl --json output for %s is unusable (%v), reading attributes as text", device, jsonErr)
+		return m.collectSmartText(device, version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect SMART data: %v", err)
+	}
+	smartData.raw = output
+	m.debugLogger.Printf("Read %s attributes as JSON", device)
+
+	// A SCSI drive's error counters are in its error log rather than with -A.
+	// smartctl sets exit status bits for logged errors, so the output is used
+	// whenever it parses.
+	if smartData.Device.Protocol == "SCSI" {
+		output, _ := m.runner.Run("-l", "error", "--json", device)
+		var errorLog SmartData
+		if err := json.Unmarshal(output, &errorLog); err != nil || errorLog.SCSIErrorCounterLog == nil {
+			m.debugLogger.Printf("No SCSI error counter log for %s", device)
+		} else {
+			smartData.SCSIErrorCounterLog = errorLog.SCSIErrorCounterLog
+		}
+	}
+
+	return &smartData, nil
+}
+
+// smartctlVersionRegex matches the first line of "smartctl --version", e.g.
+// "smartctl 6.6 2016-05-31 r4324 [x86_64-linux-4.19.0] (local build)"
+var smartctlVersionRegex = regexp.MustCompile(`^smartctl (\d+)\.(\d+)`)
+
+// detectSmartctlVersion asks smartctl for its version on first use and logs
+// how attributes will be read. It returns nil when the version is unknown.
+func (m *MAIDSmartMonitor) detectSmartctlVersion() []int {
+	m.versionOnce.Do(func() {
+		output, _ := m.runner.Run("--version")
+		match := smartctlVersionRegex.FindStringSubmatch(strings.TrimSpace(string(output)))
+		if match == nil {
+			m.debugLogger.Printf("Could not tell the smartctl version, reading attributes as JSON")
+			return
+		}
+		major, _ := strconv.Atoi(match[1])
+		minor, _ := strconv.Atoi(match[2])
+		m.smartctlVersion = []int{major, minor}
+		if smartctlHasJSON(m.smartctlVersion) {
+			m.logger.Printf("Using smartctl %d.%d, reading attributes as JSON", major, minor)
+		} else {
+			m.logger.Printf("Using smartctl %d.%d, which predates --json (7.0); reading attributes from its text output", major, minor)
+		}
+	})
+	return m.smartctlVersion
+}
+
+// smartctlHasJSON reports whether a smartctl version supports --json, which
+// arrived in 7.0. An unknown version is assumed to, since a failed JSON run
+// still falls back to the text output.
+func smartctlHasJSON(version []int) bool {
+	return len(version) == 0 || version[0] >= 7
+}
+
+// collectSmartText reads a drive's attribute table from the classic text output
+// of "smartctl -A", for smartctl releases without --json. Only the attribute
+// table is available this way: offline collection status and the NVMe health
+// log are left empty.
+func (m *MAIDSmartMonitor) collectSmartText(device string, version []int) (*SmartData, error) {
+	output, err := m.runner.Run("-A", device)
+	table := parseAttributeTable(string(output))
+	if len(table) == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("failed to collect SMART data: %v", err)
+		}
+		return nil, fmt.Errorf("failed to parse SMART attributes: no attribute table in smartctl -A output")
+	}
+
+	var smartData SmartData
+	smartData.Smartctl.Version = version
+	smartData.ATASmartAttributes.Table = table
+	return &smartData, nil
+}
+
+// parseAttributeTable parses smartctl's classic attribute table:
+//
+//	ID# ATTRIBUTE_NAME          FLAG     VALUE WORST THRESH TYPE      UPDATED  WHEN_FAILED RAW_VALUE
+//	194 Temperature_Celsius     0x0022   119   100   000    Old_age   Always       -       31 (Min/Max 22/45)
+//
+// into the attributes --json would report. The raw value is kept as the raw
+// string, which may contain spaces, and the hex FLAG as the flags value.
+func parseAttributeTable(output string) []SmartAttribute {
+	var table []SmartAttribute
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		flags, err := strconv.ParseInt(strings.TrimPrefix(fields[2], "0x"), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		// Normalized values print as "---" when the drive does not report them
+		value, _ := strconv.Atoi(fields[3])
+		worst, _ := strconv.Atoi(fields[4])
+		thresh, _ := strconv.Atoi(fields[5])
+		table = append(table, SmartAttribute{
+			ID:     id,
+			Name:   fields[1],
+			Value:  value,
+			Worst:  worst,
+			Thresh: thresh,
+			Raw:    map[string]interface{}{"string": strings.Join(fields[9:], " ")},
+			Flags:  map[string]interface{}{"value": float64(flags)},
+		})
+	}
+	return table
+}
+
+// readHwmonTemperature reads a drive's temperature from the kernel's drivetemp
+// hwmon device, returning it as an attribute 194 reading so it is stored and
+// checked like one read by smartctl
+func (m *MAIDSmartMonitor) readHwmonTemperature(device string) ([]map[string]interface{}, error) {
+	matches, err := filepath.Glob(filepath.Join(m.sysPath, "block", filepath.Base(device), "device", "hwmon", "hwmon*", "temp1_input"))
+	if err != nil || len(matches) == 0 {
+		return nil, fmt.Errorf("no hwmon sensor (is the drivetemp module loaded?)")
+	}
+
+	content, err := ioutil.ReadFile(matches[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", matches[0], err)
+	}
+	millidegrees, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", matches[0], err)
+	}
+
+	return []map[string]interface{}{{
+		"device":              device,
+		"attribute_id":        194,
+		"attribute_name":      m.targetAttribs[194],
+		"raw_value":           millidegrees / 1000,
+		"normalized_value":    0,
+		"threshold":           0,
+		"worst_value":         0,
+		"flags":               "[]",
+		"smartctl_version":    "hwmon",
+		"json_format_version": "",
+	}}, nil
+}
+
+// capturePath is where the pre-captured smartctl --json output for device is
+// expected: <input-dir>/<device name>.json, e.g. sda.json for /dev/sda
+func (m *MAIDSmartMonitor) capturePath(device string) string {
+	return filepath.Join(m.inputDir, filepath.Base(device)+".json")
+}
+
+// readCapture parses the pre-captured smartctl --json output for device
+func (m *MAIDSmartMonitor) readCapture(device string) (*SmartData, error) {
+	output, err := ioutil.ReadFile(m.capturePath(device))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read captured SMART data: %v", err)
+	}
+
+	var smartData SmartData
+	if err := json.Unmarshal(output, &smartData); err != nil {
+		return nil, fmt.Errorf("failed to parse captured SMART JSON %s: %v", m.capturePath(device), err)
+	}
+	smartData.raw = output
+
+	return &smartData, nil
+}
+
+// captureDeviceInfo builds the device info that getDeviceInfo would read from
+// smartctl -i out of the pre-captured JSON
+func (m *MAIDSmartMonitor) captureDeviceInfo(device string) (*DeviceInfo, error) {
+	data, err := m.readCapture(device)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DeviceInfo{
+		Device:        device,
+		SerialNumber:  data.SerialNumber,
+		Model:         data.ModelName,
+		SecurityState: data.ATASecurity.String,
+		Locked:        data.ATASecurity.Locked || strings.Contains(data.ATASecurity.String, "LOCKED"),
+	}
+	if info.Model == "" && data.SCSIProduct != "" {
+		info.Model = strings.TrimSpace(data.SCSIVendor + " " + data.SCSIProduct)
+	}
+	if data.WWN.NAA != 0 {
+		// Same digits as the "5 000c50 0a1b2c3d4" form printed by smartctl -i
+		info.WWN = fmt.Sprintf("%x%06x%09x", data.WWN.NAA, data.WWN.OUI, data.WWN.ID)
+	}
+	switch {
+	case data.NVMeHealthLog != nil || data.NVMeTotalCapacity > 0:
+		info.MediaType = "ssd"
+	case data.RotationRate != nil && *data.RotationRate == 0:
+		info.MediaType = "ssd"
+	case data.RotationRate != nil:
+		info.MediaType, info.RotationRate = "hdd", *data.RotationRate
+	}
+	info.CapacityBytes = data.UserCapacity.Bytes
+	if info.CapacityBytes == 0 {
+		info.CapacityBytes = data.NVMeTotalCapacity
+	}
+	info.FormFactor = data.FormFactor.Name
+	info.LogicalSectorSize = data.LogicalBlockSize
+
+	return info, nil
+}
+
+// hddOnlyAttributes describe moving parts and mean nothing on an SSD, and
+// ssdOnlyAttributes measure flash wear; some HDDs use those IDs for other things
+var (
+	hddOnlyAttributes = map[int]bool{3: true, 7: true, 191: true, 192: true, 193: true, 222: true, 240: true}
+	ssdOnlyAttributes = map[int]bool{177: true, 231: true, 233: true}
+)
+
+// mediaAttributes drops the attributes that do not apply to the drive's media
+// type; drives whose type is unknown keep them all
+func (m *MAIDSmartMonitor) mediaAttributes(attributes []map[string]interface{}, info *DeviceInfo) []map[string]interface{} {
+	var exclude map[int]bool
+	switch info.MediaType {
+	case "hdd":
+		exclude = ssdOnlyAttributes
+	case "ssd":
+		exclude = hddOnlyAttributes
+	}
+	if !m.classifyMedia || exclude == nil {
+		return attributes
+	}
+
+	kept := attributes[:0]
+	for _, attr := range attributes {
+		if id := attr["attribute_id"].(int); exclude[id] {
+			m.debugLogger.Printf("Skipping attribute %d (%s) on %s %s", id, attr["attribute_name"], strings.ToUpper(info.MediaType), info.Device)
+			continue
+		}
+		kept = append(kept, attr)
+	}
+	return kept
+}
+
+// collectDeviceStatistics reads the devstat log; like collectSmartData it must
+// only be called for a device that is already spinning
+func (m *MAIDSmartMonitor) collectDeviceStatistics(device string) (*DeviceStatistics, error) {
+	var output []byte
+	var err error
+	if m.inputDir != "" {
+		// smartctl -x --json includes the devstat pages; -a captures have none
+		output, err = ioutil.ReadFile(m.capturePath(device))
+	} else {
+		output, err = m.runner.Run("-l", "devstat", "--json", device)
+	}
+	if err != nil && len(output) == 0 {
+		return nil, fmt.Errorf("failed to collect device statistics: %v", err)
+	}
+
+	var stats DeviceStatistics
+	if err := json.Unmarshal(output, &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse device statistics JSON: %v", err)
+	}
+
+	return &stats, nil
+}
+
+// collectHealthStatus reads the drive's overall-health self-assessment, reporting
+// whether it PASSED; like collectSmartData it must only be called for a device
+// that is already spinning
+func (m *MAIDSmartMonitor) collectHealthStatus(device string) (bool, error) {
+	var output []byte
+	var err error
+	if m.inputDir != "" {
+		// smartctl -a/-x --json include smart_status
+		output, err = ioutil.ReadFile(m.capturePath(device))
+	} else {
+		output, err = m.runner.Run("-H", "--json", device)
+	}
+	// smartctl exits non-zero when the drive reports FAILED, with the JSON still on stdout
+	if err != nil && len(output) == 0 {
+		return false, fmt.Errorf("failed to collect health status: %v", err)
+	}
+
+	var status HealthStatus
+	if err := json.Unmarshal(output, &status); err != nil {
+		return false, fmt.Errorf("failed to parse health status JSON: %v", err)
+	}
+	if status.SmartStatus.Passed == nil {
+		return false, fmt.Errorf("no overall-health self-assessment reported")
+	}
+
+	return *status.SmartStatus.Passed, nil
+}
+
+// storeHealthStatus records the overall-health result in the device's status row,
+// and raises a HEALTH_FAILED alert if the drive no longer passes
+func (m *MAIDSmartMonitor) storeHealthStatus(info *DeviceInfo, passed bool) error {
+	status := "PASSED"
+	if !passed {
+		status = "FAILED"
+		m.createAlert(info.Device, "SMART_Health", "HEALTH_FAILED",
+			fmt.Sprintf("Drive %s reports its overall-health self-assessment as FAILED - back it up and replace it",
+				info.SerialNumber))
+	}
+
+	return m.writes.do("health status", func() error {
+		return m.store.UpdateHealthStatus(info.ID(), status, time.Now())
+	})
+}
+
+// UpdateHealthStatus sets the health columns of the drive's status row
+func (s sqliteStore) UpdateHealthStatus(deviceID, status string, at time.Time) error {
+	_, err := s.m.db.Exec(`UPDATE device_status SET health_status = ?, last_health_check = ? WHERE device_id = ?`,
+		status, at, deviceID)
+	return err
+}
+
+// Self-test execution status codes, the upper nibble of the status byte in
+// smartctl -c output
+const selfTestInProgress = 15
+
+// selfTestAborted holds the codes for a self-test that stopped before completing:
+// aborted by the host, interrupted by a reset, or halted by a fatal error
+var selfTestAborted = map[int]bool{1: true, 2: true, 3: true}
+
+// storeSelfTestStatus records the drive's self-test execution status, with the
+// percentage complete while a test runs, and raises a SELF_TEST_ABORTED alert
+// when the status first shows a test stopping early
+func (m *MAIDSmartMonitor) storeSelfTestStatus(info *DeviceInfo, smartData *SmartData) error {
+	status := smartData.ATASmartData.SelfTest.Status
+	if status.Value == nil {
+		return nil
+	}
+	code := *status.Value >> 4
+
+	var percent *int
+	if code == selfTestInProgress && status.RemainingPercent != nil {
+		complete := 100 - *status.RemainingPercent
+		percent = &complete
+		m.logger.Printf("Self-test on %s %d%% complete", info.Device, complete)
+	}
+
+	if selfTestAborted[code] {
+		// The status stays until the next test runs, so alert only on the change
+		previous, err := m.store.Device(info.ID())
+		if err != nil {
+			return fmt.Errorf("failed to read previous self-test status: %v", err)
+		}
+		if previous == nil || previous.SelfTestCode == nil || *previous.SelfTestCode != code {
+			m.createAlert(info.Device, "Self_Test", "SELF_TEST_ABORTED",
+				fmt.Sprintf("Self-test on drive %s did not complete: %s", info.SerialNumber, status.String))
+		}
+	}
+
+	return m.writes.do("self-test status", func() error {
+		return m.store.UpdateSelfTest(info.ID(), status.String, code, percent)
+	})
+}
+
+// UpdateSelfTest sets the self-test columns of the drive's status row
+func (s sqliteStore) UpdateSelfTest(deviceID, status string, code int, percent *int) error {
+	_, err := s.m.db.Exec(`UPDATE device_status SET self_test_status = ?, self_test_code = ?, self_test_percent = ?
+		WHERE device_id = ?`, status, code, percent, deviceID)
+	return err
+}
+
+// storeDeviceStatistics stores the valid entries of the selected devstat pages
+func (m *MAIDSmartMonitor) storeDeviceStatistics(stats *DeviceStatistics, info *DeviceInfo) (int, error) {
+	var entries []DeviceStatistic
+	for _, page := range stats.ATADeviceStatistics.Pages {
+		if !devstatPages[page.Number] {
+			continue
+		}
+		for _, stat := range page.Table {
+			if stat.Value == nil || (stat.Flags.Valid != nil && !*stat.Flags.Valid) {
+				continue
+			}
+			entries = append(entries, DeviceStatistic{Page: page.Number, PageName: page.Name, Offset: stat.Offset,
+				Name: stat.Name, Value: *stat.Value})
+		}
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	timestamp := time.Now()
+	err := m.writes.do("device statistics", func() error {
+		return m.store.StoreDeviceStatistics(info, entries, timestamp)
+	})
+
+	return len(entries), err
+}
+
+// StoreDeviceStatistics inserts one reading of device statistics in a single
+// transaction
+func (s sqliteStore) StoreDeviceStatistics(info *DeviceInfo, stats []DeviceStatistic, at time.Time) error {
+	tx, err := s.m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, stat := range stats {
+		_, err := tx.Exec(`
+			INSERT OR REPLACE INTO device_statistics
+			(device_id, device, timestamp, page, page_name, offset, name, value)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, info.ID(), info.Device, at, stat.Page, stat.PageName, stat.Offset, stat.Name, stat.Value)
+		if err != nil {
+			return fmt.Errorf("failed to insert device statistic: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// attributeFlagBits are the ATA attribute flag names in bit order, as smartctl
+// reports them both as named booleans and in the numeric flags.value
+var attributeFlagBits = []string{
+	"prefailure", "updated_online", "performance", "error_rate", "event_count", "auto_keep",
+}
+
+// attributeFlagNames returns the names of the flags set on an attribute, taken
+// from smartctl's named booleans or, when absent, decoded from flags.value
+func attributeFlagNames(flags map[string]interface{}) []string {
+	names := []string{}
+	value, hasValue := flags["value"].(float64)
+	for bit, name := range attributeFlagBits {
+		set, named := flags[name].(bool)
+		if !named && hasValue {
+			set = int(value)&(1<<uint(bit)) != 0
+		}
+		if set {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseSmartAttributes parses and filters SMART attributes for target IDs
+func (m *MAIDSmartMonitor) parseSmartAttributes(smartData *SmartData, device string) []map[string]interface{} {
+	var attributes []map[string]interface{}
+
+	smartctlVersion := formatVersion(smartData.Smartctl.Version)
+	jsonFormatVersion := formatVersion(smartData.JSONFormatVersion)
+	offlineStatus := smartData.ATASmartData.OfflineDataCollection.Status
+	offlineStale := offlineCollectionStale(offlineStatus.Value)
+
+	for _, attr := range smartData.attributeTable() {
+		if name, exists := m.attributeName(attr.ID, attr.Name); exists {
+			rawValue, ok := parseRawValue(attr.Raw)
+			var tempMin, tempMax interface{}
+			if attr.ID == 190 || attr.ID == 194 {
+				rawValue, tempMin, tempMax, ok = parseTemperatureRaw(attr.Raw)
+			}
+			if !ok {
+				m.warnLogger.Printf("No usable raw value for attribute %d on %s (smartctl %s, JSON format %s)",
+					attr.ID, device, smartctlVersion, jsonFormatVersion)
+			}
+
+			flagNames := attributeFlagNames(attr.Flags)
+			flagsJSON, _ := json.Marshal(flagNames)
+
+			attributes = append(attributes, map[string]interface{}{
+				"device":              device,
+				"attribute_id":        attr.ID,
+				"attribute_name":      name,
+				"raw_value":           rawValue,
+				"normalized_value":    attr.Value,
+				"threshold":           attr.Thresh,
+				"worst_value":         attr.Worst,
+				"temp_min":            tempMin,
+				"temp_max":            tempMax,
+				"flags":               string(flagsJSON),
+				"prefailure":          hasFlag(flagNames, "prefailure"),
+				"updated_online":      hasFlag(flagNames, "updated_online"),
+				"offline_status":      offlineStatus.String,
+				"stale":               offlineStale && !hasFlag(flagNames, "updated_online"),
+				"smartctl_version":    smartctlVersion,
+				"json_format_version": jsonFormatVersion,
+			})
+		}
+	}
+
+	return attributes
+}
+
+// attributeTable returns the drive's SMART attributes: the ATA attribute table,
+// or for a SCSI drive its counters under the IDs of the ATA attributes that
+// count the same thing
+func (d *SmartData) attributeTable() []SmartAttribute {
+	if len(d.ATASmartAttributes.Table) > 0 || d.Device.Protocol != "SCSI" {
+		return d.ATASmartAttributes.Table
+	}
+	return d.scsiAttributes()
+}
+
+// scsiAttributes maps a SCSI drive's counters onto attributes: grown defects
+// are its reallocated sectors (5) and the uncorrected errors of all directions
+// its reported uncorrectable errors (187). SCSI has no normalized values, so
+// they and the thresholds are 0 and only the raw values are checked.
+func (d *SmartData) scsiAttributes() []SmartAttribute {
+	var table []SmartAttribute
+	add := func(id int, name string, value *int64) {
+		if value != nil {
+			raw := map[string]interface{}{"value": float64(*value), "string": strconv.FormatInt(*value, 10)}
+			table = append(table, SmartAttribute{ID: id, Name: name, Raw: raw})
+		}
+	}
+
+	add(4, "Start_Stop_Count", d.SCSIStartStop.StartStopCycles)
+	add(5, "Reallocated_Sector_Ct", d.SCSIGrownDefectList)
+	add(9, "Power_On_Hours", d.PowerOnTime.Hours)
+	if log := d.SCSIErrorCounterLog; log != nil {
+		var uncorrected int64
+		for _, counters := range []*SCSIErrorCounters{log.Read, log.Write, log.Verify} {
+			if counters != nil {
+				uncorrected += counters.TotalUncorrectedErrors
+			}
+		}
+		add(187, "Reported_Uncorrectable_Errors", &uncorrected)
+	}
+	add(193, "Load_Cycle_Count", d.SCSIStartStop.LoadUnloadCycles)
+	add(194, "Temperature_Celsius", d.Temperature.Current)
+	return table
+}
+
+// attributeName returns the name attribute id is stored under and whether it is
+// stored at all: the monitored attributes always, under their own names, and
+// with -collect-all every other one too, under the name smartctl reported or
+// Attribute_<id> when smartctl does not know it
+func (m *MAIDSmartMonitor) attributeName(id int, reported string) (string, bool) {
+	if name, ok := m.targetAttribs[id]; ok {
+		return name, true
+	}
+	if !m.collectAll {
+		return "", false
+	}
+	if reported == "" || reported == "Unknown_Attribute" {
+		return fmt.Sprintf("Attribute_%d", id), true
+	}
+	return reported, true
+}
+
+// offlineCollectionStale reports whether an offline data collection status value
+// means offline-only attributes have not been refreshed: collection never ran, or
+// was suspended or aborted. An unreported status is not treated as stale.
+func offlineCollectionStale(status *int) bool {
+	if status == nil {
+		return false
+	}
+
+	// Bit 7 only says whether automatic collection is enabled
+	switch *status & 0x7f {
+	case 0x00, 0x04, 0x05, 0x06:
+		return true
+	}
+	return false
+}
+
+// hasFlag reports whether name is among the attribute flag names
+func hasFlag(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyVendorThresholds fills in thresholds that the JSON attribute table reports
+// as 0 from the drive's threshold table as printed by "smartctl -A -f brief", so
+// threshold checks are not silently skipped on those drives
+func (m *MAIDSmartMonitor) applyVendorThresholds(attributes []map[string]interface{}, device, serial string) {
+	if m.inputDir != "" {
+		return
+	}
+
+	missing := false
+	for _, attr := range attributes {
+		if attr["threshold"].(int) == 0 {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return
+	}
+
+	thresholds, err := m.getVendorThresholds(device, serial)
+	if err != nil {
+		m.warnLogger.Printf("Failed to read vendor thresholds for %s, not retrying: %v", device, err)
+		return
+	}
+
+	for _, attr := range attributes {
+		if attr["threshold"].(int) != 0 {
+			continue
+		}
+		if thresh := thresholds[attr["attribute_id"].(int)]; thresh > 0 {
+			attr["threshold"] = thresh
+		}
+	}
+}
+
+// getVendorThresholds returns the drive's own attribute thresholds, cached per
+// serial, or per device path for a drive without one. Thresholds are fixed per
+// drive, so a drive whose table cannot be read is cached without any and only
+// asked once, not every cycle.
+func (m *MAIDSmartMonitor) getVendorThresholds(device, serial string) (map[int]int, error) {
+	key := serial
+	if key == "" {
+		key = device
+	}
+	m.vendorMu.Lock()
+	cached, ok := m.vendorThresholds[key]
+	m.vendorMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	release := m.acquireSpindle()
+	output, err := m.runner.Run("-A", "-f", "brief", device)
+	release()
+	// smartctl sets exit status bits for attributes past their thresholds,
+	// along with the table that shows them
+	thresholds := parseThresholdTable(string(output))
+
+	m.vendorMu.Lock()
+	m.vendorThresholds[key] = thresholds
+	m.vendorMu.Unlock()
+	if len(thresholds) == 0 && err != nil {
+		return thresholds, err
+	}
+	return thresholds, nil
+}
+
+// parseThresholdTable extracts the THRESH column from smartctl's text attribute
+// table. Both the brief and the old format start with
+// "ID# ATTRIBUTE_NAME FLAGS VALUE WORST THRESH".
+func parseThresholdTable(output string) map[int]int {
+	thresholds := make(map[int]int)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		if thresh, err := strconv.Atoi(fields[5]); err == nil {
+			thresholds[id] = thresh
+		}
+	}
+	return thresholds
+}
+
+// parseRawValue extracts the raw attribute value, preferring raw.value and falling
+// back to the leading number of raw.string, which is all some smartctl builds emit
+func parseRawValue(raw map[string]interface{}) (int64, bool) {
+	if val, ok := raw["value"]; ok {
+		switch v := val.(type) {
+		case float64:
+			return int64(v), true
+		case int64:
+			return v, true
+		case string:
+			if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return parsed, true
+			}
+		}
+	}
+
+	if str, ok := raw["string"].(string); ok {
+		if match := leadingNumberRegex.FindString(strings.TrimSpace(str)); match != "" {
+			if parsed, err := strconv.ParseInt(match, 10, 64); err == nil {
+				return parsed, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+var leadingNumberRegex = regexp.MustCompile(`^\d+`)
+
+// tempMinMaxRegex matches smartctl's temperature raw string, e.g.
+// "30 (Min/Max 25/45)" or "31 (Min/Max 21/45 #123)"
+var tempMinMaxRegex = regexp.MustCompile(`^(\d+)(?:\s*\(Min/Max\s+(-?\d+)/(-?\d+))?`)
+
+// parseTemperatureRaw extracts current, lifetime min and max temperatures from a
+// 190/194 raw structure. Drives pack these into one 48-bit raw.value, so the
+// current reading is taken from raw.string when present, else from the low byte.
+// min and max are nil when the drive does not report them.
+func parseTemperatureRaw(raw map[string]interface{}) (current int64, min, max interface{}, ok bool) {
+	if str, isStr := raw["string"].(string); isStr {
+		if match := tempMinMaxRegex.FindStringSubmatch(strings.TrimSpace(str)); match != nil {
+			current, _ = strconv.ParseInt(match[1], 10, 64)
+			if match[2] != "" {
+				lo, _ := strconv.ParseInt(match[2], 10, 64)
+				hi, _ := strconv.ParseInt(match[3], 10, 64)
+				return current, lo, hi, true
+			}
+			return current, nil, nil, true
+		}
+	}
+
+	value, ok := parseRawValue(raw)
+	return value & 0xff, nil, nil, ok
+}
+
+// parseAttributeIDs parses a comma-separated list of SMART attribute IDs such as "5,187,199"
+func parseAttributeIDs(list string) (map[int]bool, error) {
+	ids := make(map[int]bool)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil || id < 1 || id > 255 {
+			return nil, fmt.Errorf("invalid attribute ID %q", field)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// formatVersion renders a smartctl version array such as [7, 2] as "7.2"
+func formatVersion(parts []int) string {
+	if len(parts) == 0 {
+		return "unknown"
+	}
+
+	strs := make([]string, len(parts))
+	for i, p := range parts {
+		strs[i] = strconv.Itoa(p)
+	}
+	return strings.Join(strs, ".")
+}
+
+// storeSmartData stores SMART attributes in database
+func (m *MAIDSmartMonitor) storeSmartData(attributes []map[string]interface{}, info *DeviceInfo) (int, error) {
+	if len(attributes) == 0 {
+		return 0, nil
+	}
+
+	m.stateMu.RLock()
+	lowDiskSpace := m.lowDiskSpace
+	m.stateMu.RUnlock()
+	if lowDiskSpace {
+		return 0, fmt.Errorf("database filesystem is below the free space minimum, not storing readings")
+	}
+
+	reading := bufferedReading{attributes: attributes, info: *info, timestamp: time.Now()}
+	stored, err := m.writeReading(reading)
+	if err != nil {
+		m.bufferReading(reading)
+		return 0, fmt.Errorf("%v (buffered for retry, %d readings buffered)", err, len(m.buffered))
+	}
+	return stored, nil
+}
+
+// bufferedReading is a device's attribute reading that could not be stored yet
+type bufferedReading struct {
+	attributes []map[string]interface{}
+	info       DeviceInfo
+	timestamp  time.Time
+}
+
+// writeReading stores a reading through the writer, keeping its original
+// timestamp, and returns how many attribute rows were written
+func (m *MAIDSmartMonitor) writeReading(r bufferedReading) (int, error) {
+	var stored int
+	err := m.writes.do("SMART data", func() error {
+		var err error
+		stored, err = m.store.StoreSmartData(r.attributes, &r.info, r.timestamp)
+		return err
+	})
+	return stored, err
+}
+
+// bufferReading keeps a reading for retry, dropping the oldest once the buffer is full
+func (m *MAIDSmartMonitor) bufferReading(r bufferedReading) {
+	if m.maxBuffered <= 0 {
+		return
+	}
+	m.buffered = append(m.buffered, r)
+	if over := len(m.buffered) - m.maxBuffered; over > 0 {
+		m.errLogger.Printf("Reading buffer full, dropped %d oldest readings", over)
+		m.buffered = m.buffered[over:]
+	}
+}
+
+// flushBuffered retries buffered readings in order, stopping at the first failure
+// so that the rest stay buffered for the next cycle
+func (m *MAIDSmartMonitor) flushBuffered() {
+	m.stateMu.RLock()
+	lowDiskSpace := m.lowDiskSpace
+	m.stateMu.RUnlock()
+	if len(m.buffered) == 0 || lowDiskSpace {
+		return
+	}
+
+	persisted := 0
+	for _, r := range m.buffered {
+		if _, err := m.writeReading(r); err != nil {
+			m.errLogger.Printf("Database still unavailable: %v", err)
+			break
+		}
+		persisted++
+	}
+	m.buffered = m.buffered[persisted:]
+
+	m.logger.Printf("Flushed buffered readings: %d persisted, %d still buffered", persisted, len(m.buffered))
+}
+
+// Store is where the monitoring cycle persists readings, device status and
+// alerts, and reads back the history its checks compare against; the health
+// summary is read from it too. The SQLite database is the default. Writes are
+// made one at a time from the writer goroutine, while reads come concurrently
+// from the cycle's device reads and, for HealthSummary, the API front-ends.
+//
+// The commands that report on or edit the stored data (exports and imports,
+// notes, maintenance windows and suppressions, -purge-device, -diff, -digest,
+// -history), retention pruning, the hash chain, the raw archive index, the USB
+// bridge type cache and the cumulative counters work on the SQLite database
+// itself, which stays open whichever Store is used.
+type Store interface {
+	// StoreSmartData stores one reading of all of a device's attributes and
+	// returns how many rows it wrote, which may be fewer or none: readings behind
+	// the newest stored one and, with -store-on-change-only, unchanged
+	// attributes are skipped
+	StoreSmartData(attributes []map[string]interface{}, info *DeviceInfo, timestamp time.Time) (int, error)
+
+	// LastReading returns the newest stored reading of a drive's attribute, or
+	// nil if there is none
+	LastReading(deviceID string, attrID int) (*StoredReading, error)
+
+	// Readings returns the stored readings of a drive's attribute taken at or
+	// after since, oldest first
+	Readings(deviceID string, attrID int, since time.Time) ([]StoredReading, error)
+
+	// HighestRawValue returns the highest raw value ever stored for a drive's
+	// attribute, and false if none is
+	HighestRawValue(deviceID string, attrID int) (int64, bool, error)
+
+	// CaptureBaseline records the attributes as the serial's install baseline,
+	// keeping any attribute already captured, and returns how many it added
+	CaptureBaseline(serial string, attributes []map[string]interface{}, at time.Time) (int, error)
+
+	// Baseline returns the install baseline of a serial's attribute, or nil if
+	// none was captured
+	Baseline(serial string, attrID int) (*StoredReading, error)
+
+	// RecaptureBaseline replaces the normalized value of a captured baseline
+	RecaptureBaseline(serial string, attrID int, normalized int) error
+
+	// UpdateDeviceStatus records the latest status of a device
+	UpdateDeviceStatus(info *DeviceInfo) error
+
+	// Device returns the stored status of a drive, or nil if it has none
+	Device(deviceID string) (*StoredDevice, error)
+
+	// DeviceAt returns the stored status of the drive at a /dev path, preferring
+	// a mounted one and then the one seen last, or nil if there is none
+	DeviceAt(device string) (*StoredDevice, error)
+
+	// MarkActive records that a drive was seen spinning at the given time
+	MarkActive(deviceID string, at time.Time) error
+
+	// UpdateBay records the bay a drive is in
+	UpdateBay(deviceID, bay string) error
+
+	// UpdateHealthStatus records a drive's overall-health result, "PASSED" or
+	// "FAILED"
+	UpdateHealthStatus(deviceID, status string, at time.Time) error
+
+	// UpdateSelfTest records a drive's self-test execution status; percent is
+	// nil unless a test is running
+	UpdateSelfTest(deviceID, status string, code int, percent *int) error
+
+	// UpdateNVMeThermal records an NVMe drive's thermal counters
+	UpdateNVMeThermal(deviceID string, counters NVMeThermalCounters) error
+
+	// UpdateDataUnits records the bytes per raw count of a drive's attributes
+	// 241 and 242; nil for one the drive does not report
+	UpdateDataUnits(deviceID string, written, read *int64) error
+
+	// StoreDeviceStatistics stores one reading of a drive's device statistics
+	StoreDeviceStatistics(info *DeviceInfo, stats []DeviceStatistic, at time.Time) error
+
+	// CreateAlert records a new alert, or refreshes (and escalates, once it has
+	// been open long enough) the matching unresolved one. It returns the alert as
+	// recorded, with EscalatedFrom set on an escalation, and whether it is new or
+	// escalated, and so should be notified.
+	CreateAlert(alert HealthAlert) (HealthAlert, bool, error)
+
+	// ResolveAlerts marks resolved the drive's open alerts that were not raised
+	// again since seen, when the checks of its latest reading began, and returns
+	// them
+	ResolveAlerts(deviceID string, seen time.Time) ([]HealthAlert, error)
+
+	// InMaintenance reports whether a host-wide maintenance window, or one for
+	// the device path or the serial of the drive mounted there, is open at
+	InMaintenance(device string, at time.Time) (bool, error)
+
+	// IsSuppressed reports whether alerts of alertType, or on attribute, are
+	// suppressed for a drive
+	IsSuppressed(deviceID, attribute, alertType string) (bool, error)
+
+	// HealthSummary returns the health summary of the stored data
+	HealthSummary() (map[string]interface{}, error)
+}
+
+// StoredReading is one stored value of an attribute, or its install baseline
+type StoredReading struct {
+	Timestamp       time.Time
+	RawValue        int64
+	NormalizedValue int64 // 0 if not stored
+}
+
+// StoredDevice is the stored status of a drive that its next reading is
+// compared with
+type StoredDevice struct {
+	DeviceID     string
+	Device       string // /dev path it was last seen at
+	SerialNumber string
+	Model        string
+	Bay          string
+	Locked       bool
+	SmartEnabled bool
+	LastActive   time.Time            // zero if never seen spinning
+	SelfTestCode *int                 // nil if no self-test status was recorded
+	NVMeThermal  *NVMeThermalCounters // nil until first recorded
+}
+
+// NVMeThermalCounters are the lifetime thermal counters of an NVMe drive
+type NVMeThermalCounters struct {
+	WarningTempTime  int64 // minutes above the warning composite temperature
+	CriticalTempTime int64 // minutes above the critical composite temperature
+	ThrottleCount    int64 // transitions into thermal management
+	ThrottleTime     int64 // seconds in thermal management
+}
+
+// DeviceStatistic is one entry of a drive's device statistics log
+type DeviceStatistic struct {
+	Page     int
+	PageName string
+	Offset   int
+	Name     string
+	Value    int64
+}
+
+// sqliteStore is the Store kept in the monitor's SQLite database
+type sqliteStore struct {
+	m *MAIDSmartMonitor
+}
+
+// StoreSmartData inserts one reading of all attributes in a single transaction
+func (s sqliteStore) StoreSmartData(attributes []map[string]interface{}, info *DeviceInfo, timestamp time.Time) (int, error) {
+	tx, err := s.m.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// A clock set back (NTP step, VM snapshot restore) would interleave new
+	// readings with newer stored ones, and a repeated timestamp would replace
+	// them, so nothing is stored until the clock passes the newest reading
+	var newest time.Time
+	err = tx.QueryRow(`SELECT timestamp FROM smart_data WHERE device_id = ? ORDER BY timestamp DESC LIMIT 1`,
+		info.ID()).Scan(&newest)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to read newest reading: %v", err)
+	}
+	if err == nil && !timestamp.After(newest) {
+		s.m.warnLogger.Printf("Not storing readings for %s: the clock (%s) is behind its newest stored reading (%s)",
+			info.Device, timestamp.Format(time.RFC3339), newest.Format(time.RFC3339))
+		return 0, nil
+	}
+
+	if s.m.storeOnChangeOnly {
+		changed, err := changedAttributes(tx, attributes, info.ID(), timestamp.Add(-s.m.storeHeartbeat))
+		if err != nil {
+			return 0, err
+		}
+		if skipped := len(attributes) - len(changed); skipped > 0 {
+			s.m.debugLogger.Printf("Skipped %d unchanged SMART attributes for %s", skipped, info.Device)
+		}
+		if len(changed) == 0 {
+			return 0, nil
+		}
+		attributes = changed
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO smart_data 
+		(device, serial_number, model, timestamp, attribute_id, attribute_name,
+		 raw_value, normalized_value, threshold, worst_value, flags,
+		 prefailure, updated_online, temp_min, temp_max, offline_status, stale,
+		 smartctl_version, json_format_version, device_id, raw_encoded)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, attr := range attributes {
+		_, err := stmt.Exec(
+			attr["device"], info.SerialNumber, info.Model, timestamp,
+			attr["attribute_id"], attr["attribute_name"],
+			attr["raw_value"], attr["normalized_value"],
+			attr["threshold"], attr["worst_value"], attr["flags"],
+			attr["prefailure"], attr["updated_online"],
+			attr["temp_min"], attr["temp_max"], attr["offline_status"], attr["stale"],
+			attr["smartctl_version"], attr["json_format_version"],
+			info.ID(), vendorEncodedAttribs[attr["attribute_id"].(int)],
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert attribute: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.m.debugLogger.Printf("Stored %d SMART attributes for %s", len(attributes), attributes[0]["device"])
+	return len(attributes), nil
+}
+
+// changedAttributes returns the attributes whose raw, normalized, worst or
+// threshold value differs from the last row stored for the device, along with
+// those whose last row was stored before heartbeat or that have none
+func changedAttributes(tx *sql.Tx, attributes []map[string]interface{}, deviceID string, heartbeat time.Time) ([]map[string]interface{}, error) {
+	var changed []map[string]interface{}
+	for _, attr := range attributes {
+		var raw, normalized, worst, threshold sql.NullInt64
+		var stored time.Time
+		err := tx.QueryRow(`
+			SELECT raw_value, normalized_value, worst_value, threshold, timestamp FROM smart_data
+			WHERE device_id = ? AND attribute_id = ?
+			ORDER BY timestamp DESC LIMIT 1
+		`, deviceID, attr["attribute_id"]).Scan(&raw, &normalized, &worst, &threshold, &stored)
+		if err == sql.ErrNoRows {
+			changed = append(changed, attr)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read last stored value: %v", err)
+		}
+
+		current := fmt.Sprint(attr["raw_value"], attr["normalized_value"], attr["worst_value"], attr["threshold"])
+		last := fmt.Sprint(raw.Int64, normalized.Int64, worst.Int64, threshold.Int64)
+		if current != last || stored.Before(heartbeat) {
+			changed = append(changed, attr)
+		}
+	}
+	return changed, nil
+}
+
+// captureBaseline records the first reading of each attribute seen for a serial as
+// its as-installed baseline; later readings never overwrite it
+func (m *MAIDSmartMonitor) captureBaseline(attributes []map[string]interface{}, serial string) error {
+	if serial == "" || len(attributes) == 0 {
+		return nil
+	}
+
+	return m.writes.do("baseline", func() error {
+		captured, err := m.store.CaptureBaseline(serial, attributes, time.Now())
+		if err != nil {
+			return err
+		}
+		if captured > 0 {
+			m.logger.Printf("Captured install baseline of %d attributes for serial %s", captured, serial)
+		}
+		return nil
+	})
+}
+
+// CaptureBaseline inserts the baseline rows that do not exist yet
+func (s sqliteStore) CaptureBaseline(serial string, attributes []map[string]interface{}, at time.Time) (int, error) {
+	var captured int64
+	for _, attr := range attributes {
+		result, err := s.m.db.Exec(`
+			INSERT OR IGNORE INTO device_baselines
+			(serial_number, attribute_id, attribute_name, raw_value, normalized_value, timestamp)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, serial, attr["attribute_id"], attr["attribute_name"], attr["raw_value"], attr["normalized_value"], at)
+		if err != nil {
+			return int(captured), fmt.Errorf("failed to store baseline: %v", err)
+		}
+		n, _ := result.RowsAffected()
+		captured += n
+	}
+	return int(captured), nil
+}
+
+// Baseline reads a baseline row
+func (s sqliteStore) Baseline(serial string, attrID int) (*StoredReading, error) {
+	var baseline StoredReading
+	var raw, normalized sql.NullInt64
+	err := s.m.db.QueryRow(`
+		SELECT raw_value, normalized_value, timestamp FROM device_baselines
+		WHERE serial_number = ? AND attribute_id = ?
+	`, serial, attrID).Scan(&raw, &normalized, &baseline.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	baseline.RawValue, baseline.NormalizedValue = raw.Int64, normalized.Int64
+	return &baseline, nil
+}
+
+// RecaptureBaseline updates the normalized value of a baseline row
+func (s sqliteStore) RecaptureBaseline(serial string, attrID int, normalized int) error {
+	_, err := s.m.db.Exec(`
+		UPDATE device_baselines SET normalized_value = ?
+		WHERE serial_number = ? AND attribute_id = ?
+	`, normalized, serial, attrID)
+	return err
+}
+
+// getChangesSinceInstall returns, per device, how far each counter attribute has
+// moved from the baseline captured when its drive was first seen
+func (m *MAIDSmartMonitor) getChangesSinceInstall() (map[string][]map[string]interface{}, error) {
+	rows, err := m.db.Query(`
+		SELECT s.device, b.serial_number, b.attribute_id, b.attribute_name,
+		       b.raw_value, d.raw_value, b.timestamp
+		FROM device_status s
+		JOIN device_baselines b ON b.serial_number = s.serial_number
+		JOIN smart_data d ON d.serial_number = b.serial_number AND d.attribute_id = b.attribute_id
+		WHERE d.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                     WHERE serial_number = b.serial_number AND attribute_id = b.attribute_id)
+		ORDER BY s.device, b.attribute_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query baselines: %v", err)
+	}
+	defer rows.Close()
+
+	changes := make(map[string][]map[string]interface{})
+	for rows.Next() {
+		var device, serial, name string
+		var attrID int
+		var baseline, current int64
+		var since time.Time
+		if err := rows.Scan(&device, &serial, &attrID, &name, &baseline, &current, &since); err != nil {
+			return nil, fmt.Errorf("failed to scan baseline row: %v", err)
+		}
+		if !counterAttribs[attrID] || current == baseline {
+			continue
+		}
+		changes[device] = append(changes[device], map[string]interface{}{
+			"serial_number":  serial,
+			"attribute_id":   attrID,
+			"attribute_name": name,
+			"baseline":       baseline,
+			"current":        current,
+			"change":         current - baseline,
+			"baseline_time":  since,
+		})
+	}
+
+	return changes, nil
+}
+
+// getChangesSinceLastReading returns, per device, the attributes whose raw value
+// differs between the two most recent stored readings. Vendor-encoded error
+// rates are compared by normalized value, marked "normalized", since their raw
+// value changes with every read.
+func (m *MAIDSmartMonitor) getChangesSinceLastReading() (map[string][]map[string]interface{}, error) {
+	rows, err := m.db.Query(`
+		SELECT s.device, cur.attribute_id, cur.attribute_name,
+		       prev.raw_value, cur.raw_value, prev.normalized_value, cur.normalized_value,
+		       prev.timestamp, cur.timestamp
+		FROM device_status s
+		JOIN smart_data cur ON cur.device_id = s.device_id
+		JOIN smart_data prev ON prev.device_id = cur.device_id AND prev.attribute_id = cur.attribute_id
+		WHERE cur.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                       WHERE device_id = cur.device_id AND attribute_id = cur.attribute_id)
+		  AND prev.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                        WHERE device_id = cur.device_id AND attribute_id = cur.attribute_id
+		                          AND timestamp < cur.timestamp)
+		ORDER BY s.device, cur.attribute_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recent readings: %v", err)
+	}
+	defer rows.Close()
+
+	changes := make(map[string][]map[string]interface{})
+	for rows.Next() {
+		var device, name string
+		var attrID int
+		var previous, current, previousNormalized, currentNormalized sql.NullInt64
+		var previousTime, currentTime time.Time
+		if err := rows.Scan(&device, &attrID, &name, &previous, &current,
+			&previousNormalized, &currentNormalized, &previousTime, &currentTime); err != nil {
+			return nil, fmt.Errorf("failed to scan reading row: %v", err)
+		}
+		normalized := vendorEncodedAttribs[attrID]
+		if normalized {
+			previous, current = previousNormalized, currentNormalized
+		}
+		if !previous.Valid || !current.Valid || previous.Int64 == current.Int64 {
+			continue
+		}
+		changes[device] = append(changes[device], map[string]interface{}{
+			"attribute_id":   attrID,
+			"attribute_name": name,
+			"previous":       previous.Int64,
+			"current":        current.Int64,
+			"change":         current.Int64 - previous.Int64,
+			"normalized":     normalized,
+			"previous_time":  previousTime,
+			"current_time":   currentTime,
+		})
+	}
+
+	return changes, rows.Err()
+}
+
+// historyPoint is one stored reading of an attribute
+type historyPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// getAttributeHistory returns the raw values of attribute attrID stored since
+// since for the drive target refers to (a device_id, serial number or /dev
+// path), oldest first, with the attribute's name. Temperatures are converted to
+// the display unit, and vendor-encoded error rates give their normalized values.
+func (m *MAIDSmartMonitor) getAttributeHistory(target string, attrID int, since time.Time) ([]historyPoint, string, error) {
+	ids, err := m.resolveDeviceIDs(target)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(ids) == 0 {
+		return nil, "", fmt.Errorf("no records found for %s", target)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, 0, len(ids)+2)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, attrID, since)
+
+	column := "raw_value"
+	if vendorEncodedAttribs[attrID] {
+		column = "normalized_value"
+	}
+	rows, err := m.db.Query(`
+		SELECT timestamp, attribute_name, `+column+` FROM smart_data
+		WHERE device_id IN (`+placeholders+`) AND attribute_id = ? AND timestamp >= ? AND `+column+` IS NOT NULL
+		ORDER BY timestamp
+	`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query history: %v", err)
+	}
+	defer rows.Close()
+
+	name := m.targetAttribs[attrID]
+	var points []historyPoint
+	for rows.Next() {
+		var t time.Time
+		var raw int64
+		if err := rows.Scan(&t, &name, &raw); err != nil {
+			return nil, "", fmt.Errorf("failed to scan history row: %v", err)
+		}
+		value := float64(raw)
+		if attrID == 190 || attrID == 194 {
+			value = m.convertTemperature(raw)
+		}
+		points = append(points, historyPoint{Time: t, Value: value})
+	}
+	return points, name, rows.Err()
+}
+
+// sparkBlocks are the sparkline characters, lowest to highest
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline renders values as at most width block characters scaled between
+// their minimum and maximum. With more values than width, each character shows
+// the highest value of its share, so short peaks stay visible.
+func sparkline(values []float64, width int) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if width <= 0 || width > len(values) {
+		width = len(values)
+	}
+
+	buckets := make([]float64, width)
+	for i := range buckets {
+		from, to := i*len(values)/width, (i+1)*len(values)/width
+		buckets[i] = values[from]
+		for _, v := range values[from:to] {
+			buckets[i] = math.Max(buckets[i], v)
+		}
+	}
+
+	low, high := buckets[0], buckets[0]
+	for _, v := range buckets {
+		low, high = math.Min(low, v), math.Max(high, v)
+	}
+
+	var line strings.Builder
+	for _, v := range buckets {
+		level := 0
+		if high > low {
+			level = int((v - low) / (high - low) * float64(len(sparkBlocks)-1))
+		}
+		line.WriteRune(sparkBlocks[level])
+	}
+	return line.String()
+}
+
+// digestWindow is the period a digest covers, and digestTrendDays how many such
+// periods its alert trend looks back over
+const (
+	digestWindow    = 24 * time.Hour
+	digestTrendDays = 7
+	digestHottest   = 5
+)
+
+// digestReport is the daily digest: what changed on the drives over its window,
+// for operators who want a routine health pulse rather than every alert
+type digestReport struct {
+	Host            string              `json:"host"`
+	From            time.Time           `json:"from"`
+	To              time.Time           `json:"to"`
+	NewAlerts       []exportedAlert     `json:"new_alerts"`
+	ClearedAlerts   []exportedAlert     `json:"cleared_alerts"`
+	Hottest         []digestTemperature `json:"hottest"`
+	CriticalChanges []digestChange      `json:"critical_changes"`
+	Trend           digestTrend         `json:"trend"`
+}
+
+// digestTemperature is a drive's latest and highest temperature in the window
+type digestTemperature struct {
+	Device       string  `json:"device"`
+	SerialNumber string  `json:"serial_number"`
+	Current      float64 `json:"current"`
+	Peak         float64 `json:"peak"`
+	Unit         string  `json:"unit"`
+}
+
+// digestChange is a critical attribute whose raw value moved during the window
+type digestChange struct {
+	Device        string `json:"device"`
+	SerialNumber  string `json:"serial_number"`
+	AttributeID   int    `json:"attribute_id"`
+	AttributeName string `json:"attribute_name"`
+	Previous      int64  `json:"previous"`
+	Current       int64  `json:"current"`
+}
+
+// digestTrend compares the alerting of the window with the days before it
+type digestTrend struct {
+	Drives         int    `json:"drives"`
+	DrivesAlerting int    `json:"drives_alerting"`  // with an alert seen in the window
+	DailyNewAlerts []int  `json:"daily_new_alerts"` // per window, oldest first; the last is this digest's
+	Direction      string `json:"direction"`        // "improving", "steady" or "worsening"
+}
+
+// buildDigest gathers the digest for the window ending at now. An alert counts
+// as cleared when it resolved in the window, which happens when its drive has
+// been read without raising it again; alerts raised on a change, such as
+// BAY_CHANGED, clear on the next reading.
+func (m *MAIDSmartMonitor) buildDigest(now time.Time) (*digestReport, error) {
+	host, _ := os.Hostname()
+	since := now.Add(-digestWindow)
+	report := &digestReport{Host: host, From: since, To: now}
+
+	var err error
+	report.NewAlerts, err = m.queryAlerts(`first_seen >= ? AND first_seen <= ?`, since, now)
+	if err != nil {
+		return nil, err
+	}
+	report.ClearedAlerts, err = m.queryAlerts(`resolved_at >= ? AND resolved_at <= ?`, since, now)
+	if err != nil {
+		return nil, err
+	}
+	if report.Hottest, err = m.digestTemperatures(since); err != nil {
+		return nil, err
+	}
+	if report.CriticalChanges, err = m.digestCriticalChanges(since); err != nil {
+		return nil, err
+	}
+	if report.Trend, err = m.digestTrend(now); err != nil {
+		return nil, err
+	}
+
+	// Empty sections are empty lists, not null, in JSON
+	if report.NewAlerts == nil {
+		report.NewAlerts = []exportedAlert{}
+	}
+	if report.ClearedAlerts == nil {
+		report.ClearedAlerts = []exportedAlert{}
+	}
+	if report.Hottest == nil {
+		report.Hottest = []digestTemperature{}
+	}
+	if report.CriticalChanges == nil {
+		report.CriticalChanges = []digestChange{}
+	}
+	return report, nil
+}
+
+// digestTemperatures returns the hottest drives by their peak temperature since
+// since, taken from attribute 194 when the drive reports it and from 190 otherwise
+func (m *MAIDSmartMonitor) digestTemperatures(since time.Time) ([]digestTemperature, error) {
+	rows, err := m.db.Query(`
+		SELECT st.device, COALESCE(st.serial_number, ''), s.attribute_id, MAX(s.raw_value),
+		       (SELECT raw_value FROM smart_data WHERE device_id = s.device_id AND attribute_id = s.attribute_id
+		        ORDER BY timestamp DESC LIMIT 1)
+		FROM smart_data s
+		JOIN device_status st ON st.device_id = s.device_id
+		WHERE s.attribute_id IN (190, 194) AND s.timestamp >= ? AND s.raw_value IS NOT NULL
+		GROUP BY s.device_id, s.attribute_id
+		ORDER BY st.device, s.attribute_id DESC
+	`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query temperatures: %v", err)
+	}
+	defer rows.Close()
+
+	var hottest []digestTemperature
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var device, serial string
+		var attrID int
+		var peak, current int64
+		if err := rows.Scan(&device, &serial, &attrID, &peak, &current); err != nil {
+			return nil, fmt.Errorf("failed to scan temperature row: %v", err)
+		}
+		// 194 sorts first, so 190 is only used for drives without it
+		if seen[device] {
+			continue
+		}
+		seen[device] = true
+		hottest = append(hottest, digestTemperature{
+			Device:       device,
+			SerialNumber: serial,
+			Current:      m.convertTemperature(current),
+			Peak:         m.convertTemperature(peak),
+			Unit:         m.tempUnit,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read temperatures: %v", err)
+	}
+
+	sort.SliceStable(hottest, func(i, j int) bool { return hottest[i].Peak > hottest[j].Peak })
+	if len(hottest) > digestHottest {
+		hottest = hottest[:digestHottest]
+	}
+	return hottest, nil
+}
+
+// digestCriticalChanges returns the critical attributes whose latest raw value
+// differs from the last one stored before since. Drives first seen within the
+// window have nothing to compare against and are left out.
+func (m *MAIDSmartMonitor) digestCriticalChanges(since time.Time) ([]digestChange, error) {
+	ids := make([]int, 0, len(m.criticalAttrs))
+	for id := range m.criticalAttrs {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sort.Ints(ids)
+
+	args := make([]interface{}, 0, len(ids)+1)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, since)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+
+	rows, err := m.db.Query(`
+		SELECT st.device, COALESCE(st.serial_number, ''), cur.attribute_id, cur.attribute_name,
+		       prev.raw_value, cur.raw_value
+		FROM device_status st
+		JOIN smart_data cur ON cur.device_id = st.device_id
+		JOIN smart_data prev ON prev.device_id = cur.device_id AND prev.attribute_id = cur.attribute_id
+		WHERE cur.attribute_id IN (`+placeholders+`)
+		  AND cur.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                       WHERE device_id = cur.device_id AND attribute_id = cur.attribute_id)
+		  AND prev.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                        WHERE device_id = cur.device_id AND attribute_id = cur.attribute_id
+		                          AND timestamp < ?)
+		  AND prev.raw_value != cur.raw_value
+		ORDER BY st.device, cur.attribute_id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query critical attributes: %v", err)
+	}
+	defer rows.Close()
+
+	var changes []digestChange
+	for rows.Next() {
+		var c digestChange
+		if err := rows.Scan(&c.Device, &c.SerialNumber, &c.AttributeID, &c.AttributeName, &c.Previous, &c.Current); err != nil {
+			return nil, fmt.Errorf("failed to scan critical attribute row: %v", err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// digestTrend counts the drives, those alerting in the window ending at now,
+// and the new alerts in each of the last digestTrendDays windows. The trend is
+// worsening when the latest window had more new alerts than the average of the
+// ones before it, improving when it had fewer.
+func (m *MAIDSmartMonitor) digestTrend(now time.Time) (digestTrend, error) {
+	trend := digestTrend{DailyNewAlerts: make([]int, digestTrendDays)}
+	start := now.Add(-digestTrendDays * digestWindow)
+
+	err := m.db.QueryRow(`SELECT COUNT(*) FROM device_status`).Scan(&trend.Drives)
+	if err != nil {
+		return trend, fmt.Errorf("failed to count drives: %v", err)
+	}
+	err = m.db.QueryRow(`
+		SELECT COUNT(DISTINCT device_id) FROM health_alerts
+		WHERE timestamp >= ? AND NOT maintenance AND NOT suppressed
+	`, now.Add(-digestWindow)).Scan(&trend.DrivesAlerting)
+	if err != nil {
+		return trend, fmt.Errorf("failed to count alerting drives: %v", err)
+	}
+
+	rows, err := m.db.Query(`SELECT first_seen FROM health_alerts WHERE first_seen >= ? AND first_seen <= ?`, start, now)
+	if err != nil {
+		return trend, fmt.Errorf("failed to query alert trend: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var firstSeen time.Time
+		if err := rows.Scan(&firstSeen); err != nil {
+			return trend, fmt.Errorf("failed to scan alert trend row: %v", err)
+		}
+		day := int(firstSeen.Sub(start) / digestWindow)
+		if day >= digestTrendDays {
+			day = digestTrendDays - 1
+		}
+		trend.DailyNewAlerts[day]++
+	}
+	if err := rows.Err(); err != nil {
+		return trend, fmt.Errorf("failed to read alert trend: %v", err)
+	}
+
+	latest := trend.DailyNewAlerts[digestTrendDays-1]
+	earlier := 0
+	for _, n := range trend.DailyNewAlerts[:digestTrendDays-1] {
+		earlier += n
+	}
+	switch {
+	case latest*(digestTrendDays-1) > earlier:
+		trend.Direction = "worsening"
+	case latest*(digestTrendDays-1) < earlier:
+		trend.Direction = "improving"
+	default:
+		trend.Direction = "steady"
+	}
+	return trend, nil
+}
+
+// writeDigest renders report to w as text, html or json
+func writeDigest(w io.Writer, report *digestReport, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "html":
+		return digestHTMLTemplate.Execute(w, report)
+	default:
+		writeDigestText(w, report)
+		return nil
+	}
+}
+
+// writeDigestText renders report as plain text, one line per item
+func writeDigestText(w io.Writer, r *digestReport) {
+	const timeFormat = "2006-01-02 15:04"
+	fmt.Fprintf(w, "Daily digest for %s, %s to %s\n", r.Host, r.From.Format(timeFormat), r.To.Format(timeFormat))
+
+	writeAlerts := func(title string, alerts []exportedAlert) {
+		fmt.Fprintf(w, "\n%s (%d):\n", title, len(alerts))
+		if len(alerts) == 0 {
+			fmt.Fprintln(w, "  none")
+		}
+		for _, a := range alerts {
+			note := ""
+			if a.Suppressed {
+				note = " (suppressed)"
+			} else if a.Maintenance {
+				note = " (maintenance)"
+			}
+			fmt.Fprintf(w, "  [%s] %s %s %s: %s (last seen %s)%s\n", a.Severity, a.Device, a.AttributeName,
+				a.AlertType, a.Message, a.LastSeen.Format(timeFormat), note)
+		}
+	}
+	writeAlerts("New alerts", r.NewAlerts)
+	writeAlerts("Cleared alerts", r.ClearedAlerts)
+
+	fmt.Fprintln(w, "\nHottest drives:")
+	if len(r.Hottest) == 0 {
+		fmt.Fprintln(w, "  no temperature readings")
+	}
+	for _, t := range r.Hottest {
+		fmt.Fprintf(w, "  %s (%s): %g°%s now, peak %g°%s\n", t.Device, t.SerialNumber, t.Current, t.Unit, t.Peak, t.Unit)
+	}
+
+	fmt.Fprintln(w, "\nCritical attribute changes:")
+	if len(r.CriticalChanges) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, c := range r.CriticalChanges {
+		fmt.Fprintf(w, "  %s (%s): %s %d -> %d (%+d)\n", c.Device, c.SerialNumber, c.AttributeName,
+			c.Previous, c.Current, c.Current-c.Previous)
+	}
+
+	counts := make([]string, len(r.Trend.DailyNewAlerts))
+	for i, n := range r.Trend.DailyNewAlerts {
+		counts[i] = strconv.Itoa(n)
+	}
+	fmt.Fprintf(w, "\nFleet trend: %d drives, %d with alerts in the last day; new alerts per day over %d days: %s (%s)\n",
+		r.Trend.Drives, r.Trend.DrivesAlerting, len(counts), strings.Join(counts, " "), r.Trend.Direction)
+}
+
+// digestHTMLTemplate renders a digest as a self-contained HTML page for mail
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Funcs(htmltemplate.FuncMap{
+	"when": func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"diff": func(c digestChange) string { return fmt.Sprintf("%+d", c.Current-c.Previous) },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Daily digest for {{.Host}}</title></head>
+<body>
+<h1>Daily digest for {{.Host}}</h1>
+<p>{{when .From}} to {{when .To}}</p>
+{{define "alerts"}}{{if .}}<table border="1" cellpadding="4">
+<tr><th>Severity</th><th>Device</th><th>Attribute</th><th>Type</th><th>Message</th><th>Last seen</th></tr>
+{{range .}}<tr><td>{{.Severity}}</td><td>{{.Device}}</td><td>{{.AttributeName}}</td><td>{{.AlertType}}</td><td>{{.Message}}</td><td>{{when .LastSeen}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}{{end}}
+<h2>New alerts ({{len .NewAlerts}})</h2>
+{{template "alerts" .NewAlerts}}
+<h2>Cleared alerts ({{len .ClearedAlerts}})</h2>
+{{template "alerts" .ClearedAlerts}}
+<h2>Hottest drives</h2>
+{{if .Hottest}}<table border="1" cellpadding="4">
+<tr><th>Device</th><th>Serial</th><th>Now</th><th>Peak</th></tr>
+{{range .Hottest}}<tr><td>{{.Device}}</td><td>{{.SerialNumber}}</td><td>{{.Current}}°{{.Unit}}</td><td>{{.Peak}}°{{.Unit}}</td></tr>
+{{end}}</table>{{else}}<p>No temperature readings</p>{{end}}
+<h2>Critical attribute changes</h2>
+{{if .CriticalChanges}}<table border="1" cellpadding="4">
+<tr><th>Device</th><th>Serial</th><th>Attribute</th><th>Before</th><th>Now</th><th>Change</th></tr>
+{{range .CriticalChanges}}<tr><td>{{.Device}}</td><td>{{.SerialNumber}}</td><td>{{.AttributeName}}</td><td>{{.Previous}}</td><td>{{.Current}}</td><td>{{diff .}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+<h2>Fleet trend</h2>
+<p>{{.Trend.Drives}} drives, {{.Trend.DrivesAlerting}} with alerts in the last day.
+New alerts per day: {{range $i, $n := .Trend.DailyNewAlerts}}{{if $i}} {{end}}{{$n}}{{end}} ({{.Trend.Direction}})</p>
+</body></html>
+`))
+
+// sendDigest builds the digest for the day just ended and delivers it through
+// the notifiers as an INFO DAILY_DIGEST alert carrying the rendered report as its
+// message, so sinks limited to higher severities do not receive it
+func (m *MAIDSmartMonitor) sendDigest(format string) error {
+	now := time.Now()
+	report, err := m.buildDigest(now)
+	if err != nil {
+		return err
+	}
+
+	var message bytes.Buffer
+	if err := writeDigest(&message, report, format); err != nil {
+		return fmt.Errorf("failed to render digest: %v", err)
+	}
+
+	m.logger.Printf("Sending daily digest: %d new alerts, %d cleared, trend %s",
+		len(report.NewAlerts), len(report.ClearedAlerts), report.Trend.Direction)
+	m.notifyAlert(HealthAlert{
+		Device:        report.Host,
+		AttributeName: "Daily_Digest",
+		AlertType:     "DAILY_DIGEST",
+		Severity:      SeverityInfo,
+		Message:       message.String(),
+		FirstSeen:     now,
+		Timestamp:     now,
+	})
+	return nil
+}
+
+// nextDailyTime returns the first time after now at the hour and minute of clock
+func nextDailyTime(now, clock time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// updateDeviceStatus updates device status in database
+func (m *MAIDSmartMonitor) updateDeviceStatus(info *DeviceInfo) error {
+	return m.writes.do("device status", func() error {
+		return m.store.UpdateDeviceStatus(info)
+	})
+}
+
+// UpdateDeviceStatus replaces a device's status row
+func (s sqliteStore) UpdateDeviceStatus(info *DeviceInfo) error {
+	// A drive that used to be at this path has moved or gone away
+	if _, err := s.m.db.Exec(`
+		UPDATE device_status SET is_mounted = FALSE
+		WHERE device = ? AND device_id != ?
+	`, info.Device, info.ID()); err != nil {
+		return err
+	}
+
+	// Health and activity are only known while the drive spins, so an existing
+	// row is updated in place to keep them. A new drive counts as active from
+	// when it is first seen.
+	now := time.Now()
+	_, err := s.m.db.Exec(`
+		INSERT INTO device_status
+		(device_id, device, serial_number, model, wwn, last_seen, is_mounted, 
+		 smart_enabled, last_smart_check, security_state, is_locked, last_active, bay,
+		 media_type, rotation_rate, capacity_bytes, form_factor, logical_sector_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_id) DO UPDATE SET
+			device = excluded.device, serial_number = excluded.serial_number, model = excluded.model,
+			wwn = excluded.wwn, last_seen = excluded.last_seen, is_mounted = excluded.is_mounted,
+			smart_enabled = excluded.smart_enabled, last_smart_check = excluded.last_smart_check,
+			security_state = excluded.security_state, is_locked = excluded.is_locked, bay = excluded.bay,
+			media_type = excluded.media_type, rotation_rate = excluded.rotation_rate,
+			capacity_bytes = excluded.capacity_bytes, form_factor = excluded.form_factor,
+			logical_sector_size = excluded.logical_sector_size
+	`, info.ID(), info.Device, info.SerialNumber, info.Model, info.WWN, now, info.IsMounted,
+		info.SmartEnabled, now, info.SecurityState, info.Locked, now, info.Bay,
+		info.MediaType, info.RotationRate, info.CapacityBytes, info.FormFactor, info.LogicalSectorSize)
+
+	return err
+}
+
+// markActive records that a device was seen spinning this cycle
+func (m *MAIDSmartMonitor) markActive(info *DeviceInfo) {
+	now := time.Now()
+	m.writes.async("device activity", func() error {
+		return m.store.MarkActive(info.ID(), now)
+	})
+}
+
+// MarkActive sets last_active in the drive's status row
+func (s sqliteStore) MarkActive(deviceID string, at time.Time) error {
+	_, err := s.m.db.Exec(`UPDATE device_status SET last_active = ? WHERE device_id = ?`, at, deviceID)
+	return err
+}
+
+// Device reads the drive's status row
+func (s sqliteStore) Device(deviceID string) (*StoredDevice, error) {
+	return s.queryDevice(`device_id = ?`, deviceID)
+}
+
+// DeviceAt reads the status row of the drive at the path
+func (s sqliteStore) DeviceAt(device string) (*StoredDevice, error) {
+	return s.queryDevice(`device = ? ORDER BY is_mounted DESC, last_seen DESC LIMIT 1`, device)
+}
+
+// queryDevice reads the first status row matching the SQL condition, or nil
+func (s sqliteStore) queryDevice(condition string, args ...interface{}) (*StoredDevice, error) {
+	var d StoredDevice
+	var device, serial, model, bay sql.NullString
+	var locked, enabled sql.NullBool
+	var lastActive sql.NullTime
+	var selfTest, warningTime, criticalTime, throttleCount, throttleTime sql.NullInt64
+	err := s.m.db.QueryRow(`
+		SELECT device_id, device, serial_number, model, bay, is_locked, smart_enabled, last_active,
+		       self_test_code, nvme_warning_temp_time, nvme_critical_temp_time, nvme_throttle_count, nvme_throttle_time
+		FROM device_status WHERE `+condition, args...).Scan(&d.DeviceID, &device, &serial, &model, &bay,
+		&locked, &enabled, &lastActive, &selfTest, &warningTime, &criticalTime, &throttleCount, &throttleTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.Device, d.SerialNumber, d.Model, d.Bay = device.String, serial.String, model.String, bay.String
+	d.Locked, d.SmartEnabled, d.LastActive = locked.Bool, enabled.Bool, lastActive.Time
+	if selfTest.Valid {
+		code := int(selfTest.Int64)
+		d.SelfTestCode = &code
+	}
+	// The thermal counters are always written together
+	if warningTime.Valid {
+		d.NVMeThermal = &NVMeThermalCounters{WarningTempTime: warningTime.Int64, CriticalTempTime: criticalTime.Int64,
+			ThrottleCount: throttleCount.Int64, ThrottleTime: throttleTime.Int64}
+	}
+	return &d, nil
+}
+
+// nvmeCriticalWarnings describes the bits of the NVMe health log's
+// critical_warning byte and the alert each raises while set
+var nvmeCriticalWarnings = []struct {
+	bit       uint
+	alertType string
+	message   string
+}{
+	{0, "NVME_SPARE_LOW", "Available spare capacity is below the drive's threshold - it is running out of blocks to replace failing ones; plan its replacement"},
+	{1, "NVME_TEMPERATURE", "Temperature is beyond the drive's over- or under-temperature threshold - check its cooling"},
+	{2, "NVME_RELIABILITY_DEGRADED", "Reliability is degraded by media or internal errors - back it up and replace it"},
+	{3, "NVME_READ_ONLY", "Media has been placed in read-only mode, so writes fail - copy the data off and replace it"},
+	{4, "NVME_BACKUP_FAILED", "Volatile memory backup has failed, so cached writes may be lost on power loss"},
+}
+
+// checkNVMeCriticalWarning raises an alert for each bit set in an NVMe drive's
+// critical_warning byte, the drive's own report that it is failing
+func (m *MAIDSmartMonitor) checkNVMeCriticalWarning(device string, smartData *SmartData) {
+	if smartData.NVMeHealthLog == nil {
+		return
+	}
+	warning := smartData.NVMeHealthLog.CriticalWarning
+	known := 0
+	for _, w := range nvmeCriticalWarnings {
+		known |= 1 << w.bit
+		if warning&(1<<w.bit) != 0 {
+			m.createAlert(device, "Critical_Warning", w.alertType,
+				fmt.Sprintf("%s (critical_warning 0x%02x)", w.message, warning))
+		}
+	}
+	if other := warning &^ known; other != 0 {
+		m.warnLogger.Printf("NVMe drive %s reports critical_warning bits 0x%02x the monitor does not know", device, other)
+	}
+}
+
+// checkNVMeThermal stores an NVMe drive's thermal counters and compares them with
+// the previous reading: time spent above the warning composite temperature or in
+// thermal management raises NVME_THROTTLING, time above the critical composite
+// temperature NVME_CRITICAL_TEMPERATURE. Throttling slows a drive without any
+// error, so the counters are the only sign of it. Counters that went down, as
+// after a controller reset, are taken as the new starting point.
+func (m *MAIDSmartMonitor) checkNVMeThermal(info *DeviceInfo, smartData *SmartData) error {
+	health := smartData.NVMeHealthLog
+	if health == nil {
+		return nil
+	}
+	throttleCount := health.ThermalTemp1TransitionCount + health.ThermalTemp2TransitionCount
+	throttleTime := health.ThermalTemp1TotalTime + health.ThermalTemp2TotalTime
+
+	stored, err := m.store.Device(info.ID())
+	if err != nil {
+		return fmt.Errorf("failed to read previous thermal counters: %v", err)
+	}
+	current := NVMeThermalCounters{WarningTempTime: health.WarningTempTime, CriticalTempTime: health.CriticalCompTime,
+		ThrottleCount: throttleCount, ThrottleTime: throttleTime}
+	var previous NVMeThermalCounters
+	recorded := stored != nil && stored.NVMeThermal != nil
+	if recorded {
+		previous = *stored.NVMeThermal
+	}
+
+	increase := func(previous, current int64) int64 {
+		if !recorded || current < previous {
+			return 0
+		}
+		return current - previous
+	}
+
+	if !recorded && (throttleCount > 0 || health.WarningTempTime > 0) {
+		m.logger.Printf("NVMe drive %s has throttled %d times (%s) and spent %d minutes above its warning temperature over its life",
+			info.Device, throttleCount, time.Duration(throttleTime)*time.Second, health.WarningTempTime)
+	}
+
+	var parts []string
+	if n := increase(previous.ThrottleCount, current.ThrottleCount); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d throttling transitions", n))
+	}
+	if n := increase(previous.ThrottleTime, current.ThrottleTime); n > 0 {
+		parts = append(parts, fmt.Sprintf("%s throttled", time.Duration(n)*time.Second))
+	}
+	if n := increase(previous.WarningTempTime, current.WarningTempTime); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d minutes above the warning composite temperature", n))
+	}
+	if len(parts) > 0 {
+		m.createAlert(info.Device, "Thermal_Management", "NVME_THROTTLING",
+			fmt.Sprintf("Drive %s is thermally throttling: %s since the last reading - check its cooling",
+				info.SerialNumber, strings.Join(parts, ", ")))
+	}
+	if n := increase(previous.CriticalTempTime, current.CriticalTempTime); n > 0 {
+		m.createAlert(info.Device, "Thermal_Management", "NVME_CRITICAL_TEMPERATURE",
+			fmt.Sprintf("Drive %s spent %d minutes above its critical composite temperature since the last reading - it may shut down or be damaged; check its cooling now",
+				info.SerialNumber, n))
+	}
+
+	return m.writes.do("nvme thermal counters", func() error {
+		return m.store.UpdateNVMeThermal(info.ID(), current)
+	})
+}
+
+// UpdateNVMeThermal sets the NVMe thermal columns of the drive's status row
+func (s sqliteStore) UpdateNVMeThermal(deviceID string, counters NVMeThermalCounters) error {
+	_, err := s.m.db.Exec(`
+		UPDATE device_status SET nvme_warning_temp_time = ?, nvme_critical_temp_time = ?,
+			nvme_throttle_count = ?, nvme_throttle_time = ?
+		WHERE device_id = ?
+	`, counters.WarningTempTime, counters.CriticalTempTime, counters.ThrottleCount, counters.ThrottleTime, deviceID)
+	return err
+}
+
+// checkProlongedStandby alerts when a device in standby has not been seen
+// spinning for longer than maxStandby. Drives in a MAID array are expected to
+// spin up now and then, for scrubs if nothing else, so one that never does may
+// be dead rather than idle.
+func (m *MAIDSmartMonitor) checkProlongedStandby(info *DeviceInfo) {
+	if m.maxStandby <= 0 {
+		return
+	}
+
+	stored, err := m.store.Device(info.ID())
+	if err != nil {
+		m.errLogger.Printf("Failed to read last activity for %s: %v", info.Device, err)
+		return
+	}
+	if stored == nil || stored.LastActive.IsZero() {
+		return
+	}
+
+	if idle := time.Since(stored.LastActive); idle > m.maxStandby {
+		m.createAlert(info.Device, "Power_Mode", "PROLONGED_STANDBY",
+			fmt.Sprintf("Drive %s not seen spinning since %s (%s), longer than %s - it may be dead rather than idle",
+				info.SerialNumber, stored.LastActive.Format("2006-01-02 15:04"), idle.Round(time.Hour), m.maxStandby))
+	}
+}
+
+// checkLockTransition alerts when a drive previously seen unlocked is now locked,
+// which happens when a self-encrypting drive loses power without being re-unlocked.
+// A locked drive's filesystems cannot be mounted, so mounts discovery drops it;
+// only drives found with -discovery scan or listed in -devices are checked.
+// It must run before the new status is stored.
+func (m *MAIDSmartMonitor) checkLockTransition(info *DeviceInfo) {
+	if !info.Locked {
+		return
+	}
+
+	previous, err := m.store.Device(info.ID())
+	if err != nil {
+		m.errLogger.Printf("Failed to read previous lock state for %s: %v", info.Device, err)
+		return
+	}
+
+	if previous != nil && !previous.Locked {
+		m.createAlert(info.Device, "ATA_Security", "DRIVE_LOCKED",
+			fmt.Sprintf("Drive %s was unlocked and is now locked (%s) - possible unexpected power cycle",
+				info.SerialNumber, info.SecurityState))
+	}
+}
+
+// checkSmartTransition alerts when a drive previously seen with SMART enabled now
+// reports it unsupported or disabled, after which its attributes are no longer
+// collected: a controller or enclosure change hiding it, or someone running
+// smartctl -s off. It must run before the new status is stored.
+func (m *MAIDSmartMonitor) checkSmartTransition(info *DeviceInfo) {
+	if info.SmartEnabled {
+		return
+	}
+
+	previous, err := m.store.Device(info.ID())
+	if err != nil {
+		m.errLogger.Printf("Failed to read previous SMART state for %s: %v", info.Device, err)
+		return
+	}
+
+	if previous != nil && previous.SmartEnabled {
+		m.createAlert(info.Device, "SMART_Support", "SMART_DISABLED",
+			fmt.Sprintf("Drive %s had SMART enabled and now reports it unsupported or disabled - its attributes are no longer monitored",
+				info.SerialNumber))
+	}
+}
+
+// checkDuplicateSerial alerts when info reports a serial number already seen on
+// another device path this cycle, as counterfeit and cloned drives do. seen maps
+// each serial to the first device that reported it and is updated in place.
+func (m *MAIDSmartMonitor) checkDuplicateSerial(info *DeviceInfo, seen map[string]string) {
+	if info.SerialNumber == "" {
+		return
+	}
+
+	first, ok := seen[info.SerialNumber]
+	if !ok {
+		seen[info.SerialNumber] = info.Device
+		return
+	}
+	if first != info.Device {
+		m.createAlert(info.Device, "Serial_Number", "DUPLICATE_SERIAL",
+			fmt.Sprintf("Serial %s on %s was already reported by %s this cycle - possible counterfeit or cloned drive",
+				info.SerialNumber, info.Device, first))
+	}
+}
+
+// checkPathReassignment logs when info's device path last belonged to another
+// drive, or the drive was last seen at another path, as after a reboot or
+// rewiring renames /dev/sdX. History is keyed by device_id, so each drive's
+// readings stay its own whatever path it is read through. It must run before the
+// device status is updated.
+func (m *MAIDSmartMonitor) checkPathReassignment(info *DeviceInfo) {
+	previous, err := m.store.DeviceAt(info.Device)
+	switch {
+	case err != nil:
+		m.errLogger.Printf("Failed to read previous drive at %s: %v", info.Device, err)
+		return
+	case previous != nil && previous.DeviceID != info.ID():
+		m.logger.Printf("Device %s was reassigned: it now holds %s %s, previously %s %s; readings are recorded under %s",
+			info.Device, info.Model, info.ID(), previous.Model, previous.DeviceID, info.ID())
+	}
+
+	stored, err := m.store.Device(info.ID())
+	switch {
+	case err != nil:
+		m.errLogger.Printf("Failed to read previous path of %s: %v", info.ID(), err)
+	case stored != nil && stored.Device != "" && stored.Device != info.Device:
+		m.logger.Printf("Drive %s moved from %s to %s", info.ID(), stored.Device, info.Device)
+	}
+}
+
+// loadSlotMap reads a JSON object mapping physical bays to the serial number or
+// /dev path (such as a /dev/disk/by-path link) of the drive each holds, e.g.
+// {"7": "WD-WCC4E1234567", "8": "/dev/disk/by-path/pci-0000:00:1f.2-ata-3"}
+func loadSlotMap(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read slot map: %v", err)
+	}
+
+	var slots map[string]string
+	if err := json.Unmarshal(content, &slots); err != nil {
+		return nil, fmt.Errorf("failed to parse slot map: %v", err)
+	}
+
+	bays := make(map[string]string)
+	for bay, target := range slots {
+		if target == "" {
+			return nil, fmt.Errorf("bay %s has no serial or device path", bay)
+		}
+		if other, ok := bays[target]; ok {
+			return nil, fmt.Errorf("%s is listed in both bay %s and bay %s", target, other, bay)
+		}
+		bays[target] = bay
+	}
+	return slots, nil
+}
+
+// slotBays looks a drive up in the slot map: physical is the bay whose device
+// path resolves to the drive's, recorded the bay listed against its serial
+func (m *MAIDSmartMonitor) slotBays(info *DeviceInfo) (physical, recorded string) {
+	device, err := filepath.EvalSymlinks(info.Device)
+	if err != nil {
+		device = info.Device
+	}
+	for bay, target := range m.slotMap {
+		switch {
+		case strings.HasPrefix(target, "/dev/"):
+			if resolved, err := filepath.EvalSymlinks(target); err == nil && resolved == device {
+				physical = bay
+			}
+		case info.SerialNumber != "" && target == info.SerialNumber:
+			recorded = bay
+		}
+	}
+	return physical, recorded
+}
+
+// checkBay sets info's bay from the slot map, preferring the bay its device path
+// is mapped to, and alerts when the drive is not where it was last seen or where
+// the map lists its serial. It must run before the device status is updated.
+func (m *MAIDSmartMonitor) checkBay(info *DeviceInfo) {
+	if len(m.slotMap) == 0 {
+		return
+	}
+
+	physical, recorded := m.slotBays(info)
+	info.Bay = physical
+	if info.Bay == "" {
+		info.Bay = recorded
+	}
+	if info.Bay == "" {
+		return
+	}
+
+	stored, err := m.store.Device(info.ID())
+	if err != nil {
+		m.errLogger.Printf("Failed to read previous bay for %s: %v", info.Device, err)
+		return
+	}
+	previous := ""
+	if stored != nil {
+		previous = stored.Bay
+	}
+
+	switch {
+	case previous != "" && previous != info.Bay:
+		// Record the new bay ahead of the alert so the alert names it
+		bay := info.Bay
+		m.writes.async("device bay", func() error {
+			return m.store.UpdateBay(info.ID(), bay)
+		})
+		m.createAlert(info.Device, "Bay", "BAY_CHANGED",
+			fmt.Sprintf("Drive %s moved from bay %s to bay %s", info.ID(), previous, info.Bay))
+	case physical != "" && recorded != "" && physical != recorded:
+		m.createAlert(info.Device, "Bay", "BAY_CHANGED",
+			fmt.Sprintf("Drive %s is in bay %s but the slot map lists it in bay %s - update the slot map",
+				info.ID(), physical, recorded))
+	}
+}
+
+// UpdateBay sets the bay in the drive's status row
+func (s sqliteStore) UpdateBay(deviceID, bay string) error {
+	_, err := s.m.db.Exec(`UPDATE device_status SET bay = ? WHERE device_id = ?`, bay, deviceID)
+	return err
+}
+
+// alertFunc receives an alert raised by the health checks
+type alertFunc func(device, attribute, alertType, message string)
+
+// checkHealthThresholds checks for potential health issues and generates alerts
+func (m *MAIDSmartMonitor) checkHealthThresholds(attributes []map[string]interface{}, model string) {
+	m.evaluateThresholds(attributes, model, m.createAlert)
+}
+
+// evaluateThresholds applies the health rules to a set of attributes of a drive
+// of the given model, passing each alert to raise; the live cycle persists them,
+// historical analysis only collects them
+func (m *MAIDSmartMonitor) evaluateThresholds(attributes []map[string]interface{}, model string, raise alertFunc) {
+	tempAttr := authoritativeTemperature(attributes)
+	profile := m.profileFor(model)
+	tempLimit := int64(defaultTemperatureLimit)
+	if profile != nil && profile.MaxTemperature > 0 {
+		tempLimit = profile.MaxTemperature
+	}
+
+	for _, attr := range attributes {
+		attrID := attr["attribute_id"].(int)
+		device := attr["device"].(string)
+		rawValue := attr["raw_value"].(int64)
+		normalizedValue := attr["normalized_value"].(int)
+		threshold := attr["threshold"].(int)
+		attrName := attr["attribute_name"].(string)
+
+		// Check for threshold violations. A prefail attribute at its threshold
+		// predicts failure; an old-age one means wear, which -weight-prefail
+		// alerts on less urgently. Rows without the flag count as prefail.
+		// -ignore-stale skips only this comparison of a normalized value that
+		// offline collection has not refreshed; raw counts are still checked.
+		stale, _ := attr["stale"].(bool)
+		violation, approaching, margin := "THRESHOLD_VIOLATION", "THRESHOLD_APPROACHING", m.thresholdMargin
+		if prefail, known := attr["prefailure"].(bool); m.weightPrefail && known && !prefail {
+			violation, approaching, margin = "OLD_AGE_THRESHOLD", "OLD_AGE_APPROACHING", m.oldAgeMargin
+		}
+		switch {
+		case stale && m.ignoreStale:
+		case threshold > 0 && normalizedValue <= threshold:
+			raise(device, attrName, violation,
+				fmt.Sprintf("Value %d below threshold %d", normalizedValue, threshold))
+		case threshold > 0 && margin > 0 && normalizedValue <= threshold+margin:
+			raise(device, attrName, approaching,
+				fmt.Sprintf("Value %d within %d of threshold %d", normalizedValue, normalizedValue-threshold, threshold))
+		}
+
+		// Some firmware keeps attribute 5 normalized at 100 while sectors are
+		// reallocated, so the raw count is checked on its own
+		if attrID == 5 && m.reallocatedLimit > 0 && rawValue > m.reallocatedLimit {
+			raise(device, attrName, "REALLOCATED_COUNT",
+				fmt.Sprintf("%d sectors reallocated, above limit %d (normalized %d, threshold %d)",
+					rawValue, m.reallocatedLimit, normalizedValue, threshold))
+		}
+
+		// Check critical attributes
+		if m.criticalAttrs[attrID] && rawValue > 0 {
+			raise(device, attrName, "CRITICAL_VALUE",
+				fmt.Sprintf("Non-zero critical value: %d", rawValue))
+		}
+
+		// Temperature warnings, from one sensor per drive so that a single
+		// overheat does not raise two alerts
+		if attrID == tempAttr && rawValue > tempLimit {
+			message := fmt.Sprintf("High %s temperature: %d°C", temperatureSensor(attrID), rawValue)
+			if tempLimit != defaultTemperatureLimit {
+				message += fmt.Sprintf(", above the %d°C rated for %s", tempLimit, profile.Name)
+			}
+			raise(device, attrName, "HIGH_TEMPERATURE", message)
+		}
+
+		if profile != nil {
+			if limit := profile.RawLimits[attrID]; limit > 0 && rawValue > limit {
+				raise(device, attrName, "RATED_LIMIT",
+					fmt.Sprintf("%d exceeds the %d rated for %s", rawValue, limit, profile.Name))
+			}
+		}
+	}
+}
+
+// defaultTemperatureLimit is the drive temperature in °C above which
+// HIGH_TEMPERATURE is raised, unless the drive's model profile rates it otherwise
+const defaultTemperatureLimit = 60
+
+// modelProfile holds the nominal limits of a drive family, applied to drives
+// whose model matches Model, a regular expression
+type modelProfile struct {
+	Name           string        `json:"name"`
+	Model          string        `json:"model"`
+	MaxTemperature int64         `json:"max_temperature,omitempty"` // °C, replacing defaultTemperatureLimit
+	RawLimits      map[int]int64 `json:"raw_limits,omitempty"`      // attribute ID to rated raw value, e.g. 193 load cycles
+	DataUnit       string        `json:"data_unit,omitempty"`       // unit of attributes 241/242, see dataUnits
+
+	pattern *regexp.Regexp
+}
+
+// builtinModelProfiles are the rated operating temperature and load/unload
+// cycles from the manufacturers' data sheets for common NAS and enterprise
+// families. They are deliberately broad; -model-profiles refines them.
+var builtinModelProfiles = mustCompileProfiles([]modelProfile{
+	{Name: "WD Red", Model: `^WDC WD\d+EF[A-Z]X`, MaxTemperature: 65, RawLimits: map[int]int64{193: 600000}},
+	{Name: "WD Red Pro", Model: `^WDC WD\d+[FK]F[A-Z]X`, MaxTemperature: 65, RawLimits: map[int]int64{193: 600000}},
+	{Name: "WD Blue/Green", Model: `^WDC WD\d+E[AZ][A-Z]{2}`, MaxTemperature: 60, RawLimits: map[int]int64{193: 300000}},
+	{Name: "WD/HGST Ultrastar", Model: `^(HGST |WDC )?(HU[HS]|WUH)7`, MaxTemperature: 60, RawLimits: map[int]int64{193: 600000}},
+	{Name: "Seagate IronWolf", Model: `^ST\d+(VN|NE|NT)`, MaxTemperature: 70, RawLimits: map[int]int64{193: 600000}},
+	{Name: "Seagate Exos", Model: `^ST\d+NM`, MaxTemperature: 60, RawLimits: map[int]int64{193: 600000}},
+	{Name: "Seagate BarraCuda", Model: `^ST\d+DM`, MaxTemperature: 60, RawLimits: map[int]int64{193: 300000}},
+	{Name: "Toshiba MG", Model: `^TOSHIBA MG\d`, MaxTemperature: 55, RawLimits: map[int]int64{193: 600000}},
+	{Name: "Toshiba N300", Model: `^TOSHIBA HDWG`, MaxTemperature: 65, RawLimits: map[int]int64{193: 600000}},
+})
+
+// compileProfiles compiles each profile's model pattern, matched without regard to case
+func compileProfiles(profiles []modelProfile) ([]modelProfile, error) {
+	for i := range profiles {
+		if profiles[i].Name == "" || profiles[i].Model == "" {
+			return nil, fmt.Errorf("profile %d: name and model are required", i+1)
+		}
+		pattern, err := regexp.Compile("(?i)" + profiles[i].Model)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: invalid model pattern: %v", profiles[i].Name, err)
+		}
+		if unit := profiles[i].DataUnit; unit != "" && unit != "lba" && dataUnits[unit] == 0 {
+			return nil, fmt.Errorf("profile %s: unknown data unit %q", profiles[i].Name, unit)
+		}
+		profiles[i].pattern = pattern
+	}
+	return profiles, nil
+}
+
+// mustCompileProfiles is compileProfiles for the built-in profiles
+func mustCompileProfiles(profiles []modelProfile) []modelProfile {
+	compiled, err := compileProfiles(profiles)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// loadModelProfiles reads a JSON array of profiles, e.g.
+// [{"name": "Archive shelf", "model": "^ST8000AS", "max_temperature": 55, "raw_limits": {"193": 300000}}]
+func loadModelProfiles(path string) ([]modelProfile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model profiles: %v", err)
+	}
+
+	var profiles []modelProfile
+	if err := json.Unmarshal(content, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse model profiles: %v", err)
+	}
+	return compileProfiles(profiles)
+}
+
+// profileFor returns the first profile matching model, or nil
+func (m *MAIDSmartMonitor) profileFor(model string) *modelProfile {
+	if model == "" {
+		return nil
+	}
+	for i := range m.modelProfiles {
+		if m.modelProfiles[i].pattern.MatchString(model) {
+			return &m.modelProfiles[i]
+		}
+	}
+	return nil
+}
+
+// dataUnits are the byte sizes of the units drives count attributes 241/242 in
+// other than LBAs, named as smartctl's drive database suffixes the attribute
+// names, e.g. Host_Writes_32MiB or Lifetime_Writes_GiB
+var dataUnits = map[string]int64{
+	"32MiB": 32 << 20,
+	"MiB":   1 << 20,
+	"GiB":   1 << 30,
+	"GB":    1000000000,
+}
+
+// dataUnitBytes returns the bytes per raw count of attribute 241 or 242 on a
+// drive: the unit its model profile names, else the one smartctl's name for the
+// attribute ends in, else its logical sector size, as the counts are in LBAs
+func (m *MAIDSmartMonitor) dataUnitBytes(name string, info *DeviceInfo) int64 {
+	unit := ""
+	if profile := m.profileFor(info.Model); profile != nil {
+		unit = profile.DataUnit
+	}
+	if unit == "" {
+		if i := strings.LastIndex(name, "_"); i >= 0 {
+			unit = name[i+1:]
+		}
+	}
+	if size := dataUnits[unit]; size > 0 {
+		return size
+	}
+	if info.LogicalSectorSize > 0 {
+		return info.LogicalSectorSize
+	}
+	return 512
+}
+
+// storeDataUnits records the bytes per raw count of the drive's Total_LBAs_Written
+// (241) and Total_LBAs_Read (242), from smartctl's names for them, so the summary
+// can report them in TB
+func (m *MAIDSmartMonitor) storeDataUnits(info *DeviceInfo, smartData *SmartData) error {
+	var written, read *int64
+	for _, attr := range smartData.ATASmartAttributes.Table {
+		unit := m.dataUnitBytes(attr.Name, info)
+		switch attr.ID {
+		case 241:
+			written = &unit
+		case 242:
+			read = &unit
+		}
+	}
+	if written == nil && read == nil {
+		return nil
+	}
+
+	return m.writes.do("data units", func() error {
+		return m.store.UpdateDataUnits(info.ID(), written, read)
+	})
+}
+
+// UpdateDataUnits sets the data unit columns of the drive's status row
+func (s sqliteStore) UpdateDataUnits(deviceID string, written, read *int64) error {
+	_, err := s.m.db.Exec(`UPDATE device_status SET written_unit_bytes = ?, read_unit_bytes = ? WHERE device_id = ?`,
+		written, read, deviceID)
+	return err
+}
+
+// authoritativeTemperature picks the attribute a drive's temperature alerts are
+// based on: 194 when the drive reports it, else 190, else 0. Both are still stored.
+func authoritativeTemperature(attributes []map[string]interface{}) int {
+	tempAttr := 0
+	for _, attr := range attributes {
+		switch attr["attribute_id"].(int) {
+		case 194:
+			return 194
+		case 190:
+			tempAttr = 190
+		}
+	}
+	return tempAttr
+}
+
+// checkPowerOnHours alerts when a serial's Power_On_Hours is lower than a value
+// previously stored for it, which means the serial was misread, another drive now
+// reports it, or the counter was reset on a relabeled drive. It must run before
+// the current reading is stored.
+func (m *MAIDSmartMonitor) checkPowerOnHours(attributes []map[string]interface{}, serial string) {
+	if serial == "" {
+		return
+	}
+
+	for _, attr := range attributes {
+		if attr["attribute_id"].(int) != 9 {
+			continue
+		}
+
+		current := attr["raw_value"].(int64)
+		highest, stored, err := m.store.HighestRawValue(serial, 9)
+		if err != nil {
+			m.errLogger.Printf("Failed to query Power_On_Hours history for %s: %v", serial, err)
+			return
+		}
+
+		if stored && current < highest {
+			m.createAlert(attr["device"].(string), attr["attribute_name"].(string), "POH_REGRESSION",
+				fmt.Sprintf("Power_On_Hours for serial %s went backwards: %d < previously seen %d",
+					serial, current, highest))
+		}
+	}
+}
+
+// HighestRawValue reads the highest raw value stored for the attribute
+func (s sqliteStore) HighestRawValue(deviceID string, attrID int) (int64, bool, error) {
+	var highest sql.NullInt64
+	err := s.m.db.QueryRow(`
+		SELECT MAX(raw_value) FROM smart_data
+		WHERE device_id = ? AND attribute_id = ?
+	`, deviceID, attrID).Scan(&highest)
+	return highest.Int64, highest.Valid, err
+}
+
+// LastReading reads the newest stored row of the attribute
+func (s sqliteStore) LastReading(deviceID string, attrID int) (*StoredReading, error) {
+	var reading StoredReading
+	var raw, normalized sql.NullInt64
+	err := s.m.db.QueryRow(`
+		SELECT timestamp, raw_value, normalized_value FROM smart_data
+		WHERE device_id = ? AND attribute_id = ?
+		ORDER BY timestamp DESC LIMIT 1
+	`, deviceID, attrID).Scan(&reading.Timestamp, &raw, &normalized)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reading.RawValue, reading.NormalizedValue = raw.Int64, normalized.Int64
+	return &reading, nil
+}
+
+// Readings reads the stored rows of the attribute since the given time
+func (s sqliteStore) Readings(deviceID string, attrID int, since time.Time) ([]StoredReading, error) {
+	rows, err := s.m.db.Query(`
+		SELECT timestamp, raw_value, normalized_value FROM smart_data
+		WHERE device_id = ? AND attribute_id = ? AND timestamp >= ?
+		ORDER BY timestamp
+	`, deviceID, attrID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []StoredReading
+	for rows.Next() {
+		var reading StoredReading
+		var raw, normalized sql.NullInt64
+		if err := rows.Scan(&reading.Timestamp, &raw, &normalized); err != nil {
+			return nil, err
+		}
+		reading.RawValue, reading.NormalizedValue = raw.Int64, normalized.Int64
+		readings = append(readings, reading)
+	}
+	return readings, rows.Err()
+}
+
+// checkErrorRateDecline alerts when a vendor-encoded error rate attribute's
+// normalized value has fallen errorRateDecline or more below the baseline
+// captured when its serial was first seen. Its raw value says nothing across
+// vendors, but firmware lowers the normalized value as the real rate worsens.
+// A placeholder baseline is replaced by the first real value instead.
+func (m *MAIDSmartMonitor) checkErrorRateDecline(attributes []map[string]interface{}, serial string) {
+	if serial == "" || m.errorRateDecline <= 0 {
+		return
+	}
+
+	for _, attr := range attributes {
+		attrID := attr["attribute_id"].(int)
+		if !vendorEncodedAttribs[attrID] {
+			continue
+		}
+		current := attr["normalized_value"].(int)
+		if current == 0 || current >= placeholderNormalized {
+			// Not reported by the drive, or not computed yet
+			continue
+		}
+
+		baseline, err := m.store.Baseline(serial, attrID)
+		if err != nil {
+			m.errLogger.Printf("Failed to query %s baseline for %s: %v", attr["attribute_name"], serial, err)
+			return
+		}
+		if baseline == nil {
+			continue
+		}
+
+		installed := baseline.NormalizedValue
+		if installed >= placeholderNormalized {
+			m.recaptureBaseline(serial, attrID, attr["attribute_name"].(string), installed, current)
+			continue
+		}
+
+		if installed > 0 && installed-int64(current) >= int64(m.errorRateDecline) {
+			m.createAlert(attr["device"].(string), attr["attribute_name"].(string), "ERROR_RATE_DECLINE",
+				fmt.Sprintf("%s normalized value fell from %d at install to %d (threshold %d); its raw value is vendor-encoded",
+					attr["attribute_name"], installed, current, attr["threshold"]))
+		}
+	}
+}
+
+// recaptureBaseline replaces a placeholder normalized baseline with the first
+// real value the drive reports, so later declines are measured from it
+func (m *MAIDSmartMonitor) recaptureBaseline(serial string, attrID int, name string, placeholder int64, current int) {
+	err := m.writes.do("baseline", func() error {
+		return m.store.RecaptureBaseline(serial, attrID, current)
+	})
+	if err != nil {
+		m.errLogger.Printf("Failed to recapture %s baseline for %s: %v", name, serial, err)
+		return
+	}
+	m.logger.Printf("Recaptured %s baseline for %s: placeholder %d replaced by %d", name, serial, placeholder, current)
+}
+
+// checkReallocationRate alerts when reallocated, reallocation-event or pending
+// sector counts grow faster than the configured limit. A stable nonzero count is
+// normal wear; a fast-moving one means the drive is failing now. It must run
+// before the current reading is stored.
+func (m *MAIDSmartMonitor) checkReallocationRate(attributes []map[string]interface{}, deviceID string) {
+	if m.reallocationWindow <= 0 {
+		return
+	}
+
+	since := time.Now().Add(-m.reallocationWindow)
+	for _, attr := range attributes {
+		attrID := attr["attribute_id"].(int)
+		if attrID != 5 && attrID != 196 && attrID != 197 {
+			continue
+		}
+
+		device := attr["device"].(string)
+		current := attr["raw_value"].(int64)
+
+		readings, err := m.store.Readings(deviceID, attrID, since)
+		if err != nil {
+			m.errLogger.Printf("Failed to query reallocation history for %s: %v", device, err)
+			continue
+		}
+		if len(readings) == 0 {
+			continue
+		}
+		oldest := readings[0].RawValue
+
+		if delta := current - oldest; delta > m.reallocationLimit {
+			m.createAlert(device, attr["attribute_name"].(string), "RAPID_REALLOCATION",
+				fmt.Sprintf("Increased by %d (from %d to %d) within %s, limit %d",
+					delta, oldest, current, m.reallocationWindow, m.reallocationLimit))
+		}
+	}
+}
+
+// checkUncorrectableTrend follows Reported_Uncorrectable_Errors (187), among the
+// strongest failure predictors in published drive statistics. Nonzero values
+// already raise CRITICAL_VALUE at INFO; any increase over the previous stored
+// reading raises UNCORRECTABLE_INCREASE at WARN, and increases in at least
+// uncorrectableIncreases separate readings within uncorrectableWindow raise
+// PREDICTED_FAILURE at CRITICAL. It must run before the current reading is stored.
+func (m *MAIDSmartMonitor) checkUncorrectableTrend(attributes []map[string]interface{}, deviceID string) {
+	if m.uncorrectableWindow <= 0 {
+		return
+	}
+
+	for _, attr := range attributes {
+		if attr["attribute_id"].(int) != 187 {
+			continue
+		}
+		device := attr["device"].(string)
+		name := attr["attribute_name"].(string)
+		current := attr["raw_value"].(int64)
+
+		stored, err := m.store.LastReading(deviceID, 187)
+		if err != nil {
+			m.errLogger.Printf("Failed to query uncorrectable error history for %s: %v", device, err)
+			return
+		}
+		if stored == nil || current <= stored.RawValue {
+			return
+		}
+		previous := stored.RawValue
+		m.createAlert(device, name, "UNCORRECTABLE_INCREASE",
+			fmt.Sprintf("Rose by %d (from %d to %d) since the last reading", current-previous, previous, current))
+
+		if m.uncorrectableIncreases <= 0 {
+			return
+		}
+		readings, err := m.store.Readings(deviceID, 187, time.Now().Add(-m.uncorrectableWindow))
+		if err != nil {
+			m.errLogger.Printf("Failed to query uncorrectable error history for %s: %v", device, err)
+			return
+		}
+
+		// The current reading is the latest increase
+		increases := 1
+		var first, last int64
+		var firstSeen time.Time
+		for n, reading := range readings {
+			if n == 0 {
+				first, firstSeen = reading.RawValue, reading.Timestamp
+			} else if reading.RawValue > last {
+				increases++
+			}
+			last = reading.RawValue
+		}
+
+		if increases >= m.uncorrectableIncreases {
+			days := time.Since(firstSeen).Hours() / 24
+			rate := ""
+			if days > 0 {
+				rate = fmt.Sprintf(", %.1f per day", float64(current-first)/days)
+			}
+			m.createAlert(device, name, "PREDICTED_FAILURE",
+				fmt.Sprintf("Rose in %d separate readings within %s (from %d to %d%s) - sustained growth predicts failure; back it up and replace it",
+					increases, m.uncorrectableWindow, first, current, rate))
+		}
+		return
+	}
+}
+
+// checkPendingConversion compares pending (197) and reallocated (5) sectors with
+// the previous stored reading. Pending sectors that turn into reallocations mean
+// the surface is failing; pending sectors that clear with no reallocation were
+// most likely transient. It must run before the current reading is stored.
+func (m *MAIDSmartMonitor) checkPendingConversion(attributes []map[string]interface{}, deviceID string) {
+	var pendingAttr map[string]interface{}
+	var pending, reallocated int64
+	hasRealloc := false
+	for _, attr := range attributes {
+		switch attr["attribute_id"].(int) {
+		case 197:
+			pendingAttr = attr
+			pending = attr["raw_value"].(int64)
+		case 5:
+			hasRealloc = true
+			reallocated = attr["raw_value"].(int64)
+		}
+	}
+	if pendingAttr == nil || !hasRealloc {
+		return
+	}
+	device := pendingAttr["device"].(string)
+
+	previous := make(map[int]int64)
+	for _, attrID := range []int{5, 197} {
+		last, err := m.store.LastReading(deviceID, attrID)
+		if err != nil {
+			m.errLogger.Printf("Failed to query pending sector history for %s: %v", device, err)
+			return
+		}
+		if last == nil {
+			return
+		}
+		previous[attrID] = last.RawValue
+	}
+	prevPending, prevRealloc := previous[197], previous[5]
+
+	cleared := prevPending - pending
+	grown := reallocated - prevRealloc
+	switch {
+	case cleared > 0 && grown > 0:
+		converted := cleared
+		if grown < converted {
+			converted = grown
+		}
+		m.createAlert(device, pendingAttr["attribute_name"].(string), "PENDING_REALLOCATED",
+			fmt.Sprintf("%d pending sectors converted to reallocations (pending %d -> %d, reallocated %d -> %d)",
+				converted, prevPending, pending, prevRealloc, reallocated))
+	case cleared > 0 && grown == 0 && pending == 0:
+		m.logger.Printf("Pending sectors on %s cleared (%d -> 0) without reallocation, likely transient",
+			device, prevPending)
+	}
+}
+
+// ataPortRegex matches a libata port directory in a drive's sysfs path
+var ataPortRegex = regexp.MustCompile(`^ata(\d+)$`)
+
+// portMultiplier returns the libata port (e.g. "ata3") through which a drive is
+// reached via a SATA port multiplier, and the controller the port belongs to.
+// libata lists a port multiplier's downstream links as linkN.M under
+// /sys/class/ata_link; port is "" if the drive is not behind one.
+func (m *MAIDSmartMonitor) portMultiplier(device string) (port, controller string) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(m.sysPath, "block", filepath.Base(device), "device"))
+	if err != nil {
+		return "", ""
+	}
+	for ; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		match := ataPortRegex.FindStringSubmatch(filepath.Base(dir))
+		if match == nil {
+			continue
+		}
+		links, _ := filepath.Glob(filepath.Join(m.sysPath, "class", "ata_link", "link"+match[1]+".*"))
+		if len(links) == 0 {
+			return "", ""
+		}
+		return match[0], filepath.Base(filepath.Dir(dir))
+	}
+	return "", ""
+}
+
+// crcIncrease returns how much UDMA_CRC_Error_Count (199) has risen since the
+// previous stored reading, or 0. It must run before the current reading is stored.
+func (m *MAIDSmartMonitor) crcIncrease(attributes []map[string]interface{}, deviceID string) int64 {
+	for _, attr := range attributes {
+		if attr["attribute_id"].(int) != 199 {
+			continue
+		}
+		previous, err := m.store.LastReading(deviceID, 199)
+		if err != nil {
+			m.errLogger.Printf("Failed to query CRC error history for %s: %v", attr["device"], err)
+			return 0
+		}
+		if current := attr["raw_value"].(int64); previous != nil && current > previous.RawValue {
+			return current - previous.RawValue
+		}
+		return 0
+	}
+	return 0
+}
+
+// checkPortMultipliers raises one PORT_MULTIPLIER_FAULT for each port
+// multiplier behind which more than one drive logged new CRC errors this cycle.
+// Interface CRC errors on several drives at once point at what they share (the
+// port multiplier, its power or the cable to the controller), not the drives.
+func (m *MAIDSmartMonitor) checkPortMultipliers(increases map[string]int64) {
+	type portDrives struct {
+		controller string
+		drives     []string
+	}
+	ports := make(map[string]*portDrives)
+	for device, increase := range increases {
+		port, controller := m.portMultiplier(device)
+		if port == "" {
+			continue
+		}
+		if ports[port] == nil {
+			ports[port] = &portDrives{controller: controller}
+		}
+		ports[port].drives = append(ports[port].drives, fmt.Sprintf("%s +%d", device, increase))
+	}
+
+	for port, p := range ports {
+		if len(p.drives) < 2 {
+			continue
+		}
+		sort.Strings(p.drives)
+		m.createAlert(port, "UDMA_CRC_Error_Count", "PORT_MULTIPLIER_FAULT",
+			fmt.Sprintf("CRC errors rose on %d drives behind the port multiplier on %s (controller %s) in the same cycle (%s) - check the port multiplier, its power supply and the cable to the controller",
+				len(p.drives), port, p.controller, strings.Join(p.drives, ", ")))
+	}
+}
+
+// createAlert queues a health alert for recording without waiting for the database
+func (m *MAIDSmartMonitor) createAlert(device, attribute, alertType, message string) {
+	m.cycleAlerts++
+	m.writes.async("alert", func() error {
+		m.recordAlert(device, attribute, alertType, message)
+		return nil
+	})
+}
+
+// recordAlert records a health alert in the store and notifies it if it is new
+// or has been escalated. It runs on the writer goroutine so the store's lookup
+// and write cannot interleave with another alert.
+func (m *MAIDSmartMonitor) recordAlert(device, attribute, alertType, message string) {
+	now := time.Now()
+
+	severity := initialSeverity[alertType]
+	if severity == "" {
+		severity = SeverityWarn
+	}
+
+	alert, notify, err := m.store.CreateAlert(HealthAlert{
+		Device:        device,
+		AttributeName: attribute,
+		AlertType:     alertType,
+		Severity:      severity,
+		Message:       m.renderAlertMessage(device, attribute, alertType, severity, message),
+		FirstSeen:     now,
+		Timestamp:     now,
+		Maintenance:   m.inMaintenance(device, now),
+		Suppressed:    m.isSuppressed(device, attribute, alertType),
+		Bay:           m.bayOf(device),
+	})
+	if err != nil {
+		m.errLogger.Printf("Failed to record %s alert for %s: %v", alertType, device, err)
+		return
+	}
+	if !notify {
+		return
+	}
+
+	if alert.EscalatedFrom != "" {
+		m.errLogger.Printf("Alert escalated %s -> %s after %s unresolved - %s: %s - %s", alert.EscalatedFrom, alert.Severity,
+			now.Sub(alert.FirstSeen).Round(time.Minute), alert.Location(), alert.AttributeName, alert.AlertType)
+	}
+	m.events.queue(streamEvent{Type: "alert", Time: now, Device: alert.Device, Alert: &alert})
+	m.notifyAlert(alert)
+}
+
+// resolveAlerts queues the resolution of the drive's open alerts that its
+// latest reading, whose checks began at seen, did not raise again. Queued
+// behind those checks' alerts, it sees every alert they refreshed.
+func (m *MAIDSmartMonitor) resolveAlerts(info *DeviceInfo, seen time.Time) {
+	deviceID := info.ID()
+	m.writes.async("resolve", func() error {
+		alerts, err := m.store.ResolveAlerts(deviceID, seen)
+		if err != nil {
+			return fmt.Errorf("failed to resolve alerts for %s: %v", info.Device, err)
+		}
+		now := time.Now()
+		for _, alert := range alerts {
+			alert.Bay = m.bayOf(alert.Device)
+			m.logger.Printf("Alert resolved [%s] - %s: %s - %s after %s", alert.Severity, alert.Location(),
+				alert.AttributeName, alert.AlertType, now.Sub(alert.FirstSeen).Round(time.Minute))
+			m.events.queue(streamEvent{Type: "resolved", Time: now, Device: alert.Device, Alert: &alert})
+			m.notifyResolved(alert)
+		}
+		return nil
+	})
+}
+
+// CreateAlert inserts a new alert, or refreshes the matching unresolved alert
+// and escalates it by how long it has been open
+func (s sqliteStore) CreateAlert(alert HealthAlert) (HealthAlert, bool, error) {
+	deviceID := s.m.deviceIDFor(alert.Device)
+	alert.DeviceID = deviceID
+
+	var id int64
+	var severity string
+	var firstSeen time.Time
+	err := s.m.db.QueryRow(`
+		SELECT id, severity, first_seen FROM health_alerts
+		WHERE device_id = ? AND attribute_name = ? AND alert_type = ? AND resolved = FALSE
+		ORDER BY id DESC LIMIT 1
+	`, deviceID, alert.AttributeName, alert.AlertType).Scan(&id, &severity, &firstSeen)
+
+	switch {
+	case err == sql.ErrNoRows:
+		_, err := s.m.db.Exec(`
+			INSERT INTO health_alerts 
+			(device, device_id, attribute_name, alert_type, severity, message, first_seen, timestamp, maintenance, suppressed)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, alert.Device, deviceID, alert.AttributeName, alert.AlertType, alert.Severity, alert.Message,
+			alert.FirstSeen, alert.Timestamp, alert.Maintenance, alert.Suppressed)
+		if err != nil {
+			return alert, false, fmt.Errorf("failed to create alert: %v", err)
+		}
+		return alert, true, nil
+
+	case err != nil:
+		return alert, false, fmt.Errorf("failed to look up existing alert: %v", err)
+	}
+
+	alert.FirstSeen = firstSeen
+	alert.Severity = s.m.escalatedSeverity(severity, alert.Timestamp.Sub(firstSeen))
+
+	_, err = s.m.db.Exec(`
+		UPDATE health_alerts SET device = ?, severity = ?, message = ?, timestamp = ?, suppressed = ?
+		WHERE id = ?
+	`, alert.Device, alert.Severity, alert.Message, alert.Timestamp, alert.Suppressed, id)
+	if err != nil {
+		return alert, false, fmt.Errorf("failed to update alert: %v", err)
+	}
+
+	if alert.Severity == severity {
+		return alert, false, nil
+	}
+	alert.EscalatedFrom = severity
+	return alert, true, nil
+}
+
+// ResolveAlerts marks the drive's open alerts last raised before seen resolved
+// at seen in one transaction and returns them
+func (s sqliteStore) ResolveAlerts(deviceID string, seen time.Time) ([]HealthAlert, error) {
+	tx, err := s.m.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT device, attribute_name, alert_type, COALESCE(severity, ''), message,
+		       first_seen, timestamp, maintenance, suppressed
+		FROM health_alerts
+		WHERE device_id = ? AND resolved = FALSE AND timestamp < ?
+		ORDER BY id
+	`, deviceID, seen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query open alerts: %v", err)
+	}
+	var alerts []HealthAlert
+	for rows.Next() {
+		alert := HealthAlert{DeviceID: deviceID}
+		var firstSeen sql.NullTime
+		if err := rows.Scan(&alert.Device, &alert.AttributeName, &alert.AlertType, &alert.Severity, &alert.Message,
+			&firstSeen, &alert.Timestamp, &alert.Maintenance, &alert.Suppressed); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan open alert: %v", err)
+		}
+		// Alerts recorded before first_seen was added have none
+		alert.FirstSeen = alert.Timestamp
+		if firstSeen.Valid {
+			alert.FirstSeen = firstSeen.Time
+		}
+		alerts = append(alerts, alert)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query open alerts: %v", err)
+	}
+	if len(alerts) == 0 {
+		return nil, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE health_alerts SET resolved = TRUE, resolved_at = ?
+		WHERE device_id = ? AND resolved = FALSE AND timestamp < ?
+	`, seen, deviceID, seen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve alerts: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit resolved alerts: %v", err)
+	}
+	return alerts, nil
+}
+
+// AlertContext is the data an alert message template is rendered with. Message
+// is the built-in message, so a template can extend it rather than restate it;
+// Severity is the initial severity, before any escalation.
+type AlertContext struct {
+	Device    string
+	DeviceID  string
+	Serial    string
+	Model     string
+	Attribute string
+	AlertType string
+	Severity  string
+	Message   string
+	Host      string
+	Bay       string
+}
+
+// defaultAlertTemplate names the template used for alert types without their own
+const defaultAlertTemplate = "default"
+
+// loadAlertTemplates reads a JSON object mapping alert types, or "default", to
+// text/template message templates, e.g.
+// {"HEALTH_FAILED": "{{.Model}} {{.Serial}} at {{.Device}}: {{.Message}}"}
+func loadAlertTemplates(path string) (map[string]*template.Template, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert templates: %v", err)
+	}
+
+	var texts map[string]string
+	if err := json.Unmarshal(content, &texts); err != nil {
+		return nil, fmt.Errorf("failed to parse alert templates: %v", err)
+	}
+
+	templates := make(map[string]*template.Template)
+	for alertType, text := range texts {
+		if _, ok := initialSeverity[alertType]; !ok && alertType != defaultAlertTemplate {
+			return nil, fmt.Errorf("unknown alert type %q", alertType)
+		}
+		tmpl, err := template.New(alertType).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %s: %v", alertType, err)
+		}
+		// Catch references to fields AlertContext does not have now, not at the first alert
+		if err := tmpl.Execute(ioutil.Discard, AlertContext{}); err != nil {
+			return nil, fmt.Errorf("invalid template for %s: %v", alertType, err)
+		}
+		templates[alertType] = tmpl
+	}
+	return templates, nil
+}
+
+// renderAlertMessage renders the template configured for alertType, returning
+// the built-in message when there is none or it fails
+func (m *MAIDSmartMonitor) renderAlertMessage(device, attribute, alertType, severity, message string) string {
+	tmpl := m.alertTemplates[alertType]
+	if tmpl == nil {
+		tmpl = m.alertTemplates[defaultAlertTemplate]
+	}
+	if tmpl == nil {
+		return message
+	}
+
+	ctx := AlertContext{Device: device, DeviceID: device, Attribute: attribute, AlertType: alertType,
+		Severity: severity, Message: message, Bay: m.bayOf(device)}
+	ctx.Host, _ = os.Hostname()
+	stored, err := m.store.DeviceAt(device)
+	if err != nil {
+		m.errLogger.Printf("Failed to look up %s for alert template: %v", device, err)
+	}
+	if stored != nil {
+		ctx.DeviceID, ctx.Serial, ctx.Model = stored.DeviceID, stored.SerialNumber, stored.Model
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		m.errLogger.Printf("Failed to render %s alert template: %v", alertType, err)
+		return message
+	}
+	return buf.String()
+}
+
+// bayOf returns the bay last recorded for the drive at a /dev path, or ""
+func (m *MAIDSmartMonitor) bayOf(device string) string {
+	if len(m.slotMap) == 0 {
+		return ""
+	}
+	stored, err := m.store.DeviceAt(device)
+	if err != nil {
+		m.errLogger.Printf("Failed to look up bay of %s: %v", device, err)
+	}
+	if stored == nil {
+		return ""
+	}
+	return stored.Bay
+}
+
+// deviceIDFor resolves the current /dev path of a drive to its stable identity,
+// falling back to the path for devices that have no status row
+func (m *MAIDSmartMonitor) deviceIDFor(device string) string {
+	stored, err := m.store.DeviceAt(device)
+	if err != nil || stored == nil {
+		return device
+	}
+	return stored.DeviceID
+}
+
+// inMaintenance reports whether a host-wide or device maintenance window is open
+// at the given time; device windows match either the device path or its serial
+func (m *MAIDSmartMonitor) inMaintenance(device string, at time.Time) bool {
+	open, err := m.store.InMaintenance(device, at)
+	if err != nil {
+		m.errLogger.Printf("Failed to check maintenance windows: %v", err)
+		return false
+	}
+	return open
+}
+
+// InMaintenance counts the maintenance windows open at the given time
+func (s sqliteStore) InMaintenance(device string, at time.Time) (bool, error) {
+	var count int
+	err := s.m.db.QueryRow(`
+		SELECT COUNT(*) FROM maintenance_windows
+		WHERE starts <= ? AND ends > ?
+		  AND (device IS NULL OR device = ?
+		       OR device IN (SELECT serial_number FROM device_status WHERE device = ? AND is_mounted))
+	`, at, at, device, device).Scan(&count)
+	return count > 0, err
+}
+
+// startMaintenance opens a maintenance window for a device path or serial, or for
+// the whole host when target is empty
+func (m *MAIDSmartMonitor) startMaintenance(target string, duration time.Duration, reason string) error {
+	now := time.Now()
+	var device interface{}
+	if target != "" {
+		device = target
+	}
+
+	return m.writes.do("maintenance", func() error {
+		_, err := m.db.Exec(`
+			INSERT INTO maintenance_windows (device, starts, ends, reason)
+			VALUES (?, ?, ?, ?)
+		`, device, now, now.Add(duration), reason)
+		if err != nil {
+			return fmt.Errorf("failed to start maintenance: %v", err)
+		}
+		return nil
+	})
+}
+
+// endMaintenance closes open maintenance windows for target (or the host-wide ones when target is empty)
+func (m *MAIDSmartMonitor) endMaintenance(target string) (int64, error) {
+	now := time.Now()
+	var ended int64
+
+	err := m.writes.do("maintenance", func() error {
+		query := `UPDATE maintenance_windows SET ends = ? WHERE ends > ? AND device IS NULL`
+		args := []interface{}{now, now}
+		if target != "" {
+			query = `UPDATE maintenance_windows SET ends = ? WHERE ends > ? AND device = ?`
+			args = append(args, target)
+		}
+
+		result, err := m.db.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to end maintenance: %v", err)
+		}
+		ended, _ = result.RowsAffected()
+		return nil
+	})
+	return ended, err
+}
+
+// getActiveMaintenance lists the maintenance windows open now
+func (m *MAIDSmartMonitor) getActiveMaintenance() ([]map[string]interface{}, error) {
+	now := time.Now()
+	rows, err := m.db.Query(`
+		SELECT device, ends, reason FROM maintenance_windows
+		WHERE starts <= ? AND ends > ?
+		ORDER BY ends
+	`, now, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query maintenance windows: %v", err)
+	}
+	defer rows.Close()
+
+	windows := []map[string]interface{}{}
+	for rows.Next() {
+		var device, reason sql.NullString
+		var ends time.Time
+		if err := rows.Scan(&device, &ends, &reason); err != nil {
+			return nil, fmt.Errorf("failed to scan maintenance row: %v", err)
+		}
+		target := device.String
+		if !device.Valid {
+			target = "all devices"
+		}
+		windows = append(windows, map[string]interface{}{
+			"target": target,
+			"ends":   ends,
+			"reason": reason.String,
+		})
+	}
+
+	return windows, nil
+}
+
+// parseSuppression splits a -suppress/-unsuppress value of the form
+// SERIAL:MATCH, where MATCH is an attribute name or an alert type
+func parseSuppression(value string) (serial, match string, err error) {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 || i == len(value)-1 {
+		return "", "", fmt.Errorf("%q must be SERIAL:ATTRIBUTE_NAME or SERIAL:ALERT_TYPE", value)
+	}
+	return value[:i], value[i+1:], nil
+}
+
+// isSuppressed reports whether alerts of alertType on attribute are suppressed
+// for the drive at device
+func (m *MAIDSmartMonitor) isSuppressed(device, attribute, alertType string) bool {
+	suppressed, err := m.store.IsSuppressed(m.deviceIDFor(device), attribute, alertType)
+	if err != nil {
+		m.errLogger.Printf("Failed to check alert suppressions: %v", err)
+		return false
+	}
+	return suppressed
+}
+
+// IsSuppressed counts the drive's suppressions matching the attribute or alert type
+func (s sqliteStore) IsSuppressed(deviceID, attribute, alertType string) (bool, error) {
+	var count int
+	err := s.m.db.QueryRow(`
+		SELECT COUNT(*) FROM alert_suppressions
+		WHERE serial_number = ? AND match IN (?, ?)
+	`, deviceID, attribute, alertType).Scan(&count)
+	return count > 0, err
+}
+
+// suppressAlerts persistently accepts a known condition of one drive: its
+// alerts on the attribute, or of the alert type, named by match are still
+// recorded but marked suppressed and not notified. Open alerts it covers are
+// marked too; it returns how many.
+func (m *MAIDSmartMonitor) suppressAlerts(serial, match, reason string) (int64, error) {
+	var marked int64
+	err := m.writes.do("suppress", func() error {
+		tx, err := m.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`
+			INSERT OR REPLACE INTO alert_suppressions (serial_number, match, reason, created)
+			VALUES (?, ?, ?, ?)
+		`, serial, match, reason, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to add suppression: %v", err)
+		}
+		result, err := tx.Exec(`
+			UPDATE health_alerts SET suppressed = TRUE
+			WHERE device_id = ? AND (attribute_name = ? OR alert_type = ?) AND resolved = FALSE
+		`, serial, match, match)
+		if err != nil {
+			return fmt.Errorf("failed to mark open alerts: %v", err)
+		}
+		marked, _ = result.RowsAffected()
+		return tx.Commit()
+	})
+	return marked, err
+}
+
+// unsuppressAlerts removes a suppression, so the open alerts it covered count
+// again and later ones are notified; it returns how many open alerts that affects
+func (m *MAIDSmartMonitor) unsuppressAlerts(serial, match string) (int64, error) {
+	var unmarked int64
+	err := m.writes.do("suppress", func() error {
+		tx, err := m.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(`DELETE FROM alert_suppressions WHERE serial_number = ? AND match = ?`, serial, match)
+		if err != nil {
+			return fmt.Errorf("failed to remove suppression: %v", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("no suppression of %s for %s", match, serial)
+		}
+
+		// An alert may still be covered by another suppression of the drive
+		result, err = tx.Exec(`
+			UPDATE health_alerts SET suppressed = FALSE
+			WHERE device_id = ? AND (attribute_name = ? OR alert_type = ?) AND resolved = FALSE
+			  AND NOT EXISTS (SELECT 1 FROM alert_suppressions s
+			                  WHERE s.serial_number = health_alerts.device_id
+			                    AND s.match IN (health_alerts.attribute_name, health_alerts.alert_type))
+		`, serial, match, match)
+		if err != nil {
+			return fmt.Errorf("failed to unmark open alerts: %v", err)
+		}
+		unmarked, _ = result.RowsAffected()
+		return tx.Commit()
+	})
+	return unmarked, err
+}
+
+// getSuppressedAlerts lists the open alerts that are suppressed, with the
+// reason given for accepting them
+func (m *MAIDSmartMonitor) getSuppressedAlerts() ([]map[string]interface{}, error) {
+	rows, err := m.db.Query(`
+		SELECT COALESCE(st.device, a.device), a.device_id, a.attribute_name, a.alert_type, a.severity,
+		       COALESCE((SELECT reason FROM alert_suppressions s
+		                 WHERE s.serial_number = a.device_id AND s.match IN (a.attribute_name, a.alert_type)
+		                 ORDER BY s.created LIMIT 1), '')
+		FROM health_alerts a
+		LEFT JOIN device_status st ON st.device_id = a.device_id
+		WHERE a.resolved = FALSE AND a.suppressed
+		ORDER BY a.device_id, a.attribute_name, a.alert_type
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query suppressed alerts: %v", err)
+	}
+	defer rows.Close()
+
+	suppressed := []map[string]interface{}{}
+	for rows.Next() {
+		var device, serial, attribute, alertType, reason string
+		var severity sql.NullString
+		if err := rows.Scan(&device, &serial, &attribute, &alertType, &severity, &reason); err != nil {
+			return nil, fmt.Errorf("failed to scan suppressed alert: %v", err)
+		}
+		suppressed = append(suppressed, map[string]interface{}{
+			"device":         device,
+			"serial_number":  serial,
+			"attribute_name": attribute,
+			"alert_type":     alertType,
+			"severity":       severity.String,
+			"reason":         reason,
+		})
+	}
+	return suppressed, rows.Err()
+}
+
+// escalatedSeverity returns the severity an unresolved alert should have after being open for age
+func (m *MAIDSmartMonitor) escalatedSeverity(current string, age time.Duration) string {
+	target := current
+	if m.escalateWarnAfter > 0 && age >= m.escalateWarnAfter && severityRank[target] < severityRank[SeverityWarn] {
+		target = SeverityWarn
+	}
+	if m.escalateCriticalAfter > 0 && age >= m.escalateCriticalAfter {
+		target = SeverityCritical
+	}
+	return target
+}
+
+// notifyAlert reports a new or escalated alert
+func (m *MAIDSmartMonitor) notifyAlert(alert HealthAlert) {
+	if alert.Maintenance {
+		m.errLogger.Printf("HEALTH ALERT [%s] (maintenance, not notified) - %s: %s - %s",
+			alert.Severity, alert.Location(), alert.AttributeName, alert.Message)
+		return
+	}
+	if alert.Suppressed {
+		m.logger.Printf("HEALTH ALERT [%s] (suppressed, not notified) - %s: %s - %s",
+			alert.Severity, alert.Location(), alert.AttributeName, alert.Message)
+		return
+	}
+
+	// Notifiers may block on the network, so they run off the writer goroutine;
+	// Close waits for them
+	for _, n := range m.notifiers {
+		if routed, ok := n.(severityNotifier); ok && !routed.accepts(alert.Severity) {
+			continue
+		}
+		m.notifyWG.Add(1)
+		go func(n Notifier) {
+			defer m.notifyWG.Done()
+			if err := n.Notify(alert); err != nil {
+				m.errLogger.Printf("Failed to notify %s: %v", n.Name(), err)
+			}
+		}(n)
+	}
+}
+
+// notifyResolved tells the notifiers that close what they opened for an alert,
+// such as a PagerDuty incident, that it has resolved. Those whose severity
+// routing never passed them the alert are skipped.
+func (m *MAIDSmartMonitor) notifyResolved(alert HealthAlert) {
+	for _, n := range m.notifiers {
+		if routed, ok := n.(severityNotifier); ok {
+			if !routed.accepts(alert.Severity) {
+				continue
+			}
+			n = routed.Notifier
+		}
+		r, ok := n.(alertResolver)
+		if !ok {
+			continue
+		}
+		m.notifyWG.Add(1)
+		go func(name string, r alertResolver) {
+			defer m.notifyWG.Done()
+			if err := r.Resolve(alert); err != nil {
+				m.errLogger.Printf("Failed to notify %s of resolution: %v", name, err)
+			}
+		}(n.Name(), r)
+	}
+}
+
+// testNotifiers sends a synthetic alert through every configured notifier and
+// returns each notifier's result, keyed by name
+func (m *MAIDSmartMonitor) testNotifiers() map[string]error {
+	host, _ := os.Hostname()
+	now := time.Now()
+	alert := HealthAlert{
+		Device:        "/dev/test",
+		AttributeName: "Test_Notification",
+		AlertType:     "TEST_NOTIFICATION",
+		Severity:      SeverityInfo,
+		Message:       fmt.Sprintf("Test notification from maid-smart-monitor on %s", host),
+		FirstSeen:     now,
+		Timestamp:     now,
+	}
+
+	results := make(map[string]error)
+	for _, n := range m.notifiers {
+		results[n.Name()] = n.Notify(alert)
+	}
+	return results
+}
+
+// Notifier delivers health alerts to operators
+type Notifier interface {
+	Name() string
+	Notify(alert HealthAlert) error
+}
+
+// alertResolver is implemented by notifiers that can close what they opened
+// for an alert once it resolves
+type alertResolver interface {
+	Resolve(alert HealthAlert) error
+}
+
+// logNotifier writes alerts to the error log; it is always configured
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (n logNotifier) Name() string { return "log" }
+
+func (n logNotifier) Notify(alert HealthAlert) error {
+	n.logger.Printf("HEALTH ALERT [%s] - %s: %s - %s", alert.Severity, alert.Location(), alert.AttributeName, alert.Message)
+	return nil
+}
+
+// severityNotifier passes its notifier only the alerts at or above minSeverity,
+// so that, say, a pager sees CRITICAL alerts while chat sees everything.
+// -test-notify reaches it whatever the severity.
+type severityNotifier struct {
+	Notifier
+	minSeverity string
+}
+
+// accepts reports whether an alert of the given severity is routed to the notifier
+func (n severityNotifier) accepts(severity string) bool {
+	return severityRank[severity] >= severityRank[n.minSeverity]
+}
+
+// repeatedFlag collects every value of a flag given more than once
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseWebhookURLs parses webhook URLs, each optionally prefixed with the
+// minimum severity it receives, e.g. "CRITICAL=https://pager.example.com/hook".
+// They are not split on commas, which URLs may contain.
+func parseWebhookURLs(urls []string) ([]Notifier, error) {
+	var notifiers []Notifier
+	for _, entry := range urls {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		minSeverity := ""
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			if _, ok := severityRank[strings.ToUpper(parts[0])]; ok {
+				minSeverity, entry = strings.ToUpper(parts[0]), parts[1]
+			}
+		}
+		if !strings.HasPrefix(entry, "http://") && !strings.HasPrefix(entry, "https://") {
+			return nil, fmt.Errorf("invalid webhook URL %q", entry)
+		}
+
+		var n Notifier = newWebhookNotifier(entry)
+		if minSeverity != "" {
+			n = severityNotifier{Notifier: n, minSeverity: minSeverity}
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// webhookNotifier POSTs each alert as a JSON object to a URL
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name includes the URL's host so several webhooks can be told apart, without
+// echoing any token in the path
+func (n *webhookNotifier) Name() string {
+	if u, err := url.Parse(n.url); err == nil && u.Host != "" {
+		return "webhook " + u.Host
+	}
+	return "webhook"
+}
+
+func (n *webhookNotifier) Notify(alert HealthAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post alert: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// hookNotifier runs an executable for each alert, for notifications and
+// remediation the monitor has no integration for. The alert's device,
+// attribute, type, severity and message are passed as arguments and as
+// MAID_ALERT_* environment variables, and the whole alert as JSON on stdin.
+type hookNotifier struct {
+	path    string
+	timeout time.Duration
+	logger  *log.Logger
+}
+
+func (n hookNotifier) Name() string { return "hook " + filepath.Base(n.path) }
+
+func (n hookNotifier) Notify(alert HealthAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	cmd := exec.Command(n.path, alert.Device, alert.AttributeName, alert.AlertType, alert.Severity, alert.Message)
+	cmd.Env = append(os.Environ(),
+		"MAID_ALERT_DEVICE="+alert.Device,
+		"MAID_ALERT_ATTRIBUTE="+alert.AttributeName,
+		"MAID_ALERT_TYPE="+alert.AlertType,
+		"MAID_ALERT_SEVERITY="+alert.Severity,
+		"MAID_ALERT_MESSAGE="+alert.Message,
+		"MAID_ALERT_BAY="+alert.Bay,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := startProcessGroup(cmd); err != nil {
+		return fmt.Errorf("failed to run %s: %v", n.path, err)
+	}
+	defer releaseProcessGroup(cmd)
+
+	// A hook's children would keep its output open after it is killed, so the
+	// whole process group goes
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(n.timeout):
+		killProcessGroup(cmd)
+		waitKilled(done)
+		return fmt.Errorf("%s timed out after %s", n.path, n.timeout)
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		out := strings.TrimSpace(output.String())
+		if len(out) > 200 {
+			out = out[:200] + "..."
+		}
+		return fmt.Errorf("%s exited with status %d: %s", n.path, exitErr.ExitCode(), out)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %v", n.path, err)
+	}
+	n.logger.Printf("Alert hook %s exited with status 0 for %s on %s", n.path, alert.AlertType, alert.Device)
+	return nil
+}
+
+// killWait is how long a killed command's Wait is given to return
+const killWait = 5 * time.Second
+
+// waitKilled waits for a killed command's Wait, sent on done, for up to
+// killWait. Wait also waits for every process holding the command's output
+// open, and one that escaped the kill would otherwise hang the caller; it is
+// left to finish in the background.
+func waitKilled(done <-chan error) {
+	select {
+	case <-done:
+	case <-time.After(killWait):
+	}
+}
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutySeverity maps alert severities onto PagerDuty's
+var pagerDutySeverity = map[string]string{
+	SeverityInfo:     "info",
+	SeverityWarn:     "warning",
+	SeverityCritical: "critical",
+}
+
+// pagerDutyNotifier triggers a PagerDuty incident per alert through the Events
+// API v2, and resolves it when the alert resolves. The dedup key is the drive's
+// stable ID, the attribute and the alert type, so repeated and escalated alerts
+// for one problem update a single incident, even if the drive moves to another
+// /dev path, instead of opening new ones.
+type pagerDutyNotifier struct {
+	routingKey string
+	url        string
+	source     string
+	client     *http.Client
+}
+
+func newPagerDutyNotifier(routingKey string) *pagerDutyNotifier {
+	host, _ := os.Hostname()
+	return &pagerDutyNotifier{
+		routingKey: routingKey,
+		url:        pagerDutyEventsURL,
+		source:     host,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *pagerDutyNotifier) Name() string { return "pagerduty" }
+
+// pagerDutyDedupKey identifies the incident for an alert of a drive; alerts
+// not tied to a known drive fall back to the device path
+func pagerDutyDedupKey(alert HealthAlert) string {
+	deviceID := alert.DeviceID
+	if deviceID == "" {
+		deviceID = alert.Device
+	}
+	return fmt.Sprintf("maid-smart-monitor:%s:%s:%s", deviceID, alert.AttributeName, alert.AlertType)
+}
+
+func (n *pagerDutyNotifier) Notify(alert HealthAlert) error {
+	severity := pagerDutySeverity[alert.Severity]
+	if severity == "" {
+		severity = "error"
+	}
+
+	event := map[string]interface{}{
+		"routing_key":  n.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    pagerDutyDedupKey(alert),
+		"payload": map[string]interface{}{
+			"summary":   fmt.Sprintf("%s %s on %s: %s", alert.AlertType, alert.AttributeName, alert.Location(), alert.Message),
+			"source":    n.source,
+			"severity":  severity,
+			"timestamp": alert.Timestamp.Format(time.RFC3339),
+			"component": alert.Device,
+			"class":     alert.AlertType,
+			"custom_details": map[string]interface{}{
+				"attribute_name": alert.AttributeName,
+				"first_seen":     alert.FirstSeen,
+				"message":        alert.Message,
+			},
+		},
+	}
+	return n.send(event)
+}
+
+// Resolve closes the alert's incident
+func (n *pagerDutyNotifier) Resolve(alert HealthAlert) error {
+	return n.send(map[string]interface{}{
+		"routing_key":  n.routingKey,
+		"event_action": "resolve",
+		"dedup_key":    pagerDutyDedupKey(alert),
+	})
+}
+
+// send posts an event to the Events API
+func (n *pagerDutyNotifier) send(event map[string]interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send event: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PagerDuty returned %s", resp.Status)
+	}
+	return nil
+}
+
+// pruneData deletes SMART readings older than before, with the raw archive
+// entries of the same age, and returns how many readings were removed
+func (m *MAIDSmartMonitor) pruneData(before time.Time) (int64, error) {
+	var pruned int64
+	err := m.writes.do("prune", func() error {
+		tx, err := m.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		if err := chainPrune(tx, `timestamp < ?`, before); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`DELETE FROM smart_data WHERE timestamp < ?`, before)
+		if err != nil {
+			return fmt.Errorf("failed to prune data: %v", err)
+		}
+		pruned, _ = result.RowsAffected()
+
+		archives, err := archiveFiles(tx, `timestamp < ?`, before)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM raw_archive WHERE timestamp < ?`, before); err != nil {
+			return fmt.Errorf("failed to prune raw archive index: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		m.removeArchiveFiles(archives)
+		return nil
+	})
+	return pruned, err
+}
+
+// archiveFiles returns the archive files the raw_archive rows matching
+// condition point into. It runs in the deleting transaction, before the delete.
+func archiveFiles(tx *sql.Tx, condition string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(`SELECT DISTINCT archive_path FROM raw_archive WHERE `+condition, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query raw archive index: %v", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("failed to scan archive path: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// removeArchiveFiles deletes those of paths that no raw_archive row points into
+// any more, as a daily file still holding later readings does, and each drive's
+// archive directory once it is empty. It runs on the writer goroutine after the
+// rows are deleted.
+func (m *MAIDSmartMonitor) removeArchiveFiles(paths []string) {
+	removed := 0
+	for _, path := range paths {
+		var remaining int
+		if err := m.db.QueryRow(`SELECT COUNT(*) FROM raw_archive WHERE archive_path = ?`, path).Scan(&remaining); err != nil {
+			m.errLogger.Printf("Failed to check raw archive %s: %v", path, err)
+			continue
+		}
+		if remaining > 0 {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			m.errLogger.Printf("Failed to remove raw archive %s: %v", path, err)
+			continue
+		}
+		removed++
+		// Only succeeds once the drive has no archive files left
+		os.Remove(filepath.Dir(path))
+	}
+	if removed > 0 {
+		m.logger.Printf("Removed %d raw archive files", removed)
+	}
+}
+
+// pruneAlerts deletes resolved alerts last seen before the given time and
+// returns how many were removed; unresolved alerts are never pruned
+func (m *MAIDSmartMonitor) pruneAlerts(before time.Time) (int64, error) {
+	var pruned int64
+	err := m.writes.do("prune alerts", func() error {
+		result, err := m.db.Exec(`DELETE FROM health_alerts WHERE resolved AND timestamp < ?`, before)
+		if err != nil {
+			return fmt.Errorf("failed to prune alerts: %v", err)
+		}
+		pruned, _ = result.RowsAffected()
+		return nil
+	})
+	return pruned, err
+}
+
+// applyRetention prunes readings and resolved alerts older than their retention
+// periods, where set
+func (m *MAIDSmartMonitor) applyRetention() {
+	if m.retention > 0 {
+		pruned, err := m.pruneData(time.Now().Add(-m.retention))
+		if err != nil {
+			m.errLogger.Printf("Retention pruning failed: %v", err)
+		} else if pruned > 0 {
+			m.logger.Printf("Pruned %d readings older than %s", pruned, m.retention)
+		}
+	}
+
+	if m.alertRetention > 0 {
+		pruned, err := m.pruneAlerts(time.Now().Add(-m.alertRetention))
+		if err != nil {
+			m.errLogger.Printf("Alert retention pruning failed: %v", err)
+		} else if pruned > 0 {
+			m.logger.Printf("Pruned %d resolved alerts older than %s", pruned, m.alertRetention)
+		}
+	}
+}
+
+// reclaimSpace returns the pages freed by pruning to the filesystem; deleting
+// rows alone only leaves them for SQLite to reuse. A database in incremental
+// auto-vacuum mode releases its free pages in place. Older databases are
+// rebuilt with VACUUM, which needs temporary space up to the size of the
+// database and switches them to incremental mode for next time.
+func (m *MAIDSmartMonitor) reclaimSpace() error {
+	return m.writes.do("vacuum", func() error {
+		var mode int
+		if err := m.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+			return fmt.Errorf("failed to read auto-vacuum mode: %v", err)
+		}
+		if mode != 2 {
+			if _, err := m.db.Exec("VACUUM"); err != nil {
+				return fmt.Errorf("failed to vacuum database: %v", err)
+			}
+			return nil
+		}
+
+		// incremental_vacuum frees one page per step, so its rows are read to the end
+		rows, err := m.db.Query("PRAGMA incremental_vacuum")
+		if err != nil {
+			return fmt.Errorf("failed to release free pages: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to release free pages: %v", err)
+		}
+		return nil
+	})
+}
+
+// checkDiskSpace protects the host from the monitor filling the database
+// filesystem. Below the minimum it prunes the oldest tenth of the readings and
+// hands the space back to the filesystem; if space is still short, storing new
+// readings stops until space is freed. It runs at the start of each cycle.
+func (m *MAIDSmartMonitor) checkDiskSpace() {
+	if m.minFreeBytes == 0 || m.dbPath == ":memory:" {
+		return
+	}
+
+	dir := filepath.Dir(m.dbPath)
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		m.errLogger.Printf("Failed to check free space on %s: %v", dir, err)
+		return
+	}
+
+	if free < m.minFreeBytes {
+		m.warnLogger.Printf("LOW DISK SPACE: %d MB free on %s (minimum %d MB), pruning oldest readings",
+			free>>20, dir, m.minFreeBytes>>20)
+
+		var cutoff time.Time
+		err := m.db.QueryRow(`
+			SELECT timestamp FROM smart_data ORDER BY timestamp
+			LIMIT 1 OFFSET (SELECT COUNT(*) / 10 FROM smart_data)
+		`).Scan(&cutoff)
+		if err == nil {
+			if pruned, err := m.pruneData(cutoff); err != nil {
+				m.errLogger.Printf("Emergency pruning failed: %v", err)
+			} else {
+				m.logger.Printf("Emergency pruned %d readings older than %s", pruned, cutoff.Format(time.RFC3339))
+				if err := m.reclaimSpace(); err != nil {
+					m.errLogger.Printf("Failed to reclaim space after pruning: %v", err)
+				}
+			}
+		} else if err != sql.ErrNoRows {
+			m.errLogger.Printf("Failed to find pruning cutoff: %v", err)
+		}
+
+		if free, err = freeDiskSpace(dir); err != nil {
+			m.errLogger.Printf("Failed to check free space on %s: %v", dir, err)
+			return
+		}
+	}
+
+	low := free < m.minFreeBytes
+	m.stateMu.Lock()
+	changed := low != m.lowDiskSpace
+	m.lowDiskSpace = low
+	m.stateMu.Unlock()
+
+	if changed && low {
+		m.errLogger.Printf("LOW DISK SPACE: still only %d MB free on %s - NOT STORING NEW READINGS until space is freed",
+			free>>20, dir)
+	} else if changed {
+		m.logger.Printf("Free space on %s recovered (%d MB), storing readings again", dir, free>>20)
+	}
+}
+
+// runMonitoringCycle runs a single monitoring cycle
+func (m *MAIDSmartMonitor) runMonitoringCycle() error {
+	m.cycleMu.Lock()
+	defer m.cycleMu.Unlock()
+
+	start := time.Now()
+	m.stateMu.Lock()
+	previous := m.lastCycleStart
+	m.lastCycleStart = start
+	m.cycleRunning = true
+	m.stateMu.Unlock()
+
+	summary := &cycleSummary{}
+	m.cycleAlerts = 0
+	m.standbyMu.Lock()
+	m.inStandby = make(map[string]bool)
+	m.standbyMu.Unlock()
+
+	defer func() {
+		end := time.Now()
+		summary.AlertsRaised = m.cycleAlerts
+		summary.Buffered = len(m.buffered)
+		summary.Duration = end.Sub(start).Seconds()
+
+		m.stateMu.Lock()
+		m.lastCycleEnd = end
+		m.cycleRunning = false
+		m.lastSummary = summary
+		m.stateMu.Unlock()
+
+		m.addCounters(summary)
+
+		// Queued behind the cycle's alerts, so they are recorded and sent first
+		m.writes.async("events", func() error {
+			m.publishEvents(summary, end)
+			return nil
+		})
+	}()
+
+	m.debugLogger.Println("Starting SMART monitoring cycle...")
+
+	// Sub uses the monotonic clock, which a step of the wall clock does not move
+	if !previous.IsZero() {
+		if back := start.Sub(previous) - start.Round(0).Sub(previous.Round(0)); back > time.Second {
+			m.warnLogger.Printf("System clock went back %s since the last cycle; readings older than stored ones are not stored",
+				back.Round(time.Second))
+		}
+	}
+
+	// With adaptive polling the daemon wakes every -adaptive-min to poll the
+	// drives that are due, but work over the whole fleet stays on -interval
+	fleet := m.fleetDue(start)
+	if fleet {
+		m.lastFleetCycle = start
+		m.applyRetention()
+		m.checkDiskSpace()
+	}
+
+	var lastID int64
+	if m.hashChain {
+		if err := m.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM smart_data`).Scan(&lastID); err != nil {
+			return fmt.Errorf("failed to read last reading id: %v", err)
+		}
+	}
+
+	m.flushBuffered()
+
+	var devices []string
+	mounted := make(map[string]bool)
+	if m.collectSmartctl {
+		drives, err := m.getDrives()
+		if err != nil {
+			return fmt.Errorf("failed to get drives: %v", err)
+		}
+		for _, device := range drives {
+			mounted[device] = true
+		}
+		devices = m.withExtraDevices(drives)
+		m.detectUSBTypes(devices)
+		devices = m.orderDevices(devices)
+	}
+	summary.DevicesFound = len(devices)
+	serials := make(map[string]string)
+	crcIncreases := make(map[string]int64)
+
+	// Which devices to poll is settled first, so their reads can run ahead of
+	// the processing below
+	var polled []string
+	for _, device := range devices {
+		if m.backingOff(device, fleet) {
+			summary.DevicesBackedOff++
+			continue
+		}
+		if !m.pollDue(device, start) {
+			summary.DevicesDeferred++
+			continue
+		}
+		polled = append(polled, device)
+	}
+	reads := m.readDevices(polled)
+
+	for i, device := range polled {
+		read := <-reads[i]
+		m.debugLogger.Printf("Processing device: %s", device)
+		checked := time.Now()
+
+		info, err := read.info, read.infoErr
+		if err != nil {
+			m.errLogger.Printf("Failed to get device info for %s: %v", device, err)
+			// Backing off would only delay noticing that access was granted
+			if !isPermissionError(err) {
+				m.collectionFailed(device)
+			}
+			summary.DevicesFailed++
+			m.schedulePoll(device, nil, start)
+			continue
+		}
+		info.IsMounted = mounted[device]
+
+		m.checkLockTransition(info)
+		m.checkSmartTransition(info)
+		m.checkDuplicateSerial(info, serials)
+		m.checkPathReassignment(info)
+		m.checkBay(info)
+
+		// Update device status
+		if err := m.updateDeviceStatus(info); err != nil {
+			m.errLogger.Printf("Failed to update device status for %s: %v", device, err)
+		}
+
+		if info.Locked {
+			m.logger.Printf("Device %s is security-locked (%s) - skipping attribute collection", device, info.SecurityState)
+			m.schedulePoll(device, nil, start)
+			continue
+		}
+
+		if !m.collectAttributes {
+			if read.standby {
+				summary.DevicesStandby++
+				m.debugLogger.Printf("Device %s is in standby mode", device)
+				m.checkProlongedStandby(info)
+				m.schedulePoll(device, nil, start)
+				continue
+			}
+			m.markActive(info)
+
+			attributes, err := read.hwmon, read.hwmonErr
+			if err != nil {
+				m.errLogger.Printf("No hwmon temperature for %s: %v", device, err)
+				m.schedulePoll(device, nil, start)
+				continue
+			}
+			summary.DevicesCollected++
+			m.schedulePoll(device, attributes, start)
+			if stored, err := m.storeSmartData(attributes, info); err != nil {
+				m.errLogger.Printf("Failed to store temperature for %s: %v", device, err)
+			} else {
+				summary.AttributesStored += stored
+				m.events.queueChanges(info, attributes, start)
+				m.checkHealthThresholds(attributes, info.Model)
+				m.resolveAlerts(info, checked)
+			}
+			continue
+		}
+
+		if !info.SmartEnabled {
+			m.logger.Printf("SMART not supported/enabled on %s", device)
+			m.schedulePoll(device, nil, start)
+			continue
+		}
+
+		// SMART data is only read from drives that were already spinning
+		smartData, err := read.smartData, read.smartErr
+		if err != nil {
+			m.errLogger.Printf("Error collecting SMART data for %s: %v", device, err)
+			m.collectionFailed(device)
+			summary.DevicesFailed++
+			m.schedulePoll(device, nil, start)
+			continue
+		}
+
+		if smartData != nil {
+			m.collectionSucceeded(device)
+			m.markActive(info)
+			summary.DevicesCollected++
+
+			if m.collectHealth {
+				if passed, err := read.passed, read.healthErr; err != nil {
+					m.errLogger.Printf("Error collecting health status for %s: %v", device, err)
+				} else if err := m.storeHealthStatus(info, passed); err != nil {
+					m.errLogger.Printf("Failed to store health status for %s: %v", device, err)
+				}
+			}
+			if err := m.storeSelfTestStatus(info, smartData); err != nil {
+				m.errLogger.Printf("Failed to store self-test status for %s: %v", device, err)
+			}
+			m.checkNVMeCriticalWarning(device, smartData)
+			if err := m.checkNVMeThermal(info, smartData); err != nil {
+				m.errLogger.Printf("Failed to check thermal counters for %s: %v", device, err)
+			}
+			if err := m.storeDataUnits(info, smartData); err != nil {
+				m.errLogger.Printf("Failed to store data units for %s: %v", device, err)
+			}
+			if m.rawArchiveDir != "" && smartData.raw != nil {
+				if err := m.archiveRawJSON(info, smartData.raw, time.Now()); err != nil {
+					m.errLogger.Printf("Failed to archive SMART JSON for %s: %v", device, err)
+				}
+			}
+
+			attributes := m.mediaAttributes(m.parseSmartAttributes(smartData, device), info)
+			m.schedulePoll(device, attributes, start)
+			if len(attributes) > 0 {
+				m.applyVendorThresholds(attributes, device, info.SerialNumber)
+				m.processAttributes(info, attributes, start, summary, crcIncreases)
+			} else {
+				m.debugLogger.Printf("No target SMART attributes found for %s", device)
+			}
+
+			if read.stats != nil || read.statsErr != nil {
+				if stats, err := read.stats, read.statsErr; err != nil {
+					m.errLogger.Printf("Error collecting device statistics for %s: %v", device, err)
+				} else if n, err := m.storeDeviceStatistics(stats, info); err != nil {
+					m.errLogger.Printf("Failed to store device statistics for %s: %v", device, err)
+				} else if n > 0 {
+					m.debugLogger.Printf("Stored %d device statistics for %s", n, device)
+				}
+			}
+			m.resolveAlerts(info, checked)
+		} else {
+			summary.DevicesStandby++
+			m.debugLogger.Printf("No SMART data collected for %s (likely in standby)", device)
+			m.checkProlongedStandby(info)
+			m.schedulePoll(device, nil, start)
+		}
+	}
+
+	if fleet {
+		for _, c := range m.collectors {
+			m.runCollector(c, serials, start, summary, crcIncreases)
+		}
+	}
+
+	m.checkPortMultipliers(crcIncreases)
+
+	if m.hashChain {
+		if err := m.chainCycle(lastID, start, time.Now()); err != nil {
+			m.errLogger.Printf("Failed to record cycle hash: %v", err)
+		}
+	}
+
+	m.logger.Printf("Monitoring cycle completed: %d devices found, %d in standby, %d backed off, %d deferred, "+
+		"%d collected, %d failed, %d attributes stored, %d alerts raised, %d readings buffered, took %s",
+		summary.DevicesFound, summary.DevicesStandby, summary.DevicesBackedOff, summary.DevicesDeferred,
+		summary.DevicesCollected, summary.DevicesFailed, summary.AttributesStored, m.cycleAlerts, len(m.buffered), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// deviceRead is what the smartctl runs for one device returned, read ahead of
+// the processing that stores and checks it. Only the reads the device's state
+// called for are made: none past the info for a locked drive, and none past the
+// standby probe for a drive in standby.
+type deviceRead struct {
+	info      *DeviceInfo
+	infoErr   error
+	standby   bool
+	hwmon     []map[string]interface{} // with -attributes off
+	hwmonErr  error
+	smartData *SmartData
+	smartErr  error
+	passed    bool // with -health
+	healthErr error
+	stats     *DeviceStatistics // with -devstat, for ATA drives
+	statsErr  error
+}
+
+// readDevices starts reading devices in order, -parallel at a time with
+// -stagger between the starts, and returns a channel per device that delivers
+// its read
+func (m *MAIDSmartMonitor) readDevices(devices []string) []chan *deviceRead {
+	reads := make([]chan *deviceRead, len(devices))
+	for i := range reads {
+		reads[i] = make(chan *deviceRead, 1)
+	}
+	workers := m.parallel
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+
+	go func() {
+		for i, device := range devices {
+			if i > 0 && m.deviceStagger > 0 {
+				time.Sleep(jitterDelay(m.deviceStagger))
+			}
+			slots <- struct{}{}
+			go func(i int, device string) {
+				defer func() { <-slots }()
+				reads[i] <- m.readDevice(device)
+			}(i, device)
+		}
+	}()
+	return reads
+}
+
+// readDevice runs the smartctl reads for one device without spinning it up.
+// Once the drive is known to be spinning it holds one of the
+// -max-active-spindles slots until its last read.
+func (m *MAIDSmartMonitor) readDevice(device string) *deviceRead {
+	read := &deviceRead{}
+
+	// Get device info without spinning up
+	read.info, read.infoErr = m.getDeviceInfo(device)
+	if read.infoErr != nil {
+		return read
+	}
+	read.info.SmartEnabled, read.infoErr = m.checkSmartSupport(device)
+	if read.infoErr != nil {
+		return read
+	}
+	if read.info.Locked || (m.collectAttributes && !read.info.SmartEnabled) {
+		return read
+	}
+
+	if m.standbyThisCycle(device) {
+		m.debugLogger.Printf("Device %s is in standby mode - skipping to avoid spin-up", device)
+		read.standby = true
+		return read
+	}
+
+	release := m.acquireSpindle()
+	defer release()
+
+	if !m.collectAttributes {
+		read.hwmon, read.hwmonErr = m.readHwmonTemperature(device)
+		return read
+	}
+	read.smartData, read.smartErr = m.collectSmartData(device)
+	if read.smartErr != nil {
+		return read
+	}
+	if m.collectHealth {
+		read.passed, read.healthErr = m.collectHealthStatus(device)
+	}
+	// The device statistics log is ATA's; NVMe and SAS drives have none
+	if m.collectDevstat && len(read.smartData.ATASmartAttributes.Table) > 0 {
+		read.stats, read.statsErr = m.collectDeviceStatistics(device)
+	} else if m.collectDevstat {
+		m.debugLogger.Printf("Skipping device statistics for %s: not an ATA drive", device)
+	}
+	return read
+}
+
+// acquireSpindle takes one of the -max-active-spindles slots, waiting for
+// another drive's reads to finish when they are all taken, and returns the
+// function that gives it back
+func (m *MAIDSmartMonitor) acquireSpindle() func() {
+	if m.spindles == nil {
+		return func() {}
+	}
+	m.spindles <- struct{}{}
+	return func() { <-m.spindles }
+}
+
+// processAttributes runs the checks that compare a drive's attributes with its
+// history, then stores them and checks them against thresholds. A rise in UDMA
+// CRC errors is noted in crcIncreases for the port multiplier check.
+func (m *MAIDSmartMonitor) processAttributes(info *DeviceInfo, attributes []map[string]interface{}, start time.Time,
+	summary *cycleSummary, crcIncreases map[string]int64) {
+	m.checkPowerOnHours(attributes, info.SerialNumber)
+	m.checkErrorRateDecline(attributes, info.SerialNumber)
+	m.checkReallocationRate(attributes, info.ID())
+	m.checkUncorrectableTrend(attributes, info.ID())
+	m.checkPendingConversion(attributes, info.ID())
+	if increase := m.crcIncrease(attributes, info.ID()); increase > 0 {
+		crcIncreases[info.Device] = increase
+	}
+	stored, err := m.storeSmartData(attributes, info)
+	if err != nil {
+		m.errLogger.Printf("Failed to store SMART data for %s: %v", info.Device, err)
+		return
+	}
+	summary.AttributesStored += stored
+	m.events.queueChanges(info, attributes, start)
+	if err := m.captureBaseline(attributes, info.SerialNumber); err != nil {
+		m.errLogger.Printf("Failed to capture baseline for %s: %v", info.Device, err)
+	}
+	m.checkHealthThresholds(attributes, info.Model)
+}
+
+// collector reads drive health from a source other than smartctl, such as a
+// vendor tool for drives behind a RAID controller that smartctl cannot address.
+// smartctl itself is the built-in collector, run by the cycle's per-device loop;
+// the others run after it and report every drive they see in one call.
+//
+// smartctl is deliberately not behind this interface: it is read one device at
+// a time so that each drive's power state can be probed before any read, reads
+// can be paced and bounded by -parallel and -max-active-spindles, and a drive
+// can be polled on its own schedule. A Collect call that reports the whole
+// fleet at once has none of those hooks.
+type collector interface {
+	Name() string
+	Collect() ([]collectedDrive, error)
+}
+
+// collectedDrive is one drive as reported by a collector: enough identity to key
+// its history, and its attributes in smartctl's numbering
+type collectedDrive struct {
+	Device       string               `json:"device"` // /dev path, or the tool's own address such as "/c0/e252/s3"
+	SerialNumber string               `json:"serial_number"`
+	Model        string               `json:"model"`
+	WWN          string               `json:"wwn"`
+	HealthPassed *bool                `json:"health_passed"` // overall health, when the tool reports it
+	Attributes   []collectedAttribute `json:"attributes"`
+}
+
+// collectedAttribute is a SMART attribute as reported by a collector; only the
+// ID and raw value are required
+type collectedAttribute struct {
+	ID         int   `json:"id"`
+	Raw        int64 `json:"raw"`
+	Value      int   `json:"value"`
+	Worst      int   `json:"worst"`
+	Thresh     int   `json:"thresh"`
+	Prefailure bool  `json:"prefailure"`
+}
+
+// attributes converts the drive's stored attributes, as chosen by nameOf, to the
+// form parseSmartAttributes produces, marked with the collector's name in place
+// of the smartctl version
+func (d collectedDrive) attributes(nameOf func(id int, reported string) (string, bool), source string) []map[string]interface{} {
+	var attributes []map[string]interface{}
+	for _, attr := range d.Attributes {
+		name, ok := nameOf(attr.ID, "")
+		if !ok {
+			continue
+		}
+		flags := []string{}
+		if attr.Prefailure {
+			flags = append(flags, "prefailure")
+		}
+		flagsJSON, _ := json.Marshal(flags)
+
+		attributes = append(attributes, map[string]interface{}{
+			"device":              d.Device,
+			"attribute_id":        attr.ID,
+			"attribute_name":      name,
+			"raw_value":           attr.Raw,
+			"normalized_value":    attr.Value,
+			"threshold":           attr.Thresh,
+			"worst_value":         attr.Worst,
+			"flags":               string(flagsJSON),
+			"prefailure":          attr.Prefailure,
+			"smartctl_version":    source,
+			"json_format_version": "",
+		})
+	}
+	return attributes
+}
+
+// runCollector stores and checks the drives c reports like those read through
+// smartctl. Collectors cannot be asked about standby, so a drive that is
+// reported counts as spinning.
+func (m *MAIDSmartMonitor) runCollector(c collector, serials map[string]string, start time.Time,
+	summary *cycleSummary, crcIncreases map[string]int64) {
+	drives, err := c.Collect()
+	if err != nil {
+		m.errLogger.Printf("Collector %s failed: %v", c.Name(), err)
+		return
+	}
+
+	for _, d := range drives {
+		summary.DevicesFound++
+		if d.Device == "" {
+			m.warnLogger.Printf("Collector %s reported a drive without a device (serial %q); skipping it", c.Name(), d.SerialNumber)
+			summary.DevicesFailed++
+			continue
+		}
+
+		info := &DeviceInfo{
+			Device:       d.Device,
+			SerialNumber: d.SerialNumber,
+			Model:        d.Model,
+			WWN:          strings.ToLower(strings.TrimPrefix(d.WWN, "0x")),
+			SmartEnabled: true,
+		}
+		checked := time.Now()
+		m.checkDuplicateSerial(info, serials)
+		m.checkPathReassignment(info)
+		m.checkBay(info)
+		if err := m.updateDeviceStatus(info); err != nil {
+			m.errLogger.Printf("Failed to update device status for %s: %v", d.Device, err)
+		}
+		m.markActive(info)
+		summary.DevicesCollected++
+
+		if d.HealthPassed != nil {
+			if err := m.storeHealthStatus(info, *d.HealthPassed); err != nil {
+				m.errLogger.Printf("Failed to store health status for %s: %v", d.Device, err)
+			}
+		}
+
+		attributes := d.attributes(m.attributeName, c.Name())
+		if len(attributes) == 0 {
+			m.debugLogger.Printf("No target SMART attributes from %s for %s", c.Name(), d.Device)
+		} else {
+			m.processAttributes(info, attributes, start, summary, crcIncreases)
+		}
+		m.resolveAlerts(info, checked)
+	}
+}
+
+// commandCollector runs an external program, such as a wrapper around nvme-cli,
+// sas3ircu or storcli, that prints a JSON array of collectedDrive on stdout
+type commandCollector struct {
+	name    string
+	command []string
+	timeout time.Duration
+}
+
+func (c commandCollector) Name() string { return c.name }
+
+func (c commandCollector) Collect() ([]collectedDrive, error) {
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := startProcessGroup(cmd); err != nil {
+		return nil, fmt.Errorf("failed to run %s: %v", c.command[0], err)
+	}
+	defer releaseProcessGroup(cmd)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(c.timeout):
+		killProcessGroup(cmd)
+		waitKilled(done)
+		return nil, fmt.Errorf("%s timed out after %s", c.command[0], c.timeout)
+	}
+	if err != nil {
+		out := strings.TrimSpace(stderr.String())
+		if len(out) > 200 {
+			out = out[:200] + "..."
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", c.command[0], err, out)
+	}
+
+	var drives []collectedDrive
+	if err := json.Unmarshal(stdout.Bytes(), &drives); err != nil {
+		return nil, fmt.Errorf("failed to parse output of %s: %v", c.command[0], err)
+	}
+	return drives, nil
+}
+
+// collectorConfig is one entry of the -collector-config file
+type collectorConfig struct {
+	Name           string   `json:"name"`
+	Command        []string `json:"command"`
+	TimeoutSeconds int      `json:"timeout_seconds"` // default 60
+}
+
+// loadCollectors reads a JSON array of command collectors, e.g.
+// [{"name": "storcli", "command": ["/usr/local/libexec/storcli-smart", "/c0"], "timeout_seconds": 120}],
+// and returns them by name
+func loadCollectors(path string) (map[string]collector, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collector config: %v", err)
+	}
+
+	var configs []collectorConfig
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse collector config: %v", err)
+	}
+
+	collectors := make(map[string]collector)
+	for i, config := range configs {
+		if config.Name == "" || len(config.Command) == 0 {
+			return nil, fmt.Errorf("collector %d: name and command are required", i+1)
+		}
+		if config.Name == "smartctl" {
+			return nil, fmt.Errorf("collector %d: smartctl is the built-in collector", i+1)
+		}
+		if _, ok := collectors[config.Name]; ok {
+			return nil, fmt.Errorf("collector %s is defined twice", config.Name)
+		}
+		timeout := time.Duration(config.TimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			timeout = time.Minute
+		}
+		collectors[config.Name] = commandCollector{name: config.Name, command: config.Command, timeout: timeout}
+	}
+	return collectors, nil
+}
+
+// orderDevices returns devices in polling order. With the active-first order,
+// drives already spinning come before those in standby, so their readings are
+// taken before a slow cycle (or -stagger) gives them time to spin down. Devices
+// that are backing off are left at the end without being probed.
+func (m *MAIDSmartMonitor) orderDevices(devices []string) []string {
+	if m.pollOrder != "active-first" {
+		return devices
+	}
+	rank := make(map[string]int, len(devices))
+	for _, device := range devices {
+		switch {
+		case m.backoff[device] != nil && m.backoff[device].skip > 0:
+			rank[device] = 2
+		case m.standbyThisCycle(device):
+			rank[device] = 1
+		}
+	}
+	ordered := append([]string(nil), devices...)
+	sort.SliceStable(ordered, func(i, j int) bool { return rank[ordered[i]] < rank[ordered[j]] })
+	return ordered
+}
+
+// hashReadings hashes the smart_data rows with ids in (afterID, lastID] in id
+// order, returning the hex digest and the number of rows
+func (m *MAIDSmartMonitor) hashReadings(afterID, lastID int64) (string, int, error) {
+	rows, err := m.db.Query(`
+		SELECT id, device_id, timestamp, attribute_id, raw_value, normalized_value, threshold, worst_value
+		FROM smart_data WHERE id > ? AND id <= ? ORDER BY id
+	`, afterID, lastID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to query readings: %v", err)
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	count := 0
+	for rows.Next() {
+		var id int64
+		var deviceID sql.NullString
+		var timestamp time.Time
+		var attrID int
+		var raw, normalized, threshold, worst sql.NullInt64
+		if err := rows.Scan(&id, &deviceID, &timestamp, &attrID, &raw, &normalized, &threshold, &worst); err != nil {
+			return "", 0, fmt.Errorf("failed to scan reading: %v", err)
+		}
+		fmt.Fprintf(h, "%d|%s|%s|%d|%v|%v|%v|%v\n", id, deviceID.String,
+			timestamp.UTC().Format(time.RFC3339Nano), attrID, raw, normalized, threshold, worst)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return "", 0, fmt.Errorf("failed to read readings: %v", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), count, nil
+}
+
+// chainHash links a cycle's data hash to the previous cycle's hash
+func chainHash(prevHash, dataHash string) string {
+	sum := sha256.Sum256([]byte(prevHash + dataHash))
+	return hex.EncodeToString(sum[:])
+}
+
+// chainCycle records the readings stored since afterID in cycle_log, chained to
+// the previous cycle's hash so that later edits or deletions are detectable
+func (m *MAIDSmartMonitor) chainCycle(afterID int64, started, finished time.Time) error {
+	return m.writes.do("cycle hash", func() error {
+		var lastID int64
+		if err := m.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM smart_data`).Scan(&lastID); err != nil {
+			return fmt.Errorf("failed to read last reading id: %v", err)
+		}
+
+		dataHash, count, err := m.hashReadings(afterID, lastID)
+		if err != nil {
+			return err
+		}
+
+		var prevHash string
+		err = m.db.QueryRow(`SELECT hash FROM cycle_log ORDER BY id DESC LIMIT 1`).Scan(&prevHash)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to read previous cycle hash: %v", err)
+		}
+
+		_, err = m.db.Exec(`
+			INSERT INTO cycle_log (started, finished, first_id, last_id, record_count, data_hash, prev_hash, hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, started, finished, afterID+1, lastID, count, dataHash, prevHash, chainHash(prevHash, dataHash))
+		if err != nil {
+			return fmt.Errorf("failed to insert cycle hash: %v", err)
+		}
+		return nil
+	})
+}
+
+// pruneHash is the data hash of a prune entry: the id range and number of the
+// readings it deleted
+func pruneHash(firstID, lastID int64, count int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("prune|%d|%d|%d", firstID, lastID, count)))
+	return hex.EncodeToString(sum[:])
+}
+
+// chainPrune records in cycle_log, as a "prune" entry chained like a cycle, that
+// the readings matching condition are about to be deleted, so verifyChain can
+// tell cycles that lost readings to retention, disk space pruning or a purge
+// from tampered ones. It must run in the deleting transaction, before the
+// delete, and does nothing until a cycle has been chained.
+func chainPrune(tx *sql.Tx, condition string, args ...interface{}) error {
+	var chained int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM cycle_log`).Scan(&chained); err != nil {
+		return fmt.Errorf("failed to read cycle log: %v", err)
+	}
+	if chained == 0 {
+		return nil
+	}
+
+	var firstID, lastID sql.NullInt64
+	var count int
+	err := tx.QueryRow(`SELECT MIN(id), MAX(id), COUNT(*) FROM smart_data WHERE `+condition, args...).
+		Scan(&firstID, &lastID, &count)
+	if err != nil {
+		return fmt.Errorf("failed to find readings to prune: %v", err)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	var prevHash string
+	if err := tx.QueryRow(`SELECT hash FROM cycle_log ORDER BY id DESC LIMIT 1`).Scan(&prevHash); err != nil {
+		return fmt.Errorf("failed to read previous cycle hash: %v", err)
+	}
+	dataHash := pruneHash(firstID.Int64, lastID.Int64, count)
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO cycle_log (kind, started, finished, first_id, last_id, record_count, data_hash, prev_hash, hash)
+		VALUES ('prune', ?, ?, ?, ?, ?, ?, ?, ?)
+	`, now, now, firstID.Int64, lastID.Int64, count, dataHash, prevHash, chainHash(prevHash, dataHash))
+	if err != nil {
+		return fmt.Errorf("failed to insert prune entry: %v", err)
+	}
+	return nil
+}
+
+// chainCheck is the result of verifyChain: the number of cycle_log entries
+// checked, how many of those are cycles that lost readings to a logged prune
+// and so had only their chain link checked, and a description of each problem
+type chainCheck struct {
+	entries  int
+	pruned   int
+	problems []string
+}
+
+// verifyChain recomputes every cycle_log entry from the stored readings. A cycle
+// whose id range overlaps a later prune entry is checked for its link only, as
+// its remaining readings can no longer match its data hash.
+func (m *MAIDSmartMonitor) verifyChain() (*chainCheck, error) {
+	rows, err := m.db.Query(`
+		SELECT id, kind, first_id, last_id, record_count, data_hash, prev_hash, hash
+		FROM cycle_log ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cycle log: %v", err)
+	}
+
+	type entry struct {
+		id, firstID, lastID           int64
+		count                         int
+		kind, dataHash, prevHash, sum string
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.kind, &e.firstID, &e.lastID, &e.count, &e.dataHash, &e.prevHash, &e.sum); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan cycle log: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	// prunedLater reports whether a prune entry after entries[i] deleted
+	// readings in its id range
+	prunedLater := func(i int) bool {
+		for _, p := range entries[i+1:] {
+			if p.kind == "prune" && p.firstID <= entries[i].lastID && p.lastID >= entries[i].firstID {
+				return true
+			}
+		}
+		return false
+	}
+
+	check := &chainCheck{entries: len(entries)}
+	prevHash := ""
+	for i, e := range entries {
+		if e.prevHash != prevHash || chainHash(e.prevHash, e.dataHash) != e.sum {
+			check.problems = append(check.problems, fmt.Sprintf("%s %d: chain broken (log entry altered or removed)", e.kind, e.id))
+			prevHash = e.sum
+			continue
+		}
+		prevHash = e.sum
+
+		if e.kind == "prune" {
+			if pruneHash(e.firstID, e.lastID, e.count) != e.dataHash {
+				check.problems = append(check.problems, fmt.Sprintf("prune %d: entry altered", e.id))
+			}
+			continue
+		}
+		if prunedLater(i) {
+			check.pruned++
+			continue
+		}
+
+		dataHash, count, err := m.hashReadings(e.firstID-1, e.lastID)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case count == 0 && e.count > 0:
+			check.problems = append(check.problems, fmt.Sprintf("cycle %d: all %d readings missing", e.id, e.count))
+		case dataHash != e.dataHash:
+			check.problems = append(check.problems, fmt.Sprintf("cycle %d: readings altered (%d recorded, %d present)", e.id, e.count, count))
+		}
+	}
+
+	return check, nil
+}
+
+// deviceBackoff tracks a device whose collection keeps failing
+type deviceBackoff struct {
+	failures int // consecutive failed cycles
+	skip     int // cycles still to skip before the next attempt
+}
+
+// backingOff reports whether device should be skipped this cycle. Skips are
+// counted in -interval cycles, so only a fleet cycle (see fleetDue) counts one.
+func (m *MAIDSmartMonitor) backingOff(device string, fleet bool) bool {
+	b := m.backoff[device]
+	if b == nil || b.skip == 0 {
+		return false
+	}
+	if fleet {
+		b.skip--
+	}
+	return true
+}
+
+// collectionFailed extends a device's failure streak. The first failure is
+// retried on the next cycle; after that the device sits out 1, 2, 4, ... cycles,
+// capped at maxBackoffCycles.
+func (m *MAIDSmartMonitor) collectionFailed(device string) {
+	if m.maxBackoffCycles <= 0 {
+		return
+	}
+
+	b := m.backoff[device]
+	if b == nil {
+		b = &deviceBackoff{}
+		m.backoff[device] = b
+	}
+	b.failures++
+	if b.failures < 2 {
+		return
+	}
+
+	b.skip = m.maxBackoffCycles
+	if shift := uint(b.failures - 2); shift < 31 && 1<<shift < m.maxBackoffCycles {
+		b.skip = 1 << shift
+	}
+	m.warnLogger.Printf("Device %s failed %d cycles in a row, skipping the next %d", device, b.failures, b.skip)
+}
+
+// collectionSucceeded ends a device's failure streak
+func (m *MAIDSmartMonitor) collectionSucceeded(device string) {
+	if b := m.backoff[device]; b != nil {
+		m.logger.Printf("Device %s recovered after %d failed cycles", device, b.failures)
+		delete(m.backoff, device)
+	}
+}
+
+// devicePoll is when a device is next due under adaptive polling
+type devicePoll struct {
+	next     time.Time
+	interval time.Duration
+}
+
+// pollDue reports whether device is due this cycle. Without adaptive polling every
+// device is due every cycle; with it, a device is due once its interval has passed,
+// less half a minimum interval so that a tick arriving slightly early still counts.
+func (m *MAIDSmartMonitor) pollDue(device string, now time.Time) bool {
+	if m.adaptiveWarm <= 0 {
+		return true
+	}
+	p := m.polls[device]
+	return p == nil || !now.Add(m.adaptiveMin/2).Before(p.next)
+}
+
+// fleetDue reports whether this cycle does the work that covers the whole
+// fleet: retention, the disk space check, counting backoff skips and running
+// the external collectors. Without adaptive polling every cycle does; with it,
+// one cycle per -interval does, with the same leeway as pollDue.
+func (m *MAIDSmartMonitor) fleetDue(now time.Time) bool {
+	if m.adaptiveWarm <= 0 || m.lastFleetCycle.IsZero() {
+		return true
+	}
+	return !now.Add(m.adaptiveMin / 2).Before(m.lastFleetCycle.Add(m.pollInterval))
+}
+
+// schedulePoll sets when device is next due from the temperature in attributes.
+// Every device polled is scheduled, whatever became of it; drives without a
+// temperature reading, such as those in standby, locked or failing, keep the
+// normal interval.
+func (m *MAIDSmartMonitor) schedulePoll(device string, attributes []map[string]interface{}, now time.Time) {
+	if m.adaptiveWarm <= 0 {
+		return
+	}
+
+	interval, reason := m.pollInterval, "without a temperature reading"
+	if tempAttr := authoritativeTemperature(attributes); tempAttr != 0 {
+		var temp int64
+		for _, attr := range attributes {
+			if attr["attribute_id"].(int) == tempAttr {
+				temp = attr["raw_value"].(int64)
+			}
+		}
+		reason = fmt.Sprintf("at %d°C", temp)
+		switch {
+		case temp >= int64(m.adaptiveWarm):
+			interval = m.adaptiveMin
+		case m.adaptiveCool > 0 && temp <= int64(m.adaptiveCool):
+			interval = m.adaptiveMax
+		}
+	}
+
+	p := m.polls[device]
+	if p == nil {
+		p = &devicePoll{interval: m.pollInterval}
+		m.polls[device] = p
+	}
+	if interval != p.interval {
+		m.logger.Printf("Polling %s every %s %s (was every %s)", device, interval, reason, p.interval)
+	}
+	p.interval = interval
+	p.next = now.Add(interval)
+}
+
+// cycleSummary counts what one monitoring cycle did, for the end-of-cycle log
+// line and the last_cycle section of the API summary
+type cycleSummary struct {
+	DevicesFound     int     `json:"devices_found"`
+	DevicesStandby   int     `json:"devices_standby"`
+	DevicesBackedOff int     `json:"devices_backed_off"`
+	DevicesDeferred  int     `json:"devices_deferred"`
+	DevicesCollected int     `json:"devices_collected"`
+	DevicesFailed    int     `json:"devices_failed"`
+	AttributesStored int     `json:"attributes_stored"`
+	AlertsRaised     int     `json:"alerts_raised"`
+	Buffered         int     `json:"readings_buffered"`
+	Duration         float64 `json:"duration_seconds"`
+}
+
+// monitorCounters are the cumulative totals kept in monitor_counters, in the
+// order they are exposed on /metrics
+var monitorCounters = []struct {
+	name, help string
+	value      func(*cycleSummary) int
+}{
+	{"cycles_total", "Monitoring cycles run.", func(*cycleSummary) int { return 1 }},
+	{"collection_errors_total", "Devices whose identification or SMART collection failed.", func(s *cycleSummary) int { return s.DevicesFailed }},
+	{"standby_skips_total", "Devices skipped because they were in standby.", func(s *cycleSummary) int { return s.DevicesStandby }},
+	{"alerts_total", "Health alerts raised, including repeats of open alerts.", func(s *cycleSummary) int { return s.AlertsRaised }},
+}
+
+// addCounters adds a finished cycle to the cumulative totals in monitor_counters,
+// which survive restarts and only reset with the database
+func (m *MAIDSmartMonitor) addCounters(summary *cycleSummary) {
+	m.writes.async("counters", func() error {
+		for _, counter := range monitorCounters {
+			_, err := m.db.Exec(`
+				INSERT INTO monitor_counters (name, value) VALUES (?, ?)
+				ON CONFLICT(name) DO UPDATE SET value = value + excluded.value
+			`, counter.name, counter.value(summary))
+			if err != nil {
+				return fmt.Errorf("failed to update counter %s: %v", counter.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// writeMetrics writes the cumulative counters in the Prometheus text format
+func (m *MAIDSmartMonitor) writeMetrics(w io.Writer) error {
+	rows, err := m.db.Query(`SELECT name, value FROM monitor_counters`)
+	if err != nil {
+		return fmt.Errorf("failed to query counters: %v", err)
+	}
+	defer rows.Close()
+
+	values := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return fmt.Errorf("failed to scan counter: %v", err)
+		}
+		values[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read counters: %v", err)
+	}
+
+	for _, counter := range monitorCounters {
+		fmt.Fprintf(w, "# HELP maid_smart_%s %s\n", counter.name, counter.help)
+		fmt.Fprintf(w, "# TYPE maid_smart_%s counter\n", counter.name)
+		fmt.Fprintf(w, "maid_smart_%s %d\n", counter.name, values[counter.name])
+	}
+	return nil
+}
+
+// jitterRand is seeded per process so that hosts started together do not draw
+// the same delays; it is only used from the cycle loop, which is serialized
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// jitterDelay returns a random delay in [0, max)
+func jitterDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// temperatureSensor labels the temperature attributes; 190 is an airflow (often
+// offset) reading on many drives and must not be presented as the drive temperature
+func temperatureSensor(attrID int) string {
+	if attrID == 190 {
+		return "airflow"
+	}
+	return "drive"
+}
+
+// validTempUnit reports whether unit is a supported display unit
+func validTempUnit(unit string) bool {
+	return unit == "C" || unit == "F"
+}
+
+// convertTemperature converts a stored Celsius reading into the display unit
+func (m *MAIDSmartMonitor) convertTemperature(celsius int64) float64 {
+	if m.tempUnit == "F" {
+		return float64(celsius)*9/5 + 32
+	}
+	return float64(celsius)
+}
+
+// getLatestTemperatures returns the most recent temperature readings per device
+func (m *MAIDSmartMonitor) getLatestTemperatures() (map[string][]map[string]interface{}, error) {
+	rows, err := m.db.Query(`
+		SELECT st.device, s.attribute_id, s.raw_value FROM smart_data s
+		JOIN device_status st ON st.device_id = s.device_id
+		WHERE s.attribute_id IN (190, 194)
+		  AND s.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                     WHERE device_id = s.device_id AND attribute_id = s.attribute_id)
+		ORDER BY st.device, s.attribute_id DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query temperatures: %v", err)
+	}
+	defer rows.Close()
+
+	temperatures := make(map[string][]map[string]interface{})
+	for rows.Next() {
+		var device string
+		var attrID int
+		var celsius int64
+		if err := rows.Scan(&device, &attrID, &celsius); err != nil {
+			return nil, fmt.Errorf("failed to scan temperature row: %v", err)
+		}
+		temperatures[device] = append(temperatures[device], map[string]interface{}{
+			"sensor":       temperatureSensor(attrID),
+			"attribute_id": attrID,
+			"value":        m.convertTemperature(celsius),
+			"unit":         m.tempUnit,
+		})
+	}
+
+	return temperatures, nil
+}
+
+// getDataVolume returns the TB (10^12 bytes, as endurance is rated) written and
+// read over each drive's life, from the latest attribute 241 and 242 counts
+// scaled by the unit stored for them. Drives read before units were recorded
+// are taken to count 512-byte LBAs.
+func (m *MAIDSmartMonitor) getDataVolume() (map[string]map[string]float64, error) {
+	rows, err := m.db.Query(`
+		SELECT st.device, s.attribute_id, s.raw_value,
+		       CASE s.attribute_id WHEN 241 THEN st.written_unit_bytes ELSE st.read_unit_bytes END,
+		       st.logical_sector_size
+		FROM smart_data s
+		JOIN device_status st ON st.device_id = s.device_id
+		WHERE s.attribute_id IN (241, 242) AND s.raw_value IS NOT NULL
+		  AND s.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                     WHERE device_id = s.device_id AND attribute_id = s.attribute_id)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query data volume: %v", err)
+	}
+	defer rows.Close()
+
+	volume := make(map[string]map[string]float64)
+	for rows.Next() {
+		var device string
+		var attrID int
+		var count int64
+		var unit, sectorSize sql.NullInt64
+		if err := rows.Scan(&device, &attrID, &count, &unit, &sectorSize); err != nil {
+			return nil, fmt.Errorf("failed to scan data volume row: %v", err)
+		}
+		size := int64(512)
+		switch {
+		case unit.Int64 > 0:
+			size = unit.Int64
+		case sectorSize.Int64 > 0:
+			size = sectorSize.Int64
+		}
+
+		if volume[device] == nil {
+			volume[device] = make(map[string]float64)
+		}
+		key := "tb_read"
+		if attrID == 241 {
+			key = "tb_written"
+		}
+		volume[device][key] = float64(count) * float64(size) / 1e12
+	}
+
+	return volume, rows.Err()
+}
+
+// replacementCriteria are the limits past which a drive is recommended for
+// proactive replacement (0 disables each)
+type replacementCriteria struct {
+	powerOnHours int64 // attribute 9 raw value above this
+	reallocated  int64 // attribute 5 raw value above this
+	ssdLife      int   // SSD wear attribute (177, 231 or 233) normalized below this percent
+}
+
+var defaultReplacementCriteria = replacementCriteria{powerOnHours: 43800, reallocated: 100, ssdLife: 10}
+
+// recommendReplacements lists the drives that meet any replacement criterion or
+// whose overall-health self-assessment failed, most urgent first. Each met
+// criterion scores how far past its limit the drive is (1 at the limit, 2 at
+// double it), a failed self-assessment scores 10, and drives are ranked by total.
+func (m *MAIDSmartMonitor) recommendReplacements() ([]map[string]interface{}, error) {
+	criteria := m.replacement
+	rows, err := m.db.Query(`
+		SELECT st.device_id, st.device, st.serial_number, st.model, st.health_status,
+		       s.attribute_id, s.raw_value, s.normalized_value
+		FROM device_status st
+		LEFT JOIN smart_data s ON s.device_id = st.device_id
+		  AND s.attribute_id IN (5, 9, 177, 231, 233)
+		  AND s.timestamp = (SELECT MAX(timestamp) FROM smart_data
+		                     WHERE device_id = s.device_id AND attribute_id = s.attribute_id)
+		ORDER BY st.device, st.device_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query replacement criteria: %v", err)
+	}
+	defer rows.Close()
+
+	type driveWear struct {
+		device, serial, model, health string
+		values                        map[int]int64 // raw values, and normalized for the wear attributes
+	}
+	var drives []*driveWear
+	byID := make(map[string]*driveWear)
+	for rows.Next() {
+		var deviceID string
+		var device, serial, model, health sql.NullString
+		var attrID, raw, normalized sql.NullInt64
+		if err := rows.Scan(&deviceID, &device, &serial, &model, &health, &attrID, &raw, &normalized); err != nil {
+			return nil, fmt.Errorf("failed to scan replacement criteria row: %v", err)
+		}
+		d := byID[deviceID]
+		if d == nil {
+			d = &driveWear{device: device.String, serial: serial.String, model: model.String, health: health.String,
+				values: make(map[int]int64)}
+			byID[deviceID] = d
+			drives = append(drives, d)
+		}
+		switch {
+		case !attrID.Valid:
+		case attrID.Int64 == 5 || attrID.Int64 == 9:
+			d.values[int(attrID.Int64)] = raw.Int64
+		default:
+			d.values[int(attrID.Int64)] = normalized.Int64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read replacement criteria: %v", err)
+	}
+
+	recommendations := []map[string]interface{}{}
+	for _, d := range drives {
+		var reasons []string
+		score := 0.0
+		if d.health == "FAILED" {
+			reasons = append(reasons, "overall-health self-assessment FAILED")
+			score += 10
+		}
+		if poh, ok := d.values[9]; ok && criteria.powerOnHours > 0 && poh > criteria.powerOnHours {
+			reasons = append(reasons, fmt.Sprintf("%d power-on hours (over %d)", poh, criteria.powerOnHours))
+			score += float64(poh) / float64(criteria.powerOnHours)
+		}
+		if realloc, ok := d.values[5]; ok && criteria.reallocated > 0 && realloc > criteria.reallocated {
+			reasons = append(reasons, fmt.Sprintf("%d reallocated sectors (over %d)", realloc, criteria.reallocated))
+			score += float64(realloc) / float64(criteria.reallocated)
+		}
+		if criteria.ssdLife > 0 {
+			life, found := int64(100), false
+			for _, attrID := range []int{177, 231, 233} {
+				if v, ok := d.values[attrID]; ok && v < life {
+					life, found = v, true
+				}
+			}
+			if found && life < int64(criteria.ssdLife) {
+				reasons = append(reasons, fmt.Sprintf("%d%% SSD life left (under %d%%)", life, criteria.ssdLife))
+				score += float64(criteria.ssdLife) / math.Max(float64(life), 1)
+			}
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		recommendations = append(recommendations, map[string]interface{}{
+			"device":        d.device,
+			"serial_number": d.serial,
+			"model":         d.model,
+			"reasons":       reasons,
+			"score":         math.Round(score*100) / 100,
+		})
+	}
+
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		return recommendations[i]["score"].(float64) > recommendations[j]["score"].(float64)
+	})
+	for i, r := range recommendations {
+		r["priority"] = i + 1
+	}
+	return recommendations, nil
+}
+
+// summarizeTemperatures finds the hottest and coolest drives and the average over
+// all drives, taking one reading per drive: the drive sensor (194) when reported,
+// else airflow (190). It returns nil when no drive has a temperature.
+func summarizeTemperatures(temperatures map[string][]map[string]interface{}) map[string]interface{} {
+	devices := make([]string, 0, len(temperatures))
+	for device := range temperatures {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	var hottest, coolest map[string]interface{}
+	var total float64
+	for _, device := range devices {
+		// Readings are ordered 194 first
+		reading := temperatures[device][0]
+		value := reading["value"].(float64)
+		total += value
+
+		entry := map[string]interface{}{"device": device, "value": value, "sensor": reading["sensor"]}
+		if hottest == nil || value > hottest["value"].(float64) {
+			hottest = entry
+		}
+		if coolest == nil || value < coolest["value"].(float64) {
+			coolest = entry
+		}
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"hottest": hottest,
+		"coolest": coolest,
+		"average": math.Round(total/float64(len(devices))*10) / 10,
+		"devices": len(devices),
+		"unit":    temperatures[devices[0]][0]["unit"],
+	}
+}
+
+// addNote attaches an operator note to a drive serial
+func (m *MAIDSmartMonitor) addNote(serial, note string) error {
+	return m.writes.do("note", func() error {
+		_, err := m.db.Exec(`
+			INSERT INTO device_notes (serial_number, note, timestamp)
+			VALUES (?, ?, ?)
+		`, serial, note, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to add note: %v", err)
+		}
+		return nil
+	})
+}
+
+// listNotes returns all notes for a drive serial, oldest first
+func (m *MAIDSmartMonitor) listNotes(serial string) ([]map[string]interface{}, error) {
+	rows, err := m.db.Query(`
+		SELECT timestamp, note FROM device_notes
+		WHERE serial_number = ?
+		ORDER BY timestamp, id
+	`, serial)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %v", err)
+	}
+	defer rows.Close()
+
+	var notes []map[string]interface{}
+	for rows.Next() {
+		var timestamp time.Time
+		var note string
+		if err := rows.Scan(&timestamp, &note); err != nil {
+			return nil, fmt.Errorf("failed to scan note row: %v", err)
+		}
+		notes = append(notes, map[string]interface{}{
+			"timestamp": timestamp,
+			"note":      note,
+		})
+	}
+
+	return notes, nil
+}
+
+// getLatestNotesByDevice returns the most recent note for the drive currently at each device path
+func (m *MAIDSmartMonitor) getLatestNotesByDevice() (map[string]string, error) {
+	rows, err := m.db.Query(`
+		SELECT s.device, n.note FROM device_status s
+		JOIN device_notes n ON n.serial_number = s.serial_number
+		WHERE n.id = (SELECT id FROM device_notes
+		              WHERE serial_number = s.serial_number
+		              ORDER BY timestamp DESC, id DESC LIMIT 1)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %v", err)
+	}
+	defer rows.Close()
+
+	notes := make(map[string]string)
+	for rows.Next() {
+		var device, note string
+		if err := rows.Scan(&device, &note); err != nil {
+			return nil, fmt.Errorf("failed to scan note row: %v", err)
+		}
+		notes[device] = note
+	}
+
+	return notes, nil
+}
+
+// getBaysByDevice returns the bay of each drive the slot map placed, by current path
+func (m *MAIDSmartMonitor) getBaysByDevice() (map[string]string, error) {
+	rows, err := m.db.Query(`SELECT device, bay FROM device_status WHERE bay IS NOT NULL AND bay != ''`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bays: %v", err)
+	}
+	defer rows.Close()
+
+	bays := make(map[string]string)
+	for rows.Next() {
+		var device, bay string
+		if err := rows.Scan(&device, &bay); err != nil {
+			return nil, fmt.Errorf("failed to scan bay row: %v", err)
+		}
+		bays[device] = bay
+	}
+
+	return bays, rows.Err()
+}
+
+// getHealthSummary gets the health summary from the store, with the state of the
+// last monitoring cycle
+func (m *MAIDSmartMonitor) getHealthSummary() (map[string]interface{}, error) {
+	summary, err := m.store.HealthSummary()
+	if err != nil {
+		return nil, err
+	}
+
+	summary["last_cycle"] = m.cycleState()
+	return summary, nil
+}
+
+// HealthSummary counts devices and their unresolved alerts, with the latest
+// temperatures, notes, changes since install and open maintenance windows
+func (s sqliteStore) HealthSummary() (map[string]interface{}, error) {
+	m := s.m
+
+	// Get alerts by device, reported under the drive's current path
+	rows, err := m.db.Query(`
+		SELECT COALESCE(st.device, a.device), COUNT(*) as alert_count
+		FROM health_alerts a
+		LEFT JOIN device_status st ON st.device_id = a.device_id
+		WHERE a.resolved = FALSE AND NOT a.suppressed
+		GROUP BY a.device_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query alerts: %v", err)
+	}
+	defer rows.Close()
+
+	alertsByDevice := make(map[string]int)
+	for rows.Next() {
+		var device string
+		var count int
+		if err := rows.Scan(&device, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan alert row: %v", err)
+		}
+		alertsByDevice[device] = count
+	}
+
+	// Get device count
+	var deviceCount int
+	err = m.db.QueryRow("SELECT COUNT(*) FROM device_status").Scan(&deviceCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device count: %v", err)
+	}
+
+	temperatures, err := m.getLatestTemperatures()
+	if err != nil {
+		return nil, err
+	}
+
+	notesByDevice, err := m.getLatestNotesByDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	changesSinceInstall, err := m.getChangesSinceInstall()
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance, err := m.getActiveMaintenance()
+	if err != nil {
+		return nil, err
+	}
+
+	replacements, err := m.recommendReplacements()
+	if err != nil {
+		return nil, err
+	}
+
+	suppressed, err := m.getSuppressedAlerts()
+	if err != nil {
+		return nil, err
+	}
+
+	bays, err := m.getBaysByDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	dataVolume, err := m.getDataVolume()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"total_devices":       deviceCount,
+		"devices_with_alerts": len(alertsByDevice),
+		"alerts_by_device":    alertsByDevice,
+		"temperatures":        temperatures,
+		"temperature_stats":   summarizeTemperatures(temperatures),
+		"notes_by_device":     notesByDevice,
+		"since_install":       changesSinceInstall,
+		"maintenance":         maintenance,
+		"replacements":        replacements,
+		"suppressed":          suppressed,
+		"bays":                bays,
+		"data_volume":         dataVolume,
+	}, nil
+}
+
+// openReadOnly opens an existing database for queries only: no schema changes,
+// no writer, and no monitoring state
+func openReadOnly(dbPath string) (*MAIDSmartMonitor, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	m := &MAIDSmartMonitor{
+		db:          db,
+		dbPath:      dbPath,
+		logger:      log.New(levelWriter(os.Stdout, "info"), "[MAID-SMART] ", log.LstdFlags),
+		debugLogger: log.New(levelWriter(os.Stdout, "debug"), "[MAID-SMART] ", log.LstdFlags),
+		warnLogger:  log.New(levelWriter(os.Stderr, "warn"), "[MAID-SMART] ", log.LstdFlags),
+		errLogger:   log.New(os.Stderr, "[MAID-SMART] ", log.LstdFlags),
+		tempUnit:    "C",
+		replacement: defaultReplacementCriteria,
+	}
+	m.store = sqliteStore{m}
+
+	return m, nil
+}
+
+// getFleetSummary combines the health summaries of every database matching
+// pattern, one per host named after its file. A database that cannot be read is
+// reported under "errors" rather than failing the whole summary.
+func getFleetSummary(pattern, tempUnit string) (map[string]interface{}, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no databases match %q", pattern)
+	}
+	sort.Strings(paths)
+
+	hosts := make(map[string]interface{})
+	errs := make(map[string]string)
+	totalDevices, devicesWithAlerts := 0, 0
+
+	for _, path := range paths {
+		host := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+		m, err := openReadOnly(path)
+		if err != nil {
+			errs[host] = err.Error()
+			continue
+		}
+		m.tempUnit = tempUnit
+
+		summary, err := m.getHealthSummary()
+		m.Close()
+		if err != nil {
+			errs[host] = err.Error()
+			continue
+		}
+
+		// Cycle state belongs to a running daemon, not to a database file
+		delete(summary, "last_cycle")
+		summary["database"] = path
+
+		hosts[host] = summary
+		totalDevices += summary["total_devices"].(int)
+		devicesWithAlerts += summary["devices_with_alerts"].(int)
+	}
+
+	return map[string]interface{}{
+		"hosts":               hosts,
+		"total_hosts":         len(hosts),
+		"total_devices":       totalDevices,
+		"devices_with_alerts": devicesWithAlerts,
+		"errors":              errs,
+	}, nil
+}
+
+// summarySchemaVersion is bumped whenever a -summary-json field is renamed,
+// removed or changes type; adding fields does not bump it
+const summarySchemaVersion = 1
+
+// getSummaryDocument is the -summary-json output: the health summary plus the
+// status of every device, stamped with the schema version
+func (m *MAIDSmartMonitor) getSummaryDocument() (map[string]interface{}, error) {
+	summary, err := m.getHealthSummary()
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := m.getDeviceStatuses()
+	if err != nil {
+		return nil, err
+	}
+
+	summary["schema_version"] = summarySchemaVersion
+	summary["generated_at"] = time.Now()
+	summary["temperature_unit"] = m.tempUnit
+	summary["devices"] = devices
+	return summary, nil
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// cycleState returns a snapshot of the monitoring cycle state that is safe to
+// take while a cycle is running
+func (m *MAIDSmartMonitor) cycleState() map[string]interface{} {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+
+	return map[string]interface{}{
+		"running":  m.cycleRunning,
+		"started":  m.lastCycleStart,
+		"finished": m.lastCycleEnd,
+		"summary":  m.lastSummary,
+	}
+}
+
+// getDeviceStatuses returns the stored status of every known device
+func (m *MAIDSmartMonitor) getDeviceStatuses() ([]map[string]interface{}, error) {
+	rows, err := m.db.Query(`
+		SELECT device_id, device, serial_number, model, wwn, last_seen, is_mounted,
+		       smart_enabled, last_smart_check, security_state, is_locked, health_status, last_health_check,
+		       last_active, self_test_status, self_test_percent, bay,
+		       media_type, rotation_rate, capacity_bytes, form_factor, logical_sector_size,
+		       nvme_warning_temp_time, nvme_critical_temp_time, nvme_throttle_count, nvme_throttle_time,
+		       (SELECT note FROM device_notes n
+		        WHERE n.serial_number = device_status.serial_number
+		        ORDER BY n.timestamp DESC, n.id DESC LIMIT 1)
+		FROM device_status
+		ORDER BY device
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device status: %v", err)
+	}
+	defer rows.Close()
+
+	statuses := []map[string]interface{}{}
+	for rows.Next() {
+		var deviceID string
+		var device, serial, model, wwn, securityState, health, selfTest, bay, mediaType, formFactor, note sql.NullString
+		var lastSeen, lastCheck, lastHealthCheck, lastActive sql.NullTime
+		var isMounted, smartEnabled, isLocked sql.NullBool
+		var selfTestPercent, rotationRate, capacity, sectorSize sql.NullInt64
+		var warningTime, criticalTime, throttleCount, throttleTime sql.NullInt64
+		if err := rows.Scan(&deviceID, &device, &serial, &model, &wwn, &lastSeen, &isMounted, &smartEnabled, &lastCheck,
+			&securityState, &isLocked, &health, &lastHealthCheck, &lastActive, &selfTest, &selfTestPercent, &bay,
+			&mediaType, &rotationRate, &capacity, &formFactor, &sectorSize,
+			&warningTime, &criticalTime, &throttleCount, &throttleTime, &note); err != nil {
+			return nil, fmt.Errorf("failed to scan device status row: %v", err)
+		}
+		status := map[string]interface{}{
+			"device_id":         deviceID,
+			"device":            device.String,
+			"serial_number":     serial.String,
+			"model":             model.String,
+			"wwn":               wwn.String,
+			"last_seen":         lastSeen.Time,
+			"is_mounted":        isMounted.Bool,
+			"smart_enabled":     smartEnabled.Bool,
+			"last_smart_check":  lastCheck.Time,
+			"security_state":    securityState.String,
+			"is_locked":         isLocked.Bool,
+			"health_status":     health.String,
+			"last_health_check": lastHealthCheck.Time,
+			"last_active":       lastActive.Time,
+			"latest_note":       note.String,
+			"self_test_status":  selfTest.String,
+			"bay":               bay.String,
+			"media_type":        mediaType.String,
+			"rotation_rate":     rotationRate.Int64,
+			"capacity_bytes":    capacity.Int64,
+			"form_factor":       formFactor.String,
+
+			"logical_sector_size": sectorSize.Int64,
+		}
+		if selfTestPercent.Valid {
+			status["self_test_percent"] = selfTestPercent.Int64
+		}
+		if throttleCount.Valid {
+			status["nvme_thermal"] = map[string]int64{
+				"warning_temp_minutes":  warningTime.Int64,
+				"critical_temp_minutes": criticalTime.Int64,
+				"throttle_count":        throttleCount.Int64,
+				"throttle_seconds":      throttleTime.Int64,
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// apiResource renders a named resource as JSON; every API front-end serves these same documents
+func (m *MAIDSmartMonitor) apiResource(name string) ([]byte, error) {
+	var data interface{}
+	var err error
+
+	switch name {
+	case "summary":
+		data, err = m.getHealthSummary()
+	case "status":
+		data, err = m.getDeviceStatuses()
+	case "diff":
+		data, err = m.getChangesSinceLastReading()
+	default:
+		return nil, fmt.Errorf("unknown resource: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(data)
+}
+
+// serveSocket answers line-based requests ("GET summary", "GET status") on a Unix
+// domain socket, replying with one JSON document per line
+func (m *MAIDSmartMonitor) serveSocket(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			m.errLogger.Printf("Socket accept failed: %v", err)
+			continue
+		}
+		go m.handleSocketConn(conn)
+	}
+}
+
+// handleSocketConn serves requests from a single socket client until it disconnects
+func (m *MAIDSmartMonitor) handleSocketConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if !scanner.Scan() {
+			return
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var response []byte
+		var err error
+		if len(fields) != 2 || strings.ToUpper(fields[0]) != "GET" {
+			err = fmt.Errorf("invalid request, expected: GET <summary|status>")
+		} else {
+			response, err = m.apiResource(fields[1])
+		}
+		if err != nil {
+			response, _ = json.Marshal(map[string]string{"error": err.Error()})
+		}
+
+		if _, err := conn.Write(append(response, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+// apiHandler serves the API resources over HTTP at /api/<resource>, and the
+// cumulative counters at /metrics, requiring a bearer token when token is non-empty
+func (m *MAIDSmartMonitor) apiHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/api/")
+		if name != "summary" && name != "status" && name != "diff" {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := m.apiResource(name)
+		if err != nil {
+			m.errLogger.Printf("API request for %s failed: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+
+	mux.HandleFunc("/api/events", m.serveEvents)
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := m.writeMetrics(&buf); err != nil {
+			m.errLogger.Printf("Metrics request failed: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+
+	if token == "" {
+		return mux
+	}
+
+	expected := []byte(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(requestToken(r)), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// requestToken returns the bearer token an API request carries. Browsers cannot
+// set headers on a WebSocket, so /api/events also takes it as a "bearer.<token>"
+// Sec-WebSocket-Protocol or an access_token query parameter.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if r.URL.Path != "/api/events" {
+		return ""
+	}
+	if protocol := wsTokenProtocol(r.Header); protocol != "" {
+		return strings.TrimPrefix(protocol, wsTokenPrefix)
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// streamEvent is one JSON message of the /api/events stream: an "attributes"
+// event lists the attributes of a drive that changed since its previous reading
+// (all of them on its first), an "alert" event carries a new or escalated alert,
+// a "resolved" event an alert that has resolved, and a "cycle" event with the
+// cycle's summary ends each cycle's events
+type streamEvent struct {
+	Type       string            `json:"type"`
+	Time       time.Time         `json:"time"`
+	Device     string            `json:"device,omitempty"`
+	DeviceID   string            `json:"device_id,omitempty"`
+	Bay        string            `json:"bay,omitempty"`
+	Attributes []attributeChange `json:"attributes,omitempty"`
+	Alert      *HealthAlert      `json:"alert,omitempty"`
+	Summary    *cycleSummary     `json:"summary,omitempty"`
+}
+
+// attributeChange is an attribute's reading, with the previous one when there was one
+type attributeChange struct {
+	ID                 int    `json:"id"`
+	Name               string `json:"name"`
+	RawValue           int64  `json:"raw_value"`
+	NormalizedValue    int    `json:"normalized_value"`
+	PreviousRaw        *int64 `json:"previous_raw_value,omitempty"`
+	PreviousNormalized *int   `json:"previous_normalized_value,omitempty"`
+}
+
+// attributeReading is the part of a reading whose change is streamed
+type attributeReading struct {
+	raw        int64
+	normalized int
+}
+
+// eventClientBuffer is how many events an /api/events client may fall behind
+// by before it is disconnected
+const eventClientBuffer = 256
+
+// eventHub holds the events of the running cycle and fans them out to the
+// connected clients when it ends. Its zero value has no clients.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]string // send channel to remote address
+	pending [][]byte
+	last    map[string]map[int]attributeReading // previous reading by device ID and attribute ID
+}
+
+// subscribe registers a client and returns the channel its events arrive on.
+// The hub closes the channel if the client falls too far behind.
+func (h *eventHub) subscribe(addr string) chan []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients == nil {
+		h.clients = make(map[chan []byte]string)
+	}
+	send := make(chan []byte, eventClientBuffer)
+	h.clients[send] = addr
+	return send
+}
+
+// unsubscribe removes a client, unless the hub already dropped it
+func (h *eventHub) unsubscribe(send chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[send]; ok {
+		delete(h.clients, send)
+		close(send)
+	}
+}
+
+// queue holds an event for the end of the cycle; without clients it is dropped
+func (h *eventHub) queue(event streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+	if data, err := json.Marshal(event); err == nil {
+		h.pending = append(h.pending, data)
+	}
+}
+
+// queueChanges queues an attributes event for the attributes of a drive whose
+// raw or normalized value differs from its previous reading. Readings are
+// tracked with or without clients, so a new client only hears of real changes.
+func (h *eventHub) queueChanges(info *DeviceInfo, attributes []map[string]interface{}, now time.Time) {
+	h.mu.Lock()
+	if h.last == nil {
+		h.last = make(map[string]map[int]attributeReading)
+	}
+	previous := h.last[info.ID()]
+	current := make(map[int]attributeReading, len(attributes))
+	var changes []attributeChange
+	for _, attr := range attributes {
+		id := attr["attribute_id"].(int)
+		reading := attributeReading{raw: attr["raw_value"].(int64), normalized: attr["normalized_value"].(int)}
+		current[id] = reading
+
+		before, seen := previous[id]
+		if seen && before == reading {
+			continue
+		}
+		change := attributeChange{
+			ID:              id,
+			Name:            attr["attribute_name"].(string),
+			RawValue:        reading.raw,
+			NormalizedValue: reading.normalized,
+		}
+		if seen {
+			change.PreviousRaw, change.PreviousNormalized = &before.raw, &before.normalized
+		}
+		changes = append(changes, change)
+	}
+	h.last[info.ID()] = current
+	h.mu.Unlock()
+
+	if len(changes) > 0 {
+		h.queue(streamEvent{Type: "attributes", Time: now, Device: info.Device, DeviceID: info.ID(),
+			Bay: info.Bay, Attributes: changes})
+	}
+}
+
+// publishEvents sends the cycle's queued events and its summary to every client.
+// A client whose buffer is full is dropped rather than holding up the others.
+func (m *MAIDSmartMonitor) publishEvents(summary *cycleSummary, end time.Time) {
+	h := &m.events
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		h.pending = nil
+		return
+	}
+
+	if data, err := json.Marshal(streamEvent{Type: "cycle", Time: end, Summary: summary}); err == nil {
+		h.pending = append(h.pending, data)
+	}
+	for send, addr := range h.clients {
+		for _, data := range h.pending {
+			select {
+			case send <- data:
+				continue
+			default:
+			}
+			m.warnLogger.Printf("Event stream client %s fell more than %d events behind, disconnecting", addr, eventClientBuffer)
+			delete(h.clients, send)
+			close(send)
+			break
+		}
+	}
+	h.pending = nil
+}
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// wsGUID is appended to the client's key to derive Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsTokenPrefix marks the Sec-WebSocket-Protocol value that carries the API token
+const wsTokenPrefix = "bearer."
+
+// eventPingInterval is how often /api/events clients are pinged; one that sends
+// nothing, not even a pong, for two intervals is disconnected
+const eventPingInterval = 30 * time.Second
+
+// headerHasToken reports whether a comma-separated header contains token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsTokenProtocol returns the Sec-WebSocket-Protocol value carrying the API
+// token, if the client offered one
+func wsTokenProtocol(header http.Header) string {
+	for _, value := range header.Values("Sec-WebSocket-Protocol") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); strings.HasPrefix(field, wsTokenPrefix) {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+// sameOrigin reports whether a request either has no Origin, as non-browser
+// clients send it, or one naming the host it was sent to. Browsers do not apply
+// the same-origin policy to WebSockets, so without this any page a user visits
+// could read the event stream of a monitor on their network.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// writeWSFrame writes one unmasked, unfragmented frame, as a server sends them
+func writeWSFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 127)
+		for shift := 56; shift >= 0; shift -= 8 {
+			frame = append(frame, byte(uint64(n)>>uint(shift)))
+		}
+	}
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// readWSFrame reads one frame from a client, which must mask it, and returns
+// its opcode and unmasked payload. Clients have nothing to send beyond control
+// frames, so large frames are refused.
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("unmasked client frame")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126, 127:
+		size := 2
+		if length == 127 {
+			size = 8
+		}
+		extended := make([]byte, size)
+		if _, err := io.ReadFull(r, extended); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range extended {
+			length = length<<8 | uint64(b)
+		}
+	}
+	if length > 4096 {
+		return 0, nil, fmt.Errorf("client frame of %d bytes is too large", length)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+// serveEvents upgrades an /api/events request to a WebSocket and streams the
+// hub's events to it until either side closes the connection
+func (m *MAIDSmartMonitor) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !sameOrigin(r) {
+		m.warnLogger.Printf("Refused event stream for %s from origin %s", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		m.errLogger.Printf("Event stream upgrade for %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	// A browser drops the connection unless the protocol it offered is accepted
+	var protocol string
+	if offered := wsTokenProtocol(r.Header); offered != "" {
+		protocol = "Sec-WebSocket-Protocol: " + offered + "\r\n"
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n" + protocol + "\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	send := m.events.subscribe(r.RemoteAddr)
+	defer m.events.unsubscribe(send)
+	m.logger.Printf("Event stream client %s connected", r.RemoteAddr)
+	defer m.logger.Printf("Event stream client %s disconnected", r.RemoteAddr)
+
+	// Pongs and close replies come from the reader, events and pings from here
+	var writeMu sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return writeWSFrame(conn, opcode, payload)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			conn.SetReadDeadline(time.Now().Add(2 * eventPingInterval))
+			opcode, payload, err := readWSFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsClose:
+				if len(payload) > 2 {
+					payload = payload[:2]
+				}
+				write(wsClose, payload)
+				return
+			case wsPing:
+				write(wsPong, payload)
+			}
+		}
+	}()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case data, ok := <-send:
+			if !ok {
+				// Dropped by the hub for falling behind: 1008, policy violation
+				write(wsClose, append([]byte{0x03, 0xf0}, "too slow"...))
+				return
+			}
+			if err := write(wsText, data); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := write(wsPing, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// resolveListenAddr turns a listen flag into a host:port address. A bare port or
+// ":port" binds to localhost only; listening on every interface requires asking
+// for 0.0.0.0 or [::] explicitly. IPv6 hosts must be bracketed ("[::1]:9100").
+func resolveListenAddr(addr string) (string, error) {
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = ":" + addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q (use host:port, [ipv6]:port or port): %v", addr, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port in listen address %q", addr)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// startHTTPServer listens on addr and serves handler in the background
+func (m *MAIDSmartMonitor) startHTTPServer(name, addr string, handler http.Handler) (*http.Server, error) {
+	resolved, err := resolveListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", resolved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", resolved, err)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			m.errLogger.Printf("%s server stopped: %v", name, err)
+		}
+	}()
+
+	m.logger.Printf("Serving %s on http://%s", name, resolved)
+	return server, nil
+}
+
+// acquireInstanceLock locks the daemon's lock file at path, so that a second
+// daemon against the same database refuses to start, and records this process
+// in it. The lock lives as long as the returned file stays open and is released
+// by the OS if the process dies, so a stale lock file is simply taken over; the
+// previous holder's description is returned in that case.
+func acquireInstanceLock(path string) (*os.File, string, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open lock file %s: %v", path, err)
+	}
+
+	locked, err := tryLockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("failed to read lock file %s: %v", path, err)
+	}
+	var holder string
+	if fields := strings.Fields(string(content)); len(fields) > 0 {
+		holder = "PID " + fields[0]
+		if len(fields) > 1 {
+			holder += ", started " + fields[1]
+		}
+	}
+
+	if !locked {
+		file.Close()
+		if holder == "" {
+			holder = "another process"
+		}
+		return nil, "", fmt.Errorf("another instance (%s) holds %s", holder, path)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("failed to truncate lock file %s: %v", path, err)
+	}
+	if _, err := file.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), time.Now().Format(time.RFC3339))), 0); err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("failed to write lock file %s: %v", path, err)
+	}
+	return file, holder, nil
+}
+
+// sdNotify sends a state string such as "READY=1" or "WATCHDOG=1" to systemd.
+// It does nothing unless systemd set NOTIFY_SOCKET (Type=notify services).
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	// A leading '@' names a socket in the abstract namespace
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// listenSocket creates the Unix socket at path, replacing a stale socket left by a previous run
+func listenSocket(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+
+	return listener, nil
+}
+
+// replayedAlert is an alert that would have fired while replaying stored history
+type replayedAlert struct {
+	HealthAlert
+	Occurrences int
+}
+
+// analyzeHistory replays stored readings between from and to through the health
+// rules and returns the alerts that would have fired, without persisting them
+func (m *MAIDSmartMonitor) analyzeHistory(from, to time.Time) ([]*replayedAlert, error) {
+	rows, err := m.db.Query(`
+		SELECT device, COALESCE(model, ''), timestamp, attribute_id, attribute_name,
+		       raw_value, normalized_value, threshold, worst_value, COALESCE(stale, FALSE), prefailure
+		FROM smart_data
+		WHERE timestamp >= ? AND timestamp <= ?
+		ORDER BY device, timestamp, attribute_id
+	`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %v", err)
+	}
+	defer rows.Close()
+
+	var replayed []*replayedAlert
+	byKey := make(map[string]*replayedAlert)
+
+	var batch []map[string]interface{}
+	var batchDevice, batchModel string
+	var batchTime time.Time
+
+	flush := func() {
+		m.evaluateThresholds(batch, batchModel, func(device, attribute, alertType, message string) {
+			key := device + "|" + attribute + "|" + alertType
+			if r, ok := byKey[key]; ok {
+				r.Occurrences++
+				r.Message = message
+				r.Timestamp = batchTime
+				r.Severity = m.escalatedSeverity(r.Severity, batchTime.Sub(r.FirstSeen))
+				return
+			}
+
+			severity := initialSeverity[alertType]
+			if severity == "" {
+				severity = SeverityWarn
+			}
+			r := &replayedAlert{
+				HealthAlert: HealthAlert{
+					Device:        device,
+					AttributeName: attribute,
+					AlertType:     alertType,
+					Severity:      severity,
+					Message:       message,
+					FirstSeen:     batchTime,
+					Timestamp:     batchTime,
+				},
+				Occurrences: 1,
+			}
+			byKey[key] = r
+			replayed = append(replayed, r)
+		})
+		batch = nil
+	}
+
+	for rows.Next() {
+		var device, model, name string
+		var timestamp time.Time
+		var attrID, normalized, threshold, worst int
+		var raw int64
+		var stale bool
+		var prefail sql.NullBool
+		if err := rows.Scan(&device, &model, &timestamp, &attrID, &name, &raw, &normalized, &threshold, &worst, &stale, &prefail); err != nil {
+			return nil, fmt.Errorf("failed to scan history row: %v", err)
+		}
+
+		if device != batchDevice || !timestamp.Equal(batchTime) {
+			flush()
+			batchDevice, batchModel, batchTime = device, model, timestamp
+		}
+
+		attr := map[string]interface{}{
+			"device":           device,
+			"attribute_id":     attrID,
+			"attribute_name":   name,
+			"raw_value":        raw,
+			"normalized_value": normalized,
+			"threshold":        threshold,
+			"worst_value":      worst,
+			"stale":            stale,
+		}
+		if prefail.Valid {
+			attr["prefailure"] = prefail.Bool
+		}
+		batch = append(batch, attr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+	flush()
+
+	return replayed, nil
+}
+
+// parseTimeArg parses a command line timestamp given as RFC 3339, "YYYY-MM-DD HH:MM:SS" or "YYYY-MM-DD"
+func parseTimeArg(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// parseSince parses a relative window such as 48h, 3d or 2w: a whole number of
+// days (d) or weeks (w), or anything time.ParseDuration accepts
+func parseSince(value string) (time.Duration, error) {
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if n := len(value); n > 1 {
+		if unit, ok := units[value[n-1]]; ok {
+			count, err := strconv.Atoi(value[:n-1])
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// resolveDeviceIDs finds the identities a purge target refers to: a device_id,
+// a serial number, or the drive currently at a /dev path
+func (m *MAIDSmartMonitor) resolveDeviceIDs(target string) ([]string, error) {
+	rows, err := m.db.Query(`
+		SELECT device_id FROM device_status
+		WHERE device_id = ? OR serial_number = ? OR device = ?
+		UNION
+		SELECT DISTINCT device_id FROM smart_data
+		WHERE device_id = ? OR serial_number = ?
+	`, target, target, target, target, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", target, err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan device id: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// purgeDevice deletes every record of the drives matching target in one
+// transaction, then their raw archive files, optionally archiving their
+// readings to archiveFile first, and returns the number of rows removed per
+// table. Notes are kept: they are the drive's servicing history, such as its
+// RMA, which outlives its readings.
+func (m *MAIDSmartMonitor) purgeDevice(target, archiveFile string) (map[string]int64, error) {
+	ids, err := m.resolveDeviceIDs(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no records found for %s", target)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	if archiveFile != "" {
+		err := m.exportQuery(archiveFile, `
+			SELECT * FROM smart_data WHERE device_id IN (`+placeholders+`)
+			ORDER BY device_id, timestamp, attribute_id
+		`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("archive failed, nothing purged: %v", err)
+		}
+	}
+
+	// device_id is the serial whenever the drive reports one, so it also
+	// keys the serial-indexed tables
+	statements := []struct{ table, query string }{
+		{"smart_data", `DELETE FROM smart_data WHERE device_id IN (` + placeholders + `)`},
+		{"device_statistics", `DELETE FROM device_statistics WHERE device_id IN (` + placeholders + `)`},
+		{"health_alerts", `DELETE FROM health_alerts WHERE device_id IN (` + placeholders + `)`},
+		{"device_status", `DELETE FROM device_status WHERE device_id IN (` + placeholders + `)`},
+		{"device_baselines", `DELETE FROM device_baselines WHERE serial_number IN (` + placeholders + `)`},
+		{"raw_archive", `DELETE FROM raw_archive WHERE device_id IN (` + placeholders + `)`},
+	}
+
+	counts := make(map[string]int64)
+	err = m.writes.do("purge", func() error {
+		tx, err := m.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		if err := chainPrune(tx, `device_id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		archives, err := archiveFiles(tx, `device_id IN (`+placeholders+`)`, args...)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range statements {
+			result, err := tx.Exec(stmt.query, args...)
+			if err != nil {
+				return fmt.Errorf("failed to purge %s: %v", stmt.table, err)
+			}
+			counts[stmt.table], _ = result.RowsAffected()
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		m.removeArchiveFiles(archives)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// defaultSmartdLogDir is where smartd writes attribute logs when started with -A
+// and no prefix, as attrlog.MODEL-SERIAL.ata.csv
+const defaultSmartdLogDir = "/var/lib/smartmontools"
+
+// smartdNameRegex matches the characters smartd replaces with "_" in the model
+// and serial it builds log file names from
+var smartdNameRegex = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// smartdName normalizes a model-serial pair or file name for comparison, so
+// names match however smartd sanitized them
+func smartdName(s string) string {
+	return smartdNameRegex.ReplaceAllString(s, "_")
+}
+
+// importSmartdLogs stores the readings in smartd ATA attribute logs (a file, or
+// every *.ata.csv file in a directory) in smart_data, so history collected by
+// smartd is not lost when moving to the monitor. File names carry only a
+// sanitized model and serial, so each file is matched to a drive the monitor has
+// already identified; files matching none are skipped. Readings already stored
+// are kept. It returns the number of readings imported per file.
+func (m *MAIDSmartMonitor) importSmartdLogs(path string) (map[string]int64, error) {
+	files := []string{path}
+	if stat, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	} else if stat.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(path, "*.ata.csv"))
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no smartd ATA attribute logs (*.ata.csv) in %s", path)
+		}
+	}
+
+	rows, err := m.db.Query(`SELECT device, serial_number, COALESCE(model, '') FROM device_status WHERE serial_number != ''`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %v", err)
+	}
+	var known []DeviceInfo
+	for rows.Next() {
+		var info DeviceInfo
+		if err := rows.Scan(&info.Device, &info.SerialNumber, &info.Model); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan device: %v", err)
+		}
+		known = append(known, info)
+	}
+	rows.Close()
+
+	imported := make(map[string]int64)
+	for _, file := range files {
+		name := smartdName(strings.TrimSuffix(filepath.Base(file), ".ata.csv"))
+		var drive *DeviceInfo
+		for i := range known {
+			if strings.HasSuffix(name, smartdName(known[i].Model+"-"+known[i].SerialNumber)) {
+				drive = &known[i]
+				break
+			}
+		}
+		if drive == nil {
+			m.warnLogger.Printf("Skipping %s: no known drive matches its model and serial (run a monitoring cycle first)", file)
+			continue
+		}
+
+		n, err := m.importSmartdLog(file, drive)
+		if err != nil {
+			return imported, fmt.Errorf("failed to import %s: %v", file, err)
+		}
+		imported[file] = n
+	}
+	return imported, nil
+}
+
+// importSmartdLog stores one smartd attribute log's readings of the target
+// attributes for drive. Each line is a local timestamp followed by a
+// tab-separated "id;normalized;raw;" group per attribute.
+func (m *MAIDSmartMonitor) importSmartdLog(file string, drive *DeviceInfo) (int64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var imported int64
+	err = m.writes.do("import", func() error {
+		tx, err := m.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		stmt, err := tx.Prepare(`
+			INSERT OR IGNORE INTO smart_data
+			(device, serial_number, model, timestamp, attribute_id, attribute_name,
+			 raw_value, normalized_value, threshold, worst_value, flags, smartctl_version, device_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, 0, '[]', 'smartd', ?)
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %v", err)
+		}
+		defer stmt.Close()
+
+		for lineNo, line := range strings.Split(string(content), "\n") {
+			fields := strings.Split(strings.TrimSpace(line), "\t")
+			if fields[0] == "" {
+				continue
+			}
+			timestamp, err := time.ParseInLocation("2006-01-02 15:04:05", strings.TrimSuffix(fields[0], ";"), time.Local)
+			if err != nil {
+				m.warnLogger.Printf("Skipping %s line %d: bad timestamp %q", file, lineNo+1, fields[0])
+				continue
+			}
+			for _, field := range fields[1:] {
+				parts := strings.Split(strings.TrimSuffix(field, ";"), ";")
+				if len(parts) != 3 {
+					continue
+				}
+				id, err1 := strconv.Atoi(parts[0])
+				normalized, err2 := strconv.Atoi(parts[1])
+				raw, err3 := strconv.ParseInt(parts[2], 10, 64)
+				name, target := m.targetAttribs[id]
+				if err1 != nil || err2 != nil || err3 != nil || !target {
+					continue
+				}
+				// smartd logs the whole 48-bit raw value; temperatures keep
+				// the current reading in the low byte
+				if id == 190 || id == 194 {
+					raw &= 0xff
+				}
+				result, err := stmt.Exec(drive.Device, drive.SerialNumber, drive.Model, timestamp,
+					id, name, raw, normalized, drive.ID())
+				if err != nil {
+					return fmt.Errorf("failed to insert attribute: %v", err)
+				}
+				n, _ := result.RowsAffected()
+				imported += n
+			}
+		}
+
+		return tx.Commit()
+	})
+	return imported, err
+}
+
+// exportData exports SMART data read since the given time to CSV for analysis,
+// gzip-compressed when outputFile ends in .gz
+func (m *MAIDSmartMonitor) exportData(outputFile string, since time.Time) error {
+	return m.exportQuery(outputFile, `
+		SELECT * FROM smart_data 
+		WHERE timestamp >= ?
+		ORDER BY device, timestamp, attribute_id
+	`, since)
+}
+
+// fileNameUnsafeRegex matches the characters of a device ID that are replaced
+// when it is used in a file name, e.g. the slashes of a /dev path fallback
+var fileNameUnsafeRegex = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// purgeArchivePath names the -archive-before-purge file for target, written at
+// now in format: purged_<target>_<time>.csv.gz, or .gob.gz for gob
+func purgeArchivePath(target, format string, now time.Time) string {
+	name := strings.Trim(fileNameUnsafeRegex.ReplaceAllString(target, "_"), "_")
+	ext := ".csv.gz"
+	if format == "gob" {
+		ext = ".gob.gz"
+	}
+	return "purged_" + name + "_" + now.Format("20060102-150405") + ext
+}
+
+// deviceExportPath names the per-device file for deviceID alongside outputFile:
+// readings.csv.gz becomes readings_<serial>.csv.gz
+func deviceExportPath(outputFile, deviceID string) string {
+	var gz string
+	if strings.HasSuffix(outputFile, ".gz") {
+		gz = ".gz"
+		outputFile = strings.TrimSuffix(outputFile, gz)
+	}
+	ext := filepath.Ext(outputFile)
+
+	name := strings.Trim(fileNameUnsafeRegex.ReplaceAllString(deviceID, "_"), "_")
+
+	return strings.TrimSuffix(outputFile, ext) + "_" + name + ext + gz
+}
+
+// exportDataByDevice exports the same readings as exportData, one file per
+// device named by deviceExportPath, and returns the files written
+func (m *MAIDSmartMonitor) exportDataByDevice(outputFile string, since time.Time) ([]string, error) {
+	rows, err := m.db.Query(`
+		SELECT DISTINCT device_id FROM smart_data
+		WHERE timestamp >= ?
+		ORDER BY device_id
+	`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %v", err)
+	}
+	var deviceIDs []string
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan device: %v", err)
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query devices: %v", err)
+	}
+
+	var files []string
+	for _, deviceID := range deviceIDs {
+		file := deviceExportPath(outputFile, deviceID)
+		err := m.exportQuery(file, `
+			SELECT * FROM smart_data
+			WHERE device_id = ? AND timestamp >= ?
+			ORDER BY device, timestamp, attribute_id
+		`, deviceID, since)
+		if err != nil {
+			return files, fmt.Errorf("failed to export %s: %v", deviceID, err)
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// exportQuery writes the smart_data rows selected by query to a CSV file, or
+// to a gob archive when exportFormat is "gob"
+func (m *MAIDSmartMonitor) exportQuery(outputFile, query string, args ...interface{}) error {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query data: %v", err)
+	}
+	defer rows.Close()
+
+	err = writeExportFile(outputFile, func(out io.Writer) error {
+		if m.exportFormat == "gob" {
+			return writeArchive(out, rows)
+		}
+		return m.writeCSV(out, rows)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.logger.Printf("Data exported to %s", outputFile)
+	return nil
+}
+
+// writeExportFile creates outputFile and passes write its contents' writer,
+// gzip-compressing them when outputFile ends in .gz
+func writeExportFile(outputFile string, write func(io.Writer) error) error {
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+	defer file.Close()
+
+	var out io.Writer = file
+	var gz *gzip.Writer
+	if strings.HasSuffix(outputFile, ".gz") {
+		gz = gzip.NewWriter(file)
+		out = gz
+	}
+
+	if err := write(out); err != nil {
+		return err
+	}
+
+	// Close each layer explicitly so a failed write is not mistaken for a
+	// complete (but truncated) export
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to finish compressed output: %v", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %v", err)
+	}
+	return nil
+}
+
+// writeCSV writes rows to out as CSV, with temperatures converted to the
+// display unit in extra columns
+func (m *MAIDSmartMonitor) writeCSV(out io.Writer, rows *sql.Rows) error {
+	writer := csv.NewWriter(out)
+
+	// Write header, with temperatures converted to the display unit in extra columns
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to get columns: %v", err)
+	}
+	attrIDCol, rawValueCol := -1, -1
+	for i, col := range columns {
+		switch col {
+		case "attribute_id":
+			attrIDCol = i
+		case "raw_value":
+			rawValueCol = i
+		}
+	}
+	writer.Write(append(columns, "temperature", "temperature_unit", "temperature_sensor"))
+
+	// Write data
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+
+		record := make([]string, len(columns), len(columns)+3)
+		for i, val := range values {
+			if val != nil {
+				record[i] = fmt.Sprintf("%v", val)
+			}
+		}
+
+		var temperature, unit, sensor string
+		if attrIDCol >= 0 && rawValueCol >= 0 {
+			attrID, _ := values[attrIDCol].(int64)
+			celsius, isInt := values[rawValueCol].(int64)
+			if (attrID == 190 || attrID == 194) && isInt {
+				temperature = fmt.Sprintf("%.1f", m.convertTemperature(celsius))
+				unit = m.tempUnit
+				sensor = temperatureSensor(int(attrID))
+			}
+		}
+		writer.Write(append(record, temperature, unit, sensor))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read rows: %v", err)
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %v", err)
+	}
+	return nil
+}
+
+// exportedAlert is one health_alerts row of an alert export. LastSeen is the
+// last cycle the condition was present and ResolvedAt the reading that no longer
+// raised it, nil while open. Duration runs to ResolvedAt for a resolved alert
+// and to LastSeen otherwise, or for one resolved before resolved_at was added.
+type exportedAlert struct {
+	ID            int64      `json:"id"`
+	Device        string     `json:"device"`
+	DeviceID      string     `json:"device_id"`
+	AttributeName string     `json:"attribute_name"`
+	AlertType     string     `json:"alert_type"`
+	Severity      string     `json:"severity"`
+	Message       string     `json:"message"`
+	FirstSeen     time.Time  `json:"first_seen"`
+	LastSeen      time.Time  `json:"last_seen"`
+	Duration      float64    `json:"duration_seconds"`
+	Resolved      bool       `json:"resolved"`
+	ResolvedAt    *time.Time `json:"resolved_at"`
+	Maintenance   bool       `json:"maintenance"`
+	Suppressed    bool       `json:"suppressed"`
+}
+
+// exportAlerts exports the alerts seen since the given time, oldest first, to
+// CSV or, when exportFormat is "json", a JSON array; gzip-compressed when
+// outputFile ends in .gz. It returns the number of alerts exported.
+func (m *MAIDSmartMonitor) exportAlerts(outputFile string, since time.Time) (int, error) {
+	alerts, err := m.queryAlerts(`timestamp >= ?`, since)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeExportFile(outputFile, func(out io.Writer) error {
+		if m.exportFormat == "json" {
+			if alerts == nil {
+				alerts = []exportedAlert{}
+			}
+			encoder := json.NewEncoder(out)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(alerts); err != nil {
+				return fmt.Errorf("failed to write JSON: %v", err)
+			}
+			return nil
+		}
+		return writeAlertsCSV(out, alerts)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	m.logger.Printf("Alerts exported to %s", outputFile)
+	return len(alerts), nil
+}
+
+// queryAlerts returns the alerts matching the SQL condition, oldest first
+func (m *MAIDSmartMonitor) queryAlerts(condition string, args ...interface{}) ([]exportedAlert, error) {
+	rows, err := m.db.Query(`
+		SELECT id, device, COALESCE(device_id, ''), attribute_name, alert_type, COALESCE(severity, ''),
+			message, first_seen, timestamp, resolved, resolved_at, maintenance, suppressed
+		FROM health_alerts
+		WHERE `+condition+`
+		ORDER BY first_seen, id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query alerts: %v", err)
+	}
+	defer rows.Close()
+
+	var alerts []exportedAlert
+	for rows.Next() {
+		var a exportedAlert
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&a.ID, &a.Device, &a.DeviceID, &a.AttributeName, &a.AlertType, &a.Severity,
+			&a.Message, &a.FirstSeen, &a.LastSeen, &a.Resolved, &resolvedAt, &a.Maintenance, &a.Suppressed); err != nil {
+			return nil, fmt.Errorf("failed to scan alert: %v", err)
+		}
+		a.Duration = a.LastSeen.Sub(a.FirstSeen).Seconds()
+		if resolvedAt.Valid {
+			a.ResolvedAt = &resolvedAt.Time
+			a.Duration = resolvedAt.Time.Sub(a.FirstSeen).Seconds()
+		}
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read alerts: %v", err)
+	}
+	return alerts, nil
+}
+
+// writeAlertsCSV writes alerts to out as CSV, with times in RFC 3339
+func writeAlertsCSV(out io.Writer, alerts []exportedAlert) error {
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"id", "device", "device_id", "attribute_name", "alert_type", "severity", "message",
+		"first_seen", "last_seen", "duration_seconds", "resolved", "resolved_at", "maintenance", "suppressed"})
+	for _, a := range alerts {
+		resolvedAt := ""
+		if a.ResolvedAt != nil {
+			resolvedAt = a.ResolvedAt.Format(time.RFC3339)
+		}
+		writer.Write([]string{
+			strconv.FormatInt(a.ID, 10), a.Device, a.DeviceID, a.AttributeName, a.AlertType, a.Severity, a.Message,
+			a.FirstSeen.Format(time.RFC3339), a.LastSeen.Format(time.RFC3339),
+			strconv.FormatFloat(a.Duration, 'f', 0, 64),
+			strconv.FormatBool(a.Resolved), resolvedAt, strconv.FormatBool(a.Maintenance), strconv.FormatBool(a.Suppressed),
+		})
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %v", err)
+	}
+	return nil
+}
+
+// archiveFormat and archiveVersion identify a gob archive; the version is
+// raised only when a field of archiveRecord is removed or changes type
+const (
+	archiveFormat  = "maid-smart-monitor/smart_data"
+	archiveVersion = 1
+)
+
+// archiveHeader is the first value of a gob archive
+type archiveHeader struct {
+	Format   string
+	Version  int
+	Exported time.Time
+}
+
+// archiveRecord is one smart_data row of a gob archive. The row's id is not
+// archived; imported rows are numbered by the importing database.
+type archiveRecord struct {
+	Device            string
+	SerialNumber      sql.NullString
+	Model             sql.NullString
+	Timestamp         time.Time
+	AttributeID       int64
+	AttributeName     string
+	RawValue          sql.NullInt64
+	NormalizedValue   sql.NullInt64
+	Threshold         sql.NullInt64
+	WorstValue        sql.NullInt64
+	Flags             sql.NullString
+	Prefailure        sql.NullBool
+	UpdatedOnline     sql.NullBool
+	TempMin           sql.NullInt64
+	TempMax           sql.NullInt64
+	OfflineStatus     sql.NullString
+	Stale             sql.NullBool
+	SmartctlVersion   sql.NullString
+	JSONFormatVersion sql.NullString
+	DeviceID          sql.NullString
+}
+
+// writeArchive writes rows of smart_data (selected with SELECT *) to out as a
+// gob stream: an archiveHeader followed by one archiveRecord per row
+func writeArchive(out io.Writer, rows *sql.Rows) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to get columns: %v", err)
+	}
+
+	var record archiveRecord
+	fields := map[string]interface{}{
+		"device":              &record.Device,
+		"serial_number":       &record.SerialNumber,
+		"model":               &record.Model,
+		"timestamp":           &record.Timestamp,
+		"attribute_id":        &record.AttributeID,
+		"attribute_name":      &record.AttributeName,
+		"raw_value":           &record.RawValue,
+		"normalized_value":    &record.NormalizedValue,
+		"threshold":           &record.Threshold,
+		"worst_value":         &record.WorstValue,
+		"flags":               &record.Flags,
+		"prefailure":          &record.Prefailure,
+		"updated_online":      &record.UpdatedOnline,
+		"temp_min":            &record.TempMin,
+		"temp_max":            &record.TempMax,
+		"offline_status":      &record.OfflineStatus,
+		"stale":               &record.Stale,
+		"smartctl_version":    &record.SmartctlVersion,
+		"json_format_version": &record.JSONFormatVersion,
+		"device_id":           &record.DeviceID,
+	}
+	valuePtrs := make([]interface{}, len(columns))
+	for i, col := range columns {
+		if ptr, ok := fields[col]; ok {
+			valuePtrs[i] = ptr
+		} else {
+			valuePtrs[i] = new(interface{})
+		}
+	}
+
+	enc := gob.NewEncoder(out)
+	if err := enc.Encode(archiveHeader{Format: archiveFormat, Version: archiveVersion, Exported: time.Now().UTC()}); err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	for rows.Next() {
+		record = archiveRecord{}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		if err := enc.Encode(&record); err != nil {
+			return fmt.Errorf("failed to write archive: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read rows: %v", err)
+	}
+	return nil
+}
+
+// importArchive stores the readings of a gob archive written by -export-format
+// gob (gzip-compressed if the name ends in .gz) and returns how many were new
+func (m *MAIDSmartMonitor) importArchive(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var in io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read compressed archive: %v", err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	dec := gob.NewDecoder(in)
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil || header.Format != archiveFormat {
+		return 0, fmt.Errorf("not a smart_data archive")
+	}
+	if header.Version > archiveVersion {
+		return 0, fmt.Errorf("archive version %d is newer than this build reads (%d)", header.Version, archiveVersion)
+	}
+
+	var imported int64
+	err = m.writes.do("import", func() error {
+		tx, err := m.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		stmt, err := tx.Prepare(`
+			INSERT OR IGNORE INTO smart_data
+			(device, serial_number, model, timestamp, attribute_id, attribute_name,
+			 raw_value, normalized_value, threshold, worst_value, flags, prefailure,
+			 updated_online, temp_min, temp_max, offline_status, stale,
+			 smartctl_version, json_format_version, device_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %v", err)
+		}
+		defer stmt.Close()
+
+		for {
+			// gob leaves fields that were zero when encoded untouched, so
+			// each record starts empty
+			var r archiveRecord
+			if err := dec.Decode(&r); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to read archive: %v", err)
+			}
+			result, err := stmt.Exec(r.Device, r.SerialNumber, r.Model, r.Timestamp, r.AttributeID, r.AttributeName,
+				r.RawValue, r.NormalizedValue, r.Threshold, r.WorstValue, r.Flags, r.Prefailure,
+				r.UpdatedOnline, r.TempMin, r.TempMax, r.OfflineStatus, r.Stale,
+				r.SmartctlVersion, r.JSONFormatVersion, r.DeviceID)
+			if err != nil {
+				return fmt.Errorf("failed to insert reading: %v", err)
+			}
+			n, _ := result.RowsAffected()
+			imported += n
+		}
+
+		return tx.Commit()
+	})
+	return imported, err
+}
+
+// rawArchivePath is the file the JSON of deviceID read at t is appended to:
+// <dir>/<device ID>/<YYYY-MM-DD>.json.gz, so each drive's archive rotates daily
+func rawArchivePath(dir, deviceID string, t time.Time) string {
+	name := strings.Trim(fileNameUnsafeRegex.ReplaceAllString(deviceID, "_"), "_")
+	return filepath.Join(dir, name, t.Format("2006-01-02")+".json.gz")
+}
+
+// archiveRawJSON appends raw, the smartctl output info's drive returned at t, to
+// its archive file as a gzip member of its own, and indexes the member's offset
+// and length in raw_archive. The file stays readable with zcat, while a lookup
+// decompresses only the one reading.
+func (m *MAIDSmartMonitor) archiveRawJSON(info *DeviceInfo, raw []byte, t time.Time) error {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var member bytes.Buffer
+	gz := gzip.NewWriter(&member)
+	if _, err := gz.Write(raw); err != nil {
+		return fmt.Errorf("failed to compress: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress: %v", err)
+	}
+
+	path := rawArchivePath(m.rawArchiveDir, info.ID(), t)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat archive: %v", err)
+	}
+	if _, err := file.Write(member.Bytes()); err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+
+	return m.writes.do("raw archive index", func() error {
+		_, err := m.db.Exec(`
+			INSERT INTO raw_archive (device_id, device, timestamp, archive_path, offset, length)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, info.ID(), info.Device, t, path, stat.Size(), member.Len())
+		return err
+	})
+}
+
+// rawArchiveEntry locates one archived smartctl output
+type rawArchiveEntry struct {
+	DeviceID    string
+	Device      string
+	Timestamp   time.Time
+	ArchivePath string
+	Offset      int64
+	Length      int64
+}
+
+// findRawArchive returns the latest archived smartctl output of the drive target
+// refers to (a device_id, serial number or /dev path) read at or before at
+func (m *MAIDSmartMonitor) findRawArchive(target string, at time.Time) (*rawArchiveEntry, []byte, error) {
+	ids, err := m.resolveDeviceIDs(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A drive whose readings were all kept in the archive only is still found
+	ids = append(ids, target)
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, 0, len(ids)+1)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, at)
+
+	var entry rawArchiveEntry
+	err = m.db.QueryRow(`
+		SELECT device_id, device, timestamp, archive_path, offset, length FROM raw_archive
+		WHERE device_id IN (`+placeholders+`) AND timestamp <= ?
+		ORDER BY timestamp DESC LIMIT 1
+	`, args...).Scan(&entry.DeviceID, &entry.Device, &entry.Timestamp, &entry.ArchivePath, &entry.Offset, &entry.Length)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("no archived reading of %s at or before %s", target, at.Format(time.RFC3339))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query archive index: %v", err)
+	}
+
+	file, err := os.Open(entry.ArchivePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(io.NewSectionReader(file, entry.Offset, entry.Length))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s at offset %d: %v", entry.ArchivePath, entry.Offset, err)
+	}
+	defer gz.Close()
+	raw, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s at offset %d: %v", entry.ArchivePath, entry.Offset, err)
+	}
+
+	return &entry, raw, nil
+}
+
+// Build information, injected at build time with e.g.
+// -ldflags "-X main.buildVersion=1.4.0 -X main.buildCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	buildVersion = "dev"
+	buildCommit  = "unknown"
+	buildDate    = "unknown"
+)
+
+// printVersion writes the monitor's build information and the version of the
+// smartctl it would run, for bug reports and for auditing what each host runs
+func printVersion(w io.Writer, runner smartctlRunner) {
+	fmt.Fprintf(w, "maid-smart-monitor %s\n", buildVersion)
+	fmt.Fprintf(w, "  commit:   %s\n", buildCommit)
+	fmt.Fprintf(w, "  built:    %s\n", buildDate)
+	fmt.Fprintf(w, "  go:       %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+
+	smartctl := "not found in PATH"
+	if r, ok := runner.(execRunner); ok && len(r.prefix) > 0 {
+		// smartctl may only be in the PATH the prefix runs it with, e.g. sudo's secure_path
+		via := strings.Join(r.prefix, " ")
+		output, err := runner.Run("--version")
+		if line := strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0]; line != "" {
+			smartctl = line + " via " + via
+		} else {
+			smartctl = fmt.Sprintf("%s smartctl failed to report its version: %v", via, err)
+		}
+	} else if path, err := exec.LookPath("smartctl"); err == nil {
+		output, err := runner.Run("--version")
+		if line := strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0]; line != "" {
+			smartctl = line + " at " + path
+		} else {
+			smartctl = fmt.Sprintf("%s failed to report its version: %v", path, err)
+		}
+	}
+	fmt.Fprintf(w, "  smartctl: %s\n", smartctl)
+}
+
+func main() {
+	var (
+		dbPath   = flag.String("db", "maid_smart_data.db", "Database file path")
+		lockFile = flag.String("lock-file", "", "Lock file that keeps a second daemon off the same database (default: the database path plus .lock)")
+		interval = flag.Int("interval", 300, "Monitoring interval in seconds")
+		daemon   = flag.Bool("daemon", false, "Run as daemon")
+		cycles   = flag.Int("cycles", 1, "Without -daemon, run this many cycles -interval seconds apart, then exit")
+		export   = flag.String("export", "", "Export data to CSV file (gzip-compressed if it ends in .gz)")
+		compress = flag.Bool("compress", false, "Gzip-compress the export, appending .gz to the file name")
+		split    = flag.Bool("export-split-by-device", false, "Write the export as one file per device, <name>_<serial>.csv, instead of one file")
+		format   = flag.String("export-format", "csv", "Format of -export and -archive-before-purge: csv, or gob for a compact archive readable by -import-archive; of -export-alerts: csv or json")
+		alertsTo = flag.String("export-alerts", "", "Export the alerts seen within -since to this CSV or JSON file (gzip-compressed if it ends in .gz)")
+		summary  = flag.Bool("summary", false, "Show health summary")
+		sumJSON  = flag.Bool("summary-json", false, "Show the health summary and device details as JSON (also applies to -fleet)")
+		fleet    = flag.String("fleet", "", "Show a combined health summary of every database matching this glob, e.g. '/srv/smart/*.db'")
+		diff     = flag.Bool("diff", false, "Show attributes that changed between the last two readings of each drive")
+		history  = flag.String("history", "", "Show the stored values of one attribute of a drive serial or device path over time")
+		histAttr = flag.Int("attr", 194, "Attribute ID for -history")
+		histDays = flag.Int("days", 7, "Days of history for -history")
+		spark    = flag.Bool("sparkline", false, "Show -history as one sparkline instead of a value per reading")
+		digest   = flag.Bool("digest", false, "Show the daily digest: new and cleared alerts, hottest drives, critical attribute changes and the alert trend over the last 24h")
+		digestAs = flag.String("digest-format", "text", "Format of the digest: text, html or json")
+		digestTo = flag.Bool("digest-notify", false, "Send -digest through the configured notifiers instead of printing it")
+		digestAt = flag.String("digest-at", "", "In daemon mode, send the digest through the notifiers every day at this local time, e.g. 08:00")
+		socket   = flag.String("socket-path", "", "Serve status/summary JSON on this Unix socket (daemon mode)")
+		apiAddr  = flag.String("api-listen", "", "Serve the JSON API on this address, e.g. 9100, [::1]:9100, 0.0.0.0:9100 (daemon mode)")
+		apiToken = flag.String("api-token", os.Getenv("MAID_SMART_API_TOKEN"), "Require this bearer token for API requests (default $MAID_SMART_API_TOKEN)")
+		tempUnit = flag.String("temp-unit", "C", "Temperature unit for display and export: C or F")
+		analyze  = flag.Bool("analyze", false, "Replay stored data through the alert rules without persisting alerts")
+		from     = flag.String("from", "", "Start of the -analyze window (YYYY-MM-DD or RFC 3339, default: all history)")
+		to       = flag.String("to", "", "End of the -analyze window (YYYY-MM-DD or RFC 3339, default: now)")
+		since    = flag.String("since", "", "Relative window for -export (default 30d) or start of the -analyze window, e.g. 48h, 3d, 2w")
+		addNote  = flag.String("add-note", "", "Attach a note to a drive serial: -add-note SERIAL \"text\"")
+		listNote = flag.String("list-notes", "", "List notes for a drive serial")
+
+		purge   = flag.String("purge-device", "", "Delete all records of a drive, by serial or device path")
+		archive = flag.Bool("archive-before-purge", false, "Export the drive's readings to purged_<drive>_<time>.csv.gz (.gob.gz with -export-format gob) in the current directory before -purge-device")
+
+		importSmartd  = flag.String("import-smartd", "", "Import smartd attribute logs (smartd -A) from this file or directory, e.g. "+defaultSmartdLogDir)
+		importArchive = flag.String("import-archive", "", "Import readings from an -export-format gob archive")
+
+		rawArchiveDir = flag.String("raw-archive-dir", "", "Keep each drive's smartctl JSON output under this directory, one gzip file per drive and day, indexed in the database")
+		findArchive   = flag.String("find-archive", "", "Print the archived smartctl JSON of a drive serial or device path, read at or before -at")
+		findAt        = flag.String("at", "", "Time for -find-archive (YYYY-MM-DD, \"YYYY-MM-DD HH:MM:SS\" or RFC 3339, default: now)")
+
+		maintOn     = flag.Duration("maintenance-on", 0, "Start a maintenance window of this length; alerts are recorded but not notified")
+		maintOff    = flag.Bool("maintenance-off", false, "End the open maintenance window")
+		maintDevice = flag.String("maintenance-device", "", "Limit -maintenance-on/-off to a device path or serial (default: whole host)")
+		maintReason = flag.String("maintenance-reason", "", "Reason recorded with -maintenance-on")
+
+		suppress       = flag.String("suppress", "", "Accept a known condition of a drive: record its alerts as suppressed and never notify them, e.g. WD-WCC4E1234567:Reallocated_Sector_Ct or SERIAL:REALLOCATED_COUNT")
+		suppressReason = flag.String("suppress-reason", "", "Reason recorded with -suppress")
+		unsuppress     = flag.String("unsuppress", "", "Remove a -suppress suppression, given the same SERIAL:MATCH")
+
+		escalateWarn     = flag.Duration("escalate-warn", 24*time.Hour, "Escalate unresolved alerts to WARN after this long (0 disables)")
+		escalateCritical = flag.Duration("escalate-critical", 7*24*time.Hour, "Escalate unresolved alerts to CRITICAL after this long (0 disables)")
+
+		reallocWindow  = flag.Duration("reallocation-window", 24*time.Hour, "Window for the reallocation rate check (0 disables)")
+		reallocLimit   = flag.Int64("reallocation-limit", 10, "Alert when sectors 5/196/197 grow by more than this within the window")
+		uncorrWindow   = flag.Duration("uncorrectable-window", 7*24*time.Hour, "Window for the attribute 187 trend check (0 disables)")
+		uncorrIncr     = flag.Int("uncorrectable-increases", 3, "Raise PREDICTED_FAILURE when attribute 187 rises in this many readings within the window (0 disables)")
+		classifyMedia  = flag.Bool("classify-media", true, "Skip mechanical attributes on SSDs and SSD wear attributes on HDDs, classified by the rotation rate smartctl -i reports")
+		collectAll     = flag.Bool("collect-all", false, "Store every attribute drives report, naming ones smartctl does not know Attribute_<id>, instead of only the monitored set")
+		profiles       = flag.String("model-profiles", "", "JSON file of drive model profiles (rated temperature and attribute limits), checked before the built-in ones")
+		criticalIDs    = flag.String("critical-attributes", "5,187,196,197,198", "Attribute IDs that raise CRITICAL_VALUE when their raw value is nonzero")
+		ignoreStale    = flag.Bool("ignore-stale", false, "Skip threshold alerts for offline-only attributes while offline data collection has not completed")
+		replacePOH     = flag.Int64("replace-poh", defaultReplacementCriteria.powerOnHours, "Recommend replacing drives with more power-on hours than this in the summary (0 disables)")
+		replaceRealloc = flag.Int64("replace-reallocated", defaultReplacementCriteria.reallocated, "Recommend replacing drives with more reallocated sectors than this in the summary (0 disables)")
+		replaceSSDLife = flag.Int("replace-ssd-life", defaultReplacementCriteria.ssdLife, "Recommend replacing SSDs with less than this percent of rated life left in the summary (0 disables)")
+		reallocated    = flag.Int64("reallocated-limit", 0, "Alert when attribute 5's raw reallocated sector count exceeds this, regardless of its normalized value (0 disables)")
+		errorRateDrop  = flag.Int("error-rate-decline", 30, "Alert when the normalized value of attribute 1 or 7 falls this far below its install baseline (0 disables)")
+		maxStandby     = flag.Duration("max-standby", 0, "Alert when a device in standby has not been seen spinning for longer than this, e.g. 336h (0 disables)")
+		margin         = flag.Int("threshold-margin", 0, "Raise a WARN alert when a normalized value comes within this much of its threshold (0 disables)")
+		weightPrefail  = flag.Bool("weight-prefail", false, "Alert on old-age attributes (prefail flag clear) at their threshold as WARN OLD_AGE_THRESHOLD instead of CRITICAL THRESHOLD_VIOLATION")
+		oldAgeMargin   = flag.Int("oldage-threshold-margin", 0, "With -weight-prefail, raise an INFO alert when an old-age attribute comes within this much of its threshold (0 disables)")
+
+		retentionDays = flag.Int("retention-days", 0, "Delete readings older than this many days (0 keeps everything)")
+		alertDays     = flag.Int("alert-retention-days", 0, "Delete resolved alerts last seen more than this many days ago; open alerts are kept (0 keeps everything)")
+		devstat       = flag.Bool("devstat", true, "Also collect the vendor-neutral device statistics log (smartctl -l devstat)")
+		health        = flag.Bool("health", true, "Also read each drive's overall-health self-assessment (smartctl -H) and alert on FAILED")
+		minFreeMB     = flag.Uint64("min-free-mb", 100, "Prune early, then stop storing, below this much free space on the database filesystem (0 disables)")
+
+		jitter    = flag.Duration("jitter", 0, "Delay each daemon cycle start by a random amount up to this (at most half the interval)")
+		stagger   = flag.Duration("stagger", 0, "Pause a random amount up to this between devices within a cycle")
+		parallel  = flag.Int("parallel", 1, "Number of devices read at the same time within a cycle")
+		spindles  = flag.Int("max-active-spindles", 0, "Most spinning drives read at the same time, whatever -parallel is (0 for no limit)")
+		pollOrder = flag.String("poll-order", "active-first", "Order devices are polled in: active-first (spinning drives before standby ones) or discovery")
+
+		bufferSize = flag.Int("buffer-size", 500, "Readings kept in memory for retry while the database is unavailable (0 disables)")
+
+		maxBackoff = flag.Int("max-backoff-cycles", 32, "Skip a device whose collection keeps failing for up to this many cycles between retries (0 disables)")
+
+		adaptiveWarm = flag.Int("adaptive-warm", 0, "In daemon mode, poll drives at or above this temperature in °C every -adaptive-min instead of every -interval (0 disables adaptive polling)")
+		adaptiveCool = flag.Int("adaptive-cool", 0, "With -adaptive-warm, poll drives at or below this temperature in °C every -adaptive-max (0 disables)")
+		adaptiveMin  = flag.Duration("adaptive-min", time.Minute, "Shortest poll interval for drives at or above -adaptive-warm")
+		adaptiveMax  = flag.Duration("adaptive-max", time.Hour, "Longest poll interval for drives at or below -adaptive-cool")
+
+		storeOnChangeOnly = flag.Bool("store-on-change-only", false, "Store an attribute only when its value differs from the last stored value, or the last row is older than -store-heartbeat")
+		storeHeartbeat    = flag.Duration("store-heartbeat", time.Hour, "With -store-on-change-only, store unchanged attributes at least this often")
+
+		dbJournalMode = flag.String("db-journal-mode", defaultDBDurability.journalMode, "SQLite journal mode: DELETE, or WAL so readers do not block the writer")
+		dbSynchronous = flag.String("db-synchronous", defaultDBDurability.synchronous, "SQLite synchronous setting: FULL, NORMAL (may lose the last commits on power loss with WAL) or OFF (may corrupt the database on power loss)")
+
+		hashChain   = flag.Bool("hash-chain", false, "Record a hash of each cycle's readings, chained to the previous cycle, in cycle_log")
+		verifyChain = flag.Bool("verify-chain", false, "Recompute the cycle_log hash chain from stored readings and report any tampering")
+
+		pagerDutyKey   = flag.String("pagerduty-routing-key", "", "Trigger PagerDuty incidents for CRITICAL alerts via the Events API v2 with this integration routing key")
+		alertTemplates = flag.String("alert-templates", "", "JSON file of text/template alert messages by alert type, or \"default\" for all others")
+		slotMap        = flag.String("slot-map", "", "JSON file mapping physical bays to drive serials or /dev paths, e.g. {\"7\": \"WD-WCC4E1234567\"}")
+		alertHook      = flag.String("alert-hook", "", "Run this executable for each alert, with the alert in arguments, MAID_ALERT_* variables and as JSON on stdin")
+		hookTimeout    = flag.Duration("alert-hook-timeout", 30*time.Second, "Kill an -alert-hook run that takes longer than this")
+		testNotify     = flag.Bool("test-notify", false, "Send a synthetic alert through every configured notifier and report the results")
+		setup          = flag.Bool("setup", false, "Interactively check smartctl and drive access, choose basic settings and write them to an environment file for the systemd unit")
+		testAccess     = flag.Bool("selftest-access", false, "Check that smartctl can identify every discovered and -devices drive, report a pass/fail table and exit")
+		showVersion    = flag.Bool("version", false, "Print the version, commit and build date, and the detected smartctl version, then exit")
+
+		attributesMode = flag.String("attributes", "on", "on, or off to never read SMART attributes and take temperatures from hwmon (drivetemp)")
+
+		collectorNames  = flag.String("collectors", "smartctl", "Comma-separated collectors to run each cycle: smartctl (built in) and names from -collector-config")
+		collectorConfig = flag.String("collector-config", "", "JSON file of external command collectors, e.g. wrappers around nvme-cli or storcli")
+
+		discovery    = flag.String("discovery", "", "How drives are found: mounts (Linux default) or scan (smartctl --scan, Windows default; needed to see locked drives)")
+		deviceTypes  = flag.String("device-types", "", "smartctl -d types by device path pattern, first match wins, e.g. '/dev/sd[a-x]=sat,/dev/sg*=scsi'")
+		cmdPrefix    = flag.String("command-prefix", "", "Run smartctl through this command, e.g. 'sudo -n', so the monitor itself can run unprivileged")
+		extraDevices = flag.String("devices", "", "Also monitor these comma-separated devices, mounted or not, e.g. /dev/sdc,/dev/sg4,/dev/bsg/6:0:3:0")
+
+		logLevelName = flag.String("log-level", "info", "Least severe messages to log: debug, info, warn or error; errors and alerts always print")
+		quiet        = flag.Bool("quiet", false, "Log only warnings, errors and alerts (same as -log-level=warn)")
+
+		inputDir = flag.String("input-dir", "", "Read pre-captured smartctl -x --json output (<dir>/sda.json for /dev/sda) instead of running smartctl")
+	)
+	// URLs may contain commas, so each is given with a -webhook-url of its own
+	var webhookURLs repeatedFlag
+	flag.Var(&webhookURLs, "webhook-url", "POST health alerts as JSON to this URL; repeat for several, and prefix one with SEVERITY= to send it only alerts at or above that severity")
+	flag.Parse()
+
+	runner := execRunner{prefix: strings.Fields(*cmdPrefix)}
+	if *showVersion {
+		printVersion(os.Stdout, runner)
+		return
+	}
+
+	*tempUnit = strings.ToUpper(*tempUnit)
+	if !validTempUnit(*tempUnit) {
+		log.Fatalf("Invalid -temp-unit %q: must be C or F", *tempUnit)
+	}
+	if *format != "csv" && *format != "gob" && *format != "json" {
+		log.Fatalf("Invalid -export-format %q: must be csv, gob or json", *format)
+	}
+	if *interval < 1 {
+		log.Fatalf("Invalid -interval %d: must be at least 1 second", *interval)
+	}
+	if *cycles < 1 {
+		log.Fatalf("Invalid -cycles %d: must be at least 1", *cycles)
+	}
+	if *cycles > 1 && *daemon {
+		log.Fatalf("Invalid -cycles %d: -daemon runs until stopped, -cycles only applies without it", *cycles)
+	}
+	if *digestAs != "text" && *digestAs != "html" && *digestAs != "json" {
+		log.Fatalf("Invalid -digest-format %q: must be text, html or json", *digestAs)
+	}
+	if *digestAt != "" && !*daemon {
+		log.Fatalf("Invalid -digest-at: only the daemon sends scheduled digests; run -digest -digest-notify from cron instead")
+	}
+	var digestClock time.Time
+	if *digestAt != "" {
+		clock, err := time.Parse("15:04", *digestAt)
+		if err != nil {
+			log.Fatalf("Invalid -digest-at %q: must be a time of day such as 08:00", *digestAt)
+		}
+		digestClock = clock
+	}
+
+	if *quiet {
+		*logLevelName = "warn"
+	}
+	level, ok := logLevels[*logLevelName]
+	if !ok {
+		log.Fatalf("Invalid -log-level %q: must be debug, info, warn or error", *logLevelName)
+	}
+	logLevel = level
+
+	if *fleet != "" {
+		combined, err := getFleetSummary(*fleet, *tempUnit)
+		if err != nil {
+			log.Fatalf("Failed to get fleet summary: %v", err)
+		}
+
+		if *sumJSON {
+			combined["schema_version"] = summarySchemaVersion
+			if err := printJSON(combined); err != nil {
+				log.Fatalf("Failed to write fleet summary: %v", err)
+			}
+			return
+		}
+
+		fmt.Println("MAID SMART Fleet Summary:")
+		fmt.Printf("Hosts: %v\n", combined["total_hosts"])
+		fmt.Printf("Total devices: %v\n", combined["total_devices"])
+		fmt.Printf("Devices with alerts: %v\n", combined["devices_with_alerts"])
+
+		hosts := combined["hosts"].(map[string]interface{})
+		names := make([]string, 0, len(hosts))
+		for host := range hosts {
+			names = append(names, host)
+		}
+		sort.Strings(names)
+		for _, host := range names {
+			summary := hosts[host].(map[string]interface{})
+			fmt.Printf("  %s: %v devices, %v with alerts\n", host, summary["total_devices"], summary["devices_with_alerts"])
+			alerts := summary["alerts_by_device"].(map[string]int)
+			devices := make([]string, 0, len(alerts))
+			for device := range alerts {
+				devices = append(devices, device)
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				fmt.Printf("    %s: %d alerts\n", device, alerts[device])
+			}
+		}
+
+		if errs := combined["errors"].(map[string]string); len(errs) > 0 {
+			fmt.Println("Unreadable databases:")
+			names = names[:0]
+			for host := range errs {
+				names = append(names, host)
+			}
+			sort.Strings(names)
+			for _, host := range names {
+				fmt.Printf("  %s: %s\n", host, errs[host])
+			}
+		}
+		return
+	}
+
+	durability, err := parseDBDurability(*dbJournalMode, *dbSynchronous)
+	if err != nil {
+		log.Fatalf("Invalid %v", err)
+	}
+	monitor, err := NewMAIDSmartMonitor(*dbPath, durability)
+	if err != nil {
+		log.Fatalf("Failed to create monitor: %v", err)
+	}
+	defer monitor.Close()
+	monitor.runner = runner
+	monitor.discovery = defaultDiscoverer(runner)
+
+	critical, err := parseAttributeIDs(*criticalIDs)
+	if err != nil {
+		log.Fatalf("Invalid -critical-attributes: %v", err)
+	}
+	for id := range critical {
+		if _, ok := monitor.targetAttribs[id]; !ok && !*collectAll {
+			monitor.warnLogger.Printf("Critical attribute %d is not a monitored attribute and will never alert", id)
+		}
+	}
+	monitor.criticalAttrs = critical
+	monitor.classifyMedia = *classifyMedia
+	monitor.collectAll = *collectAll
+	monitor.rawArchiveDir = *rawArchiveDir
+	if *profiles != "" {
+		custom, err := loadModelProfiles(*profiles)
+		if err != nil {
+			log.Fatalf("Invalid -model-profiles: %v", err)
+		}
+		monitor.modelProfiles = append(custom, builtinModelProfiles...)
+	}
+	monitor.thresholdMargin = *margin
+	monitor.weightPrefail = *weightPrefail
+	monitor.oldAgeMargin = *oldAgeMargin
+	monitor.ignoreStale = *ignoreStale
+	monitor.reallocatedLimit = *reallocated
+	monitor.errorRateDecline = *errorRateDrop
+	monitor.replacement = replacementCriteria{powerOnHours: *replacePOH, reallocated: *replaceRealloc, ssdLife: *replaceSSDLife}
+	monitor.maxStandby = *maxStandby
+
+	monitor.escalateWarnAfter = *escalateWarn
+	monitor.escalateCriticalAfter = *escalateCritical
+	monitor.reallocationWindow = *reallocWindow
+	monitor.reallocationLimit = *reallocLimit
+	monitor.uncorrectableWindow = *uncorrWindow
+	monitor.uncorrectableIncreases = *uncorrIncr
+	monitor.retention = time.Duration(*retentionDays) * 24 * time.Hour
+	monitor.alertRetention = time.Duration(*alertDays) * 24 * time.Hour
+	monitor.minFreeBytes = *minFreeMB << 20
+	monitor.collectDevstat = *devstat
+	monitor.collectHealth = *health
+	monitor.deviceStagger = *stagger
+	if *parallel < 1 {
+		log.Fatalf("Invalid -parallel %d: must be at least 1", *parallel)
+	}
+	monitor.parallel = *parallel
+	if *spindles < 0 {
+		log.Fatalf("Invalid -max-active-spindles %d: must be 0 (no limit) or more", *spindles)
+	}
+	if *spindles > 0 {
+		monitor.spindles = make(chan struct{}, *spindles)
+	}
+	if *pollOrder != "active-first" && *pollOrder != "discovery" {
+		log.Fatalf("Invalid -poll-order %q: must be active-first or discovery", *pollOrder)
+	}
+	monitor.pollOrder = *pollOrder
+	monitor.inputDir = *inputDir
+	rules, err := parseDeviceTypes(*deviceTypes)
+	if err != nil {
+		log.Fatalf("Invalid -device-types: %v", err)
+	}
+	monitor.runner = typedRunner{runner: monitor.runner, rules: rules, detected: &monitor.usbTypes}
+	switch *discovery {
+	case "":
+	case "mounts":
+		monitor.discovery = mountsDiscoverer{path: "/proc/mounts"}
+	case "scan":
+		monitor.discovery = scanDiscoverer{runner: monitor.runner, physicalDrives: runtime.GOOS == "windows"}
+	default:
+		log.Fatalf("Invalid -discovery %q: must be mounts or scan", *discovery)
+	}
+	for _, device := range strings.Split(*extraDevices, ",") {
+		if device = strings.TrimSpace(device); device != "" {
+			monitor.extraDevices = append(monitor.extraDevices, device)
+		}
+	}
+	switch *attributesMode {
+	case "on":
+	case "off":
+		monitor.collectAttributes = false
+	default:
+		log.Fatalf("Invalid -attributes %q: must be on or off", *attributesMode)
+	}
+	available := map[string]collector{}
+	if *collectorConfig != "" {
+		if available, err = loadCollectors(*collectorConfig); err != nil {
+			log.Fatalf("Invalid -collector-config: %v", err)
+		}
+	}
+	monitor.collectSmartctl = false
+	for _, name := range strings.Split(*collectorNames, ",") {
+		name = strings.TrimSpace(name)
+		switch c, ok := available[name]; {
+		case name == "":
+		case name == "smartctl":
+			monitor.collectSmartctl = true
+		case ok:
+			monitor.collectors = append(monitor.collectors, c)
+		default:
+			log.Fatalf("Invalid -collectors: unknown collector %q (define it in -collector-config)", name)
+		}
+	}
+	if !monitor.collectSmartctl && len(monitor.collectors) == 0 {
+		log.Fatalf("Invalid -collectors %q: no collector enabled", *collectorNames)
+	}
+	monitor.maxBuffered = *bufferSize
+	monitor.maxBackoffCycles = *maxBackoff
+	if *adaptiveWarm > 0 {
+		period := time.Duration(*interval) * time.Second
+		if *adaptiveCool >= *adaptiveWarm {
+			log.Fatalf("Invalid -adaptive-cool %d: must be below -adaptive-warm %d", *adaptiveCool, *adaptiveWarm)
+		}
+		if *adaptiveMin <= 0 || *adaptiveMin > period {
+			log.Fatalf("Invalid -adaptive-min %v: must be positive and at most the %v interval", *adaptiveMin, period)
+		}
+		if *adaptiveMax < period {
+			log.Fatalf("Invalid -adaptive-max %v: must be at least the %v interval", *adaptiveMax, period)
+		}
+	}
+	monitor.adaptiveWarm = *adaptiveWarm
+	monitor.adaptiveCool = *adaptiveCool
+	monitor.adaptiveMin = *adaptiveMin
+	monitor.adaptiveMax = *adaptiveMax
+	monitor.pollInterval = time.Duration(*interval) * time.Second
+	monitor.hashChain = *hashChain
+	monitor.storeOnChangeOnly = *storeOnChangeOnly
+	monitor.storeHeartbeat = *storeHeartbeat
+
+	if *alertTemplates != "" {
+		if monitor.alertTemplates, err = loadAlertTemplates(*alertTemplates); err != nil {
+			log.Fatalf("Invalid -alert-templates: %v", err)
+		}
+	}
+	if *slotMap != "" {
+		if monitor.slotMap, err = loadSlotMap(*slotMap); err != nil {
+			log.Fatalf("Invalid -slot-map: %v", err)
+		}
+	}
+	webhooks, err := parseWebhookURLs(webhookURLs)
+	if err != nil {
+		log.Fatalf("Invalid -webhook-url: %v", err)
+	}
+	monitor.notifiers = append(monitor.notifiers, webhooks...)
+	if *pagerDutyKey != "" {
+		monitor.notifiers = append(monitor.notifiers,
+			severityNotifier{Notifier: newPagerDutyNotifier(*pagerDutyKey), minSeverity: SeverityCritical})
+	}
+	if *alertHook != "" {
+		path, err := exec.LookPath(*alertHook)
+		if err != nil {
+			log.Fatalf("Invalid -alert-hook: %v", err)
+		}
+		monitor.notifiers = append(monitor.notifiers, hookNotifier{path: path, timeout: *hookTimeout, logger: monitor.logger})
+	}
+
+	monitor.tempUnit = *tempUnit
+	monitor.exportFormat = *format
+
+	if *verifyChain {
+		check, err := monitor.verifyChain()
+		if err != nil {
+			log.Fatalf("Failed to verify cycle log: %v", err)
+		}
+		if len(check.problems) > 0 {
+			fmt.Printf("Cycle log verification FAILED (%d of %d entries):\n", len(check.problems), check.entries)
+			for _, p := range check.problems {
+				fmt.Printf("  %s\n", p)
+			}
+			monitor.Close()
+			os.Exit(1)
+		}
+		fmt.Printf("Cycle log verified: %d entries intact", check.entries)
+		if check.pruned > 0 {
+			fmt.Printf(", %d cycles with pruned readings checked for their chain link only", check.pruned)
+		}
+		fmt.Println()
+		return
+	}
+
+	if *testNotify {
+		results := monitor.testNotifiers()
+		failed := false
+		fmt.Println("Test notification:")
+		for _, n := range monitor.notifiers {
+			if err := results[n.Name()]; err != nil {
+				fmt.Printf("  %s: FAILED: %v\n", n.Name(), err)
+				failed = true
+			} else {
+				fmt.Printf("  %s: OK\n", n.Name())
+			}
+		}
+		if failed {
+			monitor.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *testAccess {
+		results, err := monitor.checkDeviceAccess()
+		if err != nil {
+			log.Fatalf("Failed to check device access: %v", err)
+		}
+
+		if failed := printDeviceAccess(os.Stdout, results); failed > 0 {
+			fmt.Printf("%d of %d devices unreachable\n", failed, len(results))
+			monitor.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *setup {
+		err := monitor.runSetup(os.Stdin, os.Stdout)
+		monitor.Close()
+		if err != nil {
+			log.Fatalf("Setup failed: %v", err)
+		}
+		return
+	}
+
+	window := 30 * 24 * time.Hour
+	if *since != "" {
+		if window, err = parseSince(*since); err != nil {
+			log.Fatalf("Invalid -since: %v", err)
+		}
+	}
+
+	if *alertsTo != "" {
+		if *format == "gob" {
+			log.Fatalf("Invalid -export-format gob for -export-alerts: must be csv or json")
+		}
+		if *compress && !strings.HasSuffix(*alertsTo, ".gz") {
+			*alertsTo += ".gz"
+		}
+		n, err := monitor.exportAlerts(*alertsTo, time.Now().Add(-window))
+		if err != nil {
+			log.Fatalf("Failed to export alerts: %v", err)
+		}
+		fmt.Printf("Exported %d alerts\n", n)
+		return
+	}
+
+	if *format == "json" && (*export != "" || *archive) {
+		log.Fatalf("Invalid -export-format json: only -export-alerts writes JSON, -export and -archive-before-purge take csv or gob")
+	}
+
+	if *export != "" {
+		if *compress && !strings.HasSuffix(*export, ".gz") {
+			*export += ".gz"
+		}
+		if *split {
+			files, err := monitor.exportDataByDevice(*export, time.Now().Add(-window))
+			if err != nil {
+				log.Fatalf("Failed to export data: %v", err)
+			}
+			fmt.Printf("Exported %d devices\n", len(files))
+			return
+		}
+		if err := monitor.exportData(*export, time.Now().Add(-window)); err != nil {
+			log.Fatalf("Failed to export data: %v", err)
+		}
+		return
+	}
+
+	if *purge != "" {
+		var archiveFile string
+		if *archive {
+			archiveFile = purgeArchivePath(*purge, *format, time.Now())
+		}
+		counts, err := monitor.purgeDevice(*purge, archiveFile)
+		if err != nil {
+			log.Fatalf("Failed to purge %s: %v", *purge, err)
+		}
+		if archiveFile != "" {
+			fmt.Printf("Archived readings to %s\n", archiveFile)
+		}
+		fmt.Printf("Purged %s:\n", *purge)
+		for _, table := range []string{"smart_data", "device_statistics", "health_alerts", "device_status", "device_baselines", "raw_archive"} {
+			fmt.Printf("  %s: %d rows\n", table, counts[table])
+		}
+		fmt.Println("Notes on the drive are kept; see -list-notes")
+		return
+	}
+
+	if *importSmartd != "" {
+		imported, err := monitor.importSmartdLogs(*importSmartd)
+		files := make([]string, 0, len(imported))
+		for file := range imported {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			fmt.Printf("Imported %d readings from %s\n", imported[file], file)
+		}
+		if err != nil {
+			log.Fatalf("Failed to import smartd logs: %v", err)
+		}
+		return
+	}
+
+	if *importArchive != "" {
+		imported, err := monitor.importArchive(*importArchive)
+		if err != nil {
+			log.Fatalf("Failed to import %s: %v", *importArchive, err)
+		}
+		fmt.Printf("Imported %d readings from %s\n", imported, *importArchive)
+		return
+	}
+
+	if *findArchive != "" {
+		at := time.Now()
+		if *findAt != "" {
+			if at, err = parseTimeArg(*findAt); err != nil {
+				log.Fatalf("Invalid -at: %v", err)
+			}
+		}
+		entry, raw, err := monitor.findRawArchive(*findArchive, at)
+		if err != nil {
+			log.Fatalf("Failed to find archived reading: %v", err)
+		}
+		// Only the JSON goes to stdout, so it can be piped to jq
+		fmt.Fprintf(os.Stderr, "%s (%s) read at %s, from %s\n", entry.DeviceID, entry.Device,
+			entry.Timestamp.Format(time.RFC3339), entry.ArchivePath)
+		os.Stdout.Write(raw)
+		return
+	}
+
+	if *suppress != "" {
+		serial, match, err := parseSuppression(*suppress)
+		if err != nil {
+			log.Fatalf("Invalid -suppress: %v", err)
+		}
+		marked, err := monitor.suppressAlerts(serial, match, *suppressReason)
+		if err != nil {
+			log.Fatalf("Failed to suppress alerts: %v", err)
+		}
+		fmt.Printf("Suppressed %s alerts for %s (%d open alerts marked)\n", match, serial, marked)
+		return
+	}
+
+	if *unsuppress != "" {
+		serial, match, err := parseSuppression(*unsuppress)
+		if err != nil {
+			log.Fatalf("Invalid -unsuppress: %v", err)
+		}
+		unmarked, err := monitor.unsuppressAlerts(serial, match)
+		if err != nil {
+			log.Fatalf("Failed to remove suppression: %v", err)
+		}
+		fmt.Printf("Removed suppression of %s alerts for %s (%d open alerts no longer suppressed)\n", match, serial, unmarked)
+		return
+	}
+
+	if *maintOn > 0 {
+		if err := monitor.startMaintenance(*maintDevice, *maintOn, *maintReason); err != nil {
+			log.Fatalf("Failed to start maintenance: %v", err)
+		}
+		target := *maintDevice
+		if target == "" {
+			target = "all devices"
+		}
+		fmt.Printf("Maintenance started for %s until %s\n", target, time.Now().Add(*maintOn).Format("2006-01-02 15:04"))
+		return
+	}
+
+	if *maintOff {
+		ended, err := monitor.endMaintenance(*maintDevice)
+		if err != nil {
+			log.Fatalf("Failed to end maintenance: %v", err)
+		}
+		fmt.Printf("Ended %d maintenance window(s)\n", ended)
+		return
+	}
+
+	if *addNote != "" {
+		note := strings.Join(flag.Args(), " ")
+		if note == "" {
+			log.Fatalf("Usage: -add-note SERIAL \"note text\"")
+		}
+		if err := monitor.addNote(*addNote, note); err != nil {
+			log.Fatalf("Failed to add note: %v", err)
+		}
+		fmt.Printf("Note added for %s\n", *addNote)
+		return
+	}
+
+	if *listNote != "" {
+		notes, err := monitor.listNotes(*listNote)
+		if err != nil {
+			log.Fatalf("Failed to list notes: %v", err)
+		}
+		fmt.Printf("Notes for %s (%d):\n", *listNote, len(notes))
+		for _, n := range notes {
+			fmt.Printf("  %s  %s\n", n["timestamp"].(time.Time).Format("2006-01-02 15:04"), n["note"])
+		}
+		return
+	}
+
+	if *analyze {
+		start, end := time.Time{}, time.Now()
+		if *from != "" && *since != "" {
+			log.Fatalf("Use -from or -since, not both")
+		}
+		if *since != "" {
+			start = end.Add(-window)
+		}
+		if *from != "" {
+			if start, err = parseTimeArg(*from); err != nil {
+				log.Fatalf("Invalid -from: %v", err)
+			}
+		}
+		if *to != "" {
+			if end, err = parseTimeArg(*to); err != nil {
+				log.Fatalf("Invalid -to: %v", err)
+			}
+		}
+
+		replayed, err := monitor.analyzeHistory(start, end)
+		if err != nil {
+			log.Fatalf("Failed to analyze history: %v", err)
+		}
+
+		fmt.Printf("Alerts that would have fired (%d):\n", len(replayed))
+		for _, r := range replayed {
+			fmt.Printf("  [%s] %s %s %s: %s (first %s, last %s, %d readings)\n",
+				r.Severity, r.Device, r.AttributeName, r.AlertType, r.Message,
+				r.FirstSeen.Format("2006-01-02 15:04"), r.Timestamp.Format("2006-01-02 15:04"), r.Occurrences)
+		}
+		return
+	}
+
+	if *digest {
+		if *digestTo {
+			if err := monitor.sendDigest(*digestAs); err != nil {
+				log.Fatalf("Failed to send digest: %v", err)
+			}
+			return
+		}
+		report, err := monitor.buildDigest(time.Now())
+		if err != nil {
+			log.Fatalf("Failed to build digest: %v", err)
+		}
+		if err := writeDigest(os.Stdout, report, *digestAs); err != nil {
+			log.Fatalf("Failed to write digest: %v", err)
+		}
+		return
+	}
+
+	if *history != "" {
+		if *histDays <= 0 {
+			log.Fatalf("Invalid -days %d: must be positive", *histDays)
+		}
+		since := time.Now().AddDate(0, 0, -*histDays)
+		points, name, err := monitor.getAttributeHistory(*history, *histAttr, since)
+		if err != nil {
+			log.Fatalf("Failed to get history: %v", err)
+		}
+		if len(points) == 0 {
+			fmt.Printf("No readings of attribute %d for %s in the last %d days\n", *histAttr, *history, *histDays)
+			return
+		}
+
+		unit := ""
+		if *histAttr == 190 || *histAttr == 194 {
+			unit = "°" + monitor.tempUnit
+		}
+		values := make([]float64, len(points))
+		low, high := points[0].Value, points[0].Value
+		for i, p := range points {
+			values[i] = p.Value
+			low, high = math.Min(low, p.Value), math.Max(high, p.Value)
+		}
+
+		fmt.Printf("%s (%d) of %s, last %d days: %d readings\n", name, *histAttr, *history, *histDays, len(points))
+		if vendorEncodedAttribs[*histAttr] {
+			fmt.Println("  Normalized values; the raw value is vendor-encoded and not a count")
+		}
+		if *spark {
+			fmt.Printf("  %s %s\n", points[0].Time.Format("2006-01-02 15:04"), sparkline(values, 60))
+			fmt.Printf("  min %g%s, max %g%s, last %g%s at %s\n", low, unit, high, unit,
+				values[len(values)-1], unit, points[len(points)-1].Time.Format("2006-01-02 15:04"))
+			return
+		}
+		for _, p := range points {
+			fmt.Printf("  %s  %g%s\n", p.Time.Format("2006-01-02 15:04"), p.Value, unit)
+		}
+		return
+	}
+
+	if *diff {
+		changes, err := monitor.getChangesSinceLastReading()
+		if err != nil {
+			log.Fatalf("Failed to get changes: %v", err)
+		}
+
+		if len(changes) == 0 {
+			fmt.Println("No attribute changes since the previous reading")
+			return
+		}
+
+		devices := make([]string, 0, len(changes))
+		for device := range changes {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+
+		fmt.Println("Changes since previous reading:")
+		for _, device := range devices {
+			attrs := changes[device]
+			fmt.Printf("  %s (%s -> %s):\n", device,
+				attrs[0]["previous_time"].(time.Time).Format("2006-01-02 15:04"),
+				attrs[0]["current_time"].(time.Time).Format("2006-01-02 15:04"))
+			for _, c := range attrs {
+				note := ""
+				if c["normalized"].(bool) {
+					note = " normalized"
+				}
+				fmt.Printf("    %-24s %d -> %d (%+d)%s\n", c["attribute_name"], c["previous"], c["current"], c["change"], note)
+			}
+		}
+		return
+	}
+
+	if *sumJSON {
+		summary, err := monitor.getSummaryDocument()
+		if err != nil {
+			log.Fatalf("Failed to get health summary: %v", err)
+		}
+		if err := printJSON(summary); err != nil {
+			log.Fatalf("Failed to write health summary: %v", err)
+		}
+		return
+	}
+
+	if *summary {
+		summary, err := monitor.getHealthSummary()
+		if err != nil {
+			log.Fatalf("Failed to get health summary: %v", err)
+		}
+
+		// Name drives by bay as well as path when the slot map placed them
+		bays, _ := summary["bays"].(map[string]string)
+		location := func(device interface{}) string {
+			if bay := bays[fmt.Sprint(device)]; bay != "" {
+				return fmt.Sprintf("%s (bay %s)", device, bay)
+			}
+			return fmt.Sprint(device)
+		}
+
+		fmt.Println("MAID SMART Health Summary:")
+		fmt.Printf("Total devices: %v\n", summary["total_devices"])
+		fmt.Printf("Devices with alerts: %v\n", summary["devices_with_alerts"])
+
+		if alerts, ok := summary["alerts_by_device"].(map[string]int); ok {
+			devices := make([]string, 0, len(alerts))
+			for device := range alerts {
+				devices = append(devices, device)
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				fmt.Printf("  %s: %d alerts\n", location(device), alerts[device])
+			}
+		}
+
+		if temps, ok := summary["temperatures"].(map[string][]map[string]interface{}); ok && len(temps) > 0 {
+			fmt.Println("Temperatures:")
+			devices := make([]string, 0, len(temps))
+			for device := range temps {
+				devices = append(devices, device)
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				var parts []string
+				for _, r := range temps[device] {
+					parts = append(parts, fmt.Sprintf("%s %.0f°%s", r["sensor"], r["value"], r["unit"]))
+				}
+				fmt.Printf("  %s: %s\n", device, strings.Join(parts, ", "))
+			}
+		}
+
+		if stats, ok := summary["temperature_stats"].(map[string]interface{}); ok && stats != nil {
+			hottest := stats["hottest"].(map[string]interface{})
+			coolest := stats["coolest"].(map[string]interface{})
+			fmt.Printf("Hottest: %s %.0f°%s, coolest: %s %.0f°%s, average %.1f°%s over %d drives\n",
+				hottest["device"], hottest["value"], stats["unit"], coolest["device"], coolest["value"], stats["unit"],
+				stats["average"], stats["unit"], stats["devices"])
+		}
+
+		if volume, ok := summary["data_volume"].(map[string]map[string]float64); ok && len(volume) > 0 {
+			fmt.Println("Data written/read:")
+			devices := make([]string, 0, len(volume))
+			for device := range volume {
+				devices = append(devices, device)
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				fmt.Printf("  %s: %.2f TB written, %.2f TB read\n", device, volume[device]["tb_written"], volume[device]["tb_read"])
+			}
+		}
+
+		if changes, ok := summary["since_install"].(map[string][]map[string]interface{}); ok && len(changes) > 0 {
+			fmt.Println("Change since install:")
+			devices := make([]string, 0, len(changes))
+			for device := range changes {
+				devices = append(devices, device)
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				attrs := changes[device]
+				var parts []string
+				for _, c := range attrs {
+					parts = append(parts, fmt.Sprintf("%s %+d", c["attribute_name"], c["change"]))
+				}
+				fmt.Printf("  %s (since %s): %s\n", device,
+					attrs[0]["baseline_time"].(time.Time).Format("2006-01-02"), strings.Join(parts, ", "))
+			}
+		}
+
+		if windows, ok := summary["maintenance"].([]map[string]interface{}); ok && len(windows) > 0 {
+			fmt.Println("Maintenance (alerts not notified):")
+			for _, w := range windows {
+				fmt.Printf("  %s until %s %s\n", w["target"], w["ends"].(time.Time).Format("2006-01-02 15:04"), w["reason"])
+			}
+		}
+
+		if suppressed, ok := summary["suppressed"].([]map[string]interface{}); ok && len(suppressed) > 0 {
+			fmt.Println("Suppressed (accepted, not notified):")
+			for _, a := range suppressed {
+				fmt.Printf("  %s (%s): %s %s [%s] %s\n", a["device"], a["serial_number"], a["attribute_name"],
+					a["alert_type"], a["severity"], a["reason"])
+			}
+		}
+
+		if replacements, ok := summary["replacements"].([]map[string]interface{}); ok && len(replacements) > 0 {
+			fmt.Println("Recommended for replacement:")
+			for _, r := range replacements {
+				fmt.Printf("  %d. %s (%s %s): %s\n", r["priority"], location(r["device"]), r["model"], r["serial_number"],
+					strings.Join(r["reasons"].([]string), ", "))
+			}
+		}
+
+		if notes, ok := summary["notes_by_device"].(map[string]string); ok && len(notes) > 0 {
+			fmt.Println("Notes:")
+			devices := make([]string, 0, len(notes))
+			for device := range notes {
+				devices = append(devices, device)
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				fmt.Printf("  %s: %s\n", device, notes[device])
+			}
+		}
+		return
+	}
+
+	// Refused access is the usual first-run problem, so say so before every
+	// device fails with it
+	if monitor.inputDir == "" && len(runner.prefix) == 0 && !isPrivileged() {
+		monitor.warnLogger.Printf("Not running as root and no -command-prefix is set; smartctl will most likely be denied access to the drives")
+	}
+
+	if *daemon {
+		if *lockFile == "" && monitor.dbPath != ":memory:" {
+			*lockFile = monitor.dbPath + ".lock"
+		}
+		if *lockFile != "" {
+			lock, previous, err := acquireInstanceLock(*lockFile)
+			if err != nil {
+				log.Fatalf("Not starting: %v", err)
+			}
+			// Emptied on a clean exit, so only a crashed holder is reported as taken over
+			defer func() {
+				lock.Truncate(0)
+				lock.Close()
+			}()
+			if previous != "" {
+				monitor.logger.Printf("Took over lock file %s from %s, which is no longer running", *lockFile, previous)
+			}
+			monitor.logger.Printf("Holding lock file %s as PID %d", *lockFile, os.Getpid())
+		}
+
 		monitor.logger.Printf("Starting MAID SMART monitor daemon (interval: %ds)", *interval)
 
+		// With adaptive polling the daemon wakes every -adaptive-min and each
+		// cycle only polls the devices that are due
+		period := time.Duration(*interval) * time.Second
+		if monitor.adaptiveWarm > 0 {
+			period = monitor.adaptiveMin
+			monitor.logger.Printf("Adaptive polling: every %v at or above %d°C, every %v at or below %d°C, otherwise every %v",
+				monitor.adaptiveMin, monitor.adaptiveWarm, monitor.adaptiveMax, monitor.adaptiveCool, monitor.pollInterval)
+		}
+		if *jitter > period/2 {
+			monitor.logger.Printf("Jitter %v exceeds half the interval, capping at %v", *jitter, period/2)
+			*jitter = period / 2
+		}
+		if *jitter > 0 || *stagger > 0 {
+			monitor.logger.Printf("Cycle start jitter: up to %v, per-device stagger: up to %v", *jitter, *stagger)
+		}
+
+		if *socket != "" {
+			listener, err := listenSocket(*socket)
+			if err != nil {
+				log.Fatalf("Failed to start socket server: %v", err)
+			}
+			defer listener.Close()
+			go monitor.serveSocket(listener)
+			monitor.logger.Printf("Serving status on Unix socket %s", *socket)
+		}
+
+		if *apiAddr != "" {
+			server, err := monitor.startHTTPServer("API", *apiAddr, monitor.apiHandler(*apiToken))
+			if err != nil {
+				log.Fatalf("Failed to start API server: %v", err)
+			}
+			defer server.Close()
+		}
+
 		// Set up signal handling for graceful shutdown
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-		ticker := time.NewTicker(time.Duration(*interval) * time.Second)
-		defer ticker.Stop()
+		if err := sdNotify("READY=1"); err != nil {
+			monitor.errLogger.Printf("%v", err)
+		}
+
+		// Cycles stay on the interval schedule, each started at a random offset
+		// into it so hosts sharing an interval do not spin up drives in lockstep
+		next := time.Now()
+		timer := time.NewTimer(jitterDelay(*jitter))
+		defer timer.Stop()
 
-		// Run initial cycle
-		if err := monitor.runMonitoringCycle(); err != nil {
-			monitor.logger.Printf("Error in monitoring cycle: %v", err)
+		// The digest is sent between cycles, so it sees each one complete
+		var digestC <-chan time.Time
+		var digestTimer *time.Timer
+		if *digestAt != "" {
+			digestTimer = time.NewTimer(time.Until(nextDailyTime(time.Now(), digestClock)))
+			defer digestTimer.Stop()
+			digestC = digestTimer.C
+			monitor.logger.Printf("Sending the daily digest at %s", *digestAt)
 		}
 
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				if err := monitor.runMonitoringCycle(); err != nil {
-					monitor.logger.Printf("Error in monitoring cycle: %v", err)
+					monitor.errLogger.Printf("Error in monitoring cycle: %v", err)
+				} else if err := sdNotify("WATCHDOG=1"); err != nil {
+					monitor.errLogger.Printf("%v", err)
+				}
+				next = next.Add(period)
+				for time.Until(next) < 0 {
+					next = next.Add(period)
+				}
+				timer.Reset(time.Until(next) + jitterDelay(*jitter))
+			case <-digestC:
+				if err := monitor.sendDigest(*digestAs); err != nil {
+					monitor.errLogger.Printf("Failed to send daily digest: %v", err)
 				}
+				digestTimer.Reset(time.Until(nextDailyTime(time.Now(), digestClock)))
 			case sig := <-sigChan:
 				monitor.logger.Printf("Received signal %v, shutting down...", sig)
+				sdNotify("STOPPING=1")
+				return
+			}
+		}
+	} else if *cycles > 1 {
+		// A bounded burst of readings, e.g. through a stress test: cycles start
+		// -interval apart like the daemon's, without its lock, servers or jitter
+		monitor.logger.Printf("Running %d monitoring cycles (interval: %ds)", *cycles, *interval)
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+		period := time.Duration(*interval) * time.Second
+		next := time.Now()
+		failed := 0
+		for i := 1; ; i++ {
+			if err := monitor.runMonitoringCycle(); err != nil {
+				monitor.errLogger.Printf("Error in monitoring cycle %d of %d: %v", i, *cycles, err)
+				failed++
+			}
+			if i == *cycles {
+				break
+			}
+			next = next.Add(period)
+			select {
+			case <-time.After(time.Until(next)):
+			case sig := <-sigChan:
+				monitor.logger.Printf("Received signal %v after %d of %d cycles, shutting down...", sig, i, *cycles)
 				return
 			}
 		}
+		if failed > 0 {
+			monitor.Close()
+			log.Fatalf("%d of %d monitoring cycles failed", failed, *cycles)
+		}
 	} else {
 		if err := monitor.runMonitoringCycle(); err != nil {
 			log.Fatalf("Error in monitoring cycle: %v", err)
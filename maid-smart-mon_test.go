@@ -0,0 +1,1266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cannedAttributesJSON is "smartctl -A -c --json" output for a WD Red with a
+// few reallocated sectors, trimmed to what the monitor reads
+const cannedAttributesJSON = `{
+  "json_format_version": [1, 0],
+  "smartctl": {"version": [7, 3]},
+  "ata_smart_data": {"offline_data_collection": {"status": {"value": 130, "string": "was completed without error"}}},
+  "ata_smart_attributes": {"table": [
+    {"id": 5, "name": "Reallocated_Sector_Ct", "value": 199, "worst": 199, "thresh": 140,
+     "flags": {"value": 51, "string": "PO--CK ", "prefailure": true, "updated_online": true},
+     "raw": {"value": 8, "string": "8"}},
+    {"id": 9, "name": "Power_On_Hours", "value": 72, "worst": 72, "thresh": 0,
+     "flags": {"value": 50, "string": "-O--CK "},
+     "raw": {"value": 20530, "string": "20530"}},
+    {"id": 194, "name": "Temperature_Celsius", "value": 116, "worst": 103, "thresh": 0,
+     "flags": {"value": 34, "string": "-O---K "},
+     "raw": {"value": 193273528351, "string": "31 (Min/Max 22/45)"}},
+    {"id": 250, "name": "Read_Error_Retry_Rate", "value": 200, "worst": 200, "thresh": 0,
+     "flags": {"value": 50}, "raw": {"value": 0, "string": "0"}}
+  ]}
+}`
+
+// newTestMonitor returns a monitor on a private in-memory database, closed
+// when the test ends
+func newTestMonitor(t *testing.T) *MAIDSmartMonitor {
+	t.Helper()
+	m, err := NewMAIDSmartMonitor(":memory:", defaultDBDurability)
+	if err != nil {
+		t.Fatalf("NewMAIDSmartMonitor: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestParseSmartAttributes(t *testing.T) {
+	m := newTestMonitor(t)
+
+	var data SmartData
+	if err := json.Unmarshal([]byte(cannedAttributesJSON), &data); err != nil {
+		t.Fatalf("canned JSON: %v", err)
+	}
+	attributes := m.parseSmartAttributes(&data, "/dev/sda")
+
+	byID := make(map[int]map[string]interface{})
+	for _, attr := range attributes {
+		byID[attr["attribute_id"].(int)] = attr
+	}
+	if _, ok := byID[250]; ok {
+		t.Errorf("attribute 250 is not monitored but was parsed")
+	}
+	if len(byID) != 3 {
+		t.Fatalf("parsed %d attributes, want 3 (5, 9, 194)", len(byID))
+	}
+
+	realloc := byID[5]
+	if realloc["raw_value"] != int64(8) || realloc["normalized_value"] != 199 || realloc["threshold"] != 140 {
+		t.Errorf("attribute 5 = raw %v normalized %v threshold %v, want 8 199 140",
+			realloc["raw_value"], realloc["normalized_value"], realloc["threshold"])
+	}
+	if realloc["prefailure"] != true || realloc["updated_online"] != true {
+		t.Errorf("attribute 5 flags = %v, want prefailure and updated_online", realloc["flags"])
+	}
+	if byID[9]["prefailure"] != false {
+		t.Errorf("attribute 9 is old-age but parsed as prefailure")
+	}
+
+	// The packed 48-bit raw value must not be read as the temperature
+	temp := byID[194]
+	if temp["raw_value"] != int64(31) || temp["temp_min"] != int64(22) || temp["temp_max"] != int64(45) {
+		t.Errorf("attribute 194 = %v (min %v max %v), want 31 (min 22 max 45)",
+			temp["raw_value"], temp["temp_min"], temp["temp_max"])
+	}
+
+	if realloc["smartctl_version"] != "7.3" || realloc["json_format_version"] != "1.0" {
+		t.Errorf("versions = %v / %v, want 7.3 / 1.0", realloc["smartctl_version"], realloc["json_format_version"])
+	}
+	if realloc["stale"] != false {
+		t.Errorf("offline collection completed, but attribute 5 is marked stale")
+	}
+}
+
+// testAttribute is an attribute map as parseSmartAttributes produces it
+func testAttribute(id int, name string, raw int64, normalized, threshold int) map[string]interface{} {
+	return map[string]interface{}{
+		"device":           "/dev/sda",
+		"attribute_id":     id,
+		"attribute_name":   name,
+		"raw_value":        raw,
+		"normalized_value": normalized,
+		"threshold":        threshold,
+		"worst_value":      normalized,
+		"prefailure":       true,
+	}
+}
+
+func TestEvaluateThresholds(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes []map[string]interface{}
+		want       []string
+	}{
+		{
+			name: "healthy",
+			attributes: []map[string]interface{}{
+				testAttribute(5, "Reallocated_Sector_Ct", 0, 200, 140),
+				testAttribute(194, "Temperature_Celsius", 38, 112, 0),
+			},
+			want: nil,
+		},
+		{
+			name:       "below threshold",
+			attributes: []map[string]interface{}{testAttribute(3, "Spin_Up_Time", 9000, 20, 21)},
+			want:       []string{"THRESHOLD_VIOLATION"},
+		},
+		{
+			name:       "critical attribute nonzero",
+			attributes: []map[string]interface{}{testAttribute(197, "Current_Pending_Sector", 3, 200, 0)},
+			want:       []string{"CRITICAL_VALUE"},
+		},
+		{
+			name: "hot drive alerts once",
+			attributes: []map[string]interface{}{
+				testAttribute(190, "Airflow_Temperature_Cel", 63, 37, 25),
+				testAttribute(194, "Temperature_Celsius", 64, 36, 0),
+			},
+			want: []string{"HIGH_TEMPERATURE"},
+		},
+		{
+			name: "stale attribute skips only its threshold",
+			attributes: []map[string]interface{}{
+				func() map[string]interface{} {
+					attr := testAttribute(198, "Offline_Uncorrectable", 2, 90, 100)
+					attr["stale"] = true
+					return attr
+				}(),
+			},
+			want: []string{"CRITICAL_VALUE"},
+		},
+	}
+
+	m := newTestMonitor(t)
+	m.ignoreStale = true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raised []string
+			m.evaluateThresholds(tt.attributes, "", func(device, attribute, alertType, message string) {
+				raised = append(raised, alertType)
+			})
+			if !reflect.DeepEqual(raised, tt.want) {
+				t.Errorf("raised %v, want %v", raised, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckHealthThresholdsRecordsAlert(t *testing.T) {
+	m := newTestMonitor(t)
+	m.checkHealthThresholds([]map[string]interface{}{testAttribute(197, "Current_Pending_Sector", 3, 200, 0)}, "")
+	m.writes.do("sync", func() error { return nil })
+
+	var alertType, severity string
+	err := m.db.QueryRow(`SELECT alert_type, severity FROM health_alerts WHERE attribute_name = 'Current_Pending_Sector'`).
+		Scan(&alertType, &severity)
+	if err != nil {
+		t.Fatalf("alert not recorded: %v", err)
+	}
+	if alertType != "CRITICAL_VALUE" || severity != initialSeverity["CRITICAL_VALUE"] {
+		t.Errorf("recorded %s %s, want CRITICAL_VALUE %s", alertType, severity, initialSeverity["CRITICAL_VALUE"])
+	}
+}
+
+func TestErrorRateDeclinePlaceholderBaseline(t *testing.T) {
+	m := newTestMonitor(t)
+	const serial = "ZA1234567"
+	if err := m.captureBaseline([]map[string]interface{}{testAttribute(1, "Raw_Read_Error_Rate", 0, 253, 6)}, serial); err != nil {
+		t.Fatalf("captureBaseline: %v", err)
+	}
+
+	declines := func() int {
+		t.Helper()
+		m.writes.do("sync", func() error { return nil })
+		var n int
+		if err := m.db.QueryRow(`SELECT COUNT(*) FROM health_alerts WHERE alert_type = 'ERROR_RATE_DECLINE'`).Scan(&n); err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		return n
+	}
+
+	m.checkErrorRateDecline([]map[string]interface{}{testAttribute(1, "Raw_Read_Error_Rate", 0, 82, 6)}, serial)
+	if n := declines(); n != 0 {
+		t.Fatalf("%d ERROR_RATE_DECLINE alerts measured from a 253 placeholder, want 0", n)
+	}
+	var baseline int
+	if err := m.db.QueryRow(`SELECT normalized_value FROM device_baselines WHERE serial_number = ? AND attribute_id = 1`,
+		serial).Scan(&baseline); err != nil {
+		t.Fatalf("query baseline: %v", err)
+	}
+	if baseline != 82 {
+		t.Errorf("baseline = %d, want the first real value 82", baseline)
+	}
+
+	m.checkErrorRateDecline([]map[string]interface{}{testAttribute(1, "Raw_Read_Error_Rate", 0, 45, 6)}, serial)
+	if n := declines(); n != 1 {
+		t.Errorf("%d ERROR_RATE_DECLINE alerts after falling from 82 to 45, want 1", n)
+	}
+}
+
+func TestMountsDiscovererDrives(t *testing.T) {
+	drives, err := mountsDiscoverer{path: "testdata/mounts"}.Drives()
+	if err != nil {
+		t.Fatalf("Drives: %v", err)
+	}
+
+	// Partitions fold into their disk, once; pseudo and loop filesystems are skipped
+	want := []string{"/dev/sda", "/dev/sdb", "/dev/nvme0n1", "/dev/mapper/vg0-data"}
+	if !reflect.DeepEqual(drives, want) {
+		t.Errorf("Drives() = %v, want %v", drives, want)
+	}
+
+	if _, err := (mountsDiscoverer{path: "testdata/missing"}).Drives(); err == nil {
+		t.Errorf("Drives() on a missing file returned no error")
+	}
+}
+
+func TestStoreSmartData(t *testing.T) {
+	m := newTestMonitor(t)
+	info := &DeviceInfo{Device: "/dev/sda", SerialNumber: "WD-WCC4E1234567", Model: "WDC WD40EFRX-68N32N0"}
+	attributes := []map[string]interface{}{
+		testAttribute(5, "Reallocated_Sector_Ct", 8, 199, 140),
+		testAttribute(9, "Power_On_Hours", 20530, 72, 0),
+	}
+
+	first := time.Now().Add(-time.Hour)
+	if _, err := m.store.StoreSmartData(attributes, info, first); err != nil {
+		t.Fatalf("StoreSmartData: %v", err)
+	}
+	attributes[1]["raw_value"] = int64(20531)
+	if _, err := m.store.StoreSmartData(attributes, info, first.Add(time.Hour)); err != nil {
+		t.Fatalf("StoreSmartData: %v", err)
+	}
+
+	rows, err := m.db.Query(`SELECT device_id, serial_number, attribute_id, raw_value FROM smart_data ORDER BY timestamp, attribute_id`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+	var got []int64
+	for rows.Next() {
+		var deviceID, serial string
+		var attrID int
+		var raw int64
+		if err := rows.Scan(&deviceID, &serial, &attrID, &raw); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		if deviceID != info.ID() || serial != info.SerialNumber {
+			t.Errorf("row keyed %s/%s, want %s/%s", deviceID, serial, info.ID(), info.SerialNumber)
+		}
+		got = append(got, raw)
+	}
+	if want := []int64{8, 20530, 8, 20531}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored raw values %v, want %v", got, want)
+	}
+}
+
+func TestStoreSmartDataSkipsClockGoingBack(t *testing.T) {
+	m := newTestMonitor(t)
+	info := &DeviceInfo{Device: "/dev/sda", SerialNumber: "WD-WCC4E1234567"}
+	attributes := []map[string]interface{}{testAttribute(9, "Power_On_Hours", 20530, 72, 0)}
+
+	now := time.Now()
+	for i, ts := range []time.Time{now, now.Add(-time.Minute), now} {
+		stored, err := m.store.StoreSmartData(attributes, info, ts)
+		if err != nil {
+			t.Fatalf("StoreSmartData: %v", err)
+		}
+		want := 0
+		if i == 0 {
+			want = 1
+		}
+		if stored != want {
+			t.Errorf("reading %d: StoreSmartData reported %d rows stored, want %d", i, stored, want)
+		}
+	}
+
+	var timestamps []string
+	rows, err := m.db.Query(`SELECT timestamp FROM smart_data`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts string
+		rows.Scan(&ts)
+		timestamps = append(timestamps, ts)
+	}
+	sort.Strings(timestamps)
+	if len(timestamps) != 1 {
+		t.Errorf("stored %d readings, want only the first: %v", len(timestamps), timestamps)
+	}
+}
+
+// fakeSmartctl answers smartctl runs with canned output keyed by the arguments
+// before the device, so cycles can run without drives
+type fakeSmartctl map[string]string
+
+func (f fakeSmartctl) Run(args ...string) ([]byte, error) {
+	if len(args) > 0 && strings.HasPrefix(args[len(args)-1], "/dev/") {
+		args = args[:len(args)-1]
+	}
+	if output, ok := f[strings.Join(args, " ")]; ok {
+		return []byte(output), nil
+	}
+	return nil, fmt.Errorf("no canned output for smartctl %s", strings.Join(args, " "))
+}
+
+// fixedDiscoverer reports the same drives every cycle
+type fixedDiscoverer []string
+
+func (d fixedDiscoverer) Drives() ([]string, error) { return d, nil }
+
+// healthyDrive is the smartctl output of a spinning WD Red that passes its
+// self-assessment
+var healthyDrive = fakeSmartctl{
+	"--nocheck=standby -n standby": "Device is in ACTIVE or IDLE mode",
+	"--nocheck=standby -i": "Device Model:     WDC WD40EFRX-68N32N0\n" +
+		"Serial Number:    WD-WCC4E1234567\n" +
+		"SMART support is: Enabled\n",
+	"-A -c --json": cannedAttributesJSON,
+	"-H --json":    `{"smart_status": {"passed": true}}`,
+}
+
+func TestSmartDisabledOnlyWhenReported(t *testing.T) {
+	m := newTestMonitor(t)
+	m.discovery = fixedDiscoverer{"/dev/sda"}
+
+	withInfo := func(info string) fakeSmartctl {
+		runner := fakeSmartctl{}
+		for args, output := range healthyDrive {
+			runner[args] = output
+		}
+		runner["--nocheck=standby -i"] = info
+		return runner
+	}
+	const identity = "Device Model:     WDC WD40EFRX-68N32N0\nSerial Number:    WD-WCC4E1234567\n"
+
+	disabledAlerts := func(runner smartctlRunner) int {
+		t.Helper()
+		m.runner = runner
+		if err := m.runMonitoringCycle(); err != nil {
+			t.Fatalf("runMonitoringCycle: %v", err)
+		}
+		m.writes.do("sync", func() error { return nil })
+		var n int
+		if err := m.db.QueryRow(`SELECT COUNT(*) FROM health_alerts WHERE alert_type = 'SMART_DISABLED'`).Scan(&n); err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		return n
+	}
+
+	if n := disabledAlerts(healthyDrive); n != 0 {
+		t.Fatalf("%d SMART_DISABLED alerts for a healthy drive, want 0", n)
+	}
+	if n := disabledAlerts(withInfo(identity)); n != 0 {
+		t.Errorf("%d SMART_DISABLED alerts when smartctl -i printed no SMART state, want 0", n)
+	}
+	if n := disabledAlerts(withInfo(identity + "SMART support is: Disabled\n")); n != 1 {
+		t.Errorf("%d SMART_DISABLED alerts when smartctl -i reported SMART disabled, want 1", n)
+	}
+}
+
+// TestCycleConcurrentWithReads runs monitoring cycles while the API front-ends
+// read the summary, status and cycle state, as the daemon does with -api-listen
+// or -socket-path. Run with -race to check the cycle and state locking.
+func TestCycleConcurrentWithReads(t *testing.T) {
+	// A file database, so reads and the writer use separate connections
+	m, err := NewMAIDSmartMonitor(filepath.Join(t.TempDir(), "smart.db"), defaultDBDurability)
+	if err != nil {
+		t.Fatalf("NewMAIDSmartMonitor: %v", err)
+	}
+	defer m.Close()
+	m.runner = healthyDrive
+	m.discovery = fixedDiscoverer{"/dev/sda"}
+
+	const cycles = 5
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, cycles+3)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(stop)
+		for i := 0; i < cycles; i++ {
+			if err := m.runMonitoringCycle(); err != nil {
+				errs <- fmt.Errorf("cycle %d: %v", i+1, err)
+				return
+			}
+		}
+	}()
+
+	for _, resource := range []string{"summary", "status", "diff"} {
+		wg.Add(1)
+		go func(resource string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := m.apiResource(resource); err != nil {
+					errs <- fmt.Errorf("%s: %v", resource, err)
+					return
+				}
+				m.cycleState()
+			}
+		}(resource)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	m.writes.do("sync", func() error { return nil })
+	var readings int
+	if err := m.db.QueryRow(`SELECT COUNT(DISTINCT timestamp) FROM smart_data`).Scan(&readings); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if readings != cycles {
+		t.Errorf("stored %d readings, want one per cycle (%d)", readings, cycles)
+	}
+	if state := m.cycleState(); state["running"] != false {
+		t.Errorf("cycle still marked running after the last one finished")
+	}
+}
+
+// slowSmartctl holds each attribute read for a moment and records the most
+// attribute reads it saw running at once
+type slowSmartctl struct {
+	fakeSmartctl
+	mu          sync.Mutex
+	active, max int
+}
+
+func (f *slowSmartctl) Run(args ...string) ([]byte, error) {
+	if len(args) > 0 && args[0] == "-A" {
+		f.mu.Lock()
+		f.active++
+		if f.active > f.max {
+			f.max = f.active
+		}
+		f.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		defer func() {
+			f.mu.Lock()
+			f.active--
+			f.mu.Unlock()
+		}()
+	}
+	return f.fakeSmartctl.Run(args...)
+}
+
+func TestMaxActiveSpindles(t *testing.T) {
+	m := newTestMonitor(t)
+	runner := &slowSmartctl{fakeSmartctl: healthyDrive}
+	m.runner = runner
+	m.discovery = fixedDiscoverer{"/dev/sda", "/dev/sdb", "/dev/sdc", "/dev/sdd", "/dev/sde", "/dev/sdf"}
+	m.parallel = 6
+	m.spindles = make(chan struct{}, 2)
+
+	if err := m.runMonitoringCycle(); err != nil {
+		t.Fatalf("runMonitoringCycle: %v", err)
+	}
+	if runner.max != 2 {
+		t.Errorf("read %d spinning drives at once, want 2", runner.max)
+	}
+	if collected := m.lastSummary.DevicesCollected; collected != 6 {
+		t.Errorf("collected %d devices, want 6", collected)
+	}
+}
+
+// TestAlertResolution checks that an alert the next reading does not raise
+// again is resolved, and that PagerDuty is told to close its incident
+func TestAlertResolution(t *testing.T) {
+	var mu sync.Mutex
+	var events []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var event map[string]interface{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("PagerDuty event: %v", err)
+		}
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	m := newTestMonitor(t)
+	pagerDuty := newPagerDutyNotifier("R0UT1NGKEY")
+	pagerDuty.url = server.URL
+	m.notifiers = []Notifier{severityNotifier{Notifier: pagerDuty, minSeverity: SeverityCritical}}
+	m.discovery = fixedDiscoverer{"/dev/sda"}
+
+	failing := fakeSmartctl{}
+	for args, output := range healthyDrive {
+		failing[args] = output
+	}
+	failing["-A -c --json"] = strings.Replace(cannedAttributesJSON,
+		`"value": 199, "worst": 199`, `"value": 120, "worst": 120`, 1)
+
+	cycle := func(runner smartctlRunner) {
+		t.Helper()
+		m.runner = runner
+		if err := m.runMonitoringCycle(); err != nil {
+			t.Fatalf("runMonitoringCycle: %v", err)
+		}
+		m.writes.do("sync", func() error { return nil })
+		m.notifyWG.Wait()
+	}
+	openAlerts := func() int {
+		t.Helper()
+		var n int
+		if err := m.db.QueryRow(`SELECT COUNT(*) FROM health_alerts
+			WHERE alert_type = 'THRESHOLD_VIOLATION' AND NOT resolved`).Scan(&n); err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		return n
+	}
+
+	cycle(failing)
+	cycle(failing)
+	if n := openAlerts(); n != 1 {
+		t.Fatalf("%d open THRESHOLD_VIOLATION alerts while failing, want 1", n)
+	}
+	cycle(healthyDrive)
+	if n := openAlerts(); n != 0 {
+		t.Errorf("%d open THRESHOLD_VIOLATION alerts after recovering, want 0", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event["event_action"].(string))
+		if key := event["dedup_key"]; key != "maid-smart-monitor:WD-WCC4E1234567:Reallocated_Sector_Ct:THRESHOLD_VIOLATION" {
+			t.Errorf("dedup_key = %v, want the serial, attribute and alert type", key)
+		}
+	}
+	if want := []string{"trigger", "resolve"}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("PagerDuty events = %v, want %v", actions, want)
+	}
+}
+
+func TestReclaimSpace(t *testing.T) {
+	m, err := NewMAIDSmartMonitor(filepath.Join(t.TempDir(), "smart.db"), defaultDBDurability)
+	if err != nil {
+		t.Fatalf("NewMAIDSmartMonitor: %v", err)
+	}
+	defer m.Close()
+
+	var mode int
+	if err := m.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil || mode != 2 {
+		t.Fatalf("auto_vacuum = %d (%v), want 2 (incremental) on a new database", mode, err)
+	}
+
+	info := &DeviceInfo{Device: "/dev/sda", SerialNumber: "WD-WCC4E1234567"}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 500; i++ {
+		attr := testAttribute(5, "Reallocated_Sector_Ct", int64(i), 100, 10)
+		if _, err := m.store.StoreSmartData([]map[string]interface{}{attr}, info, start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("StoreSmartData: %v", err)
+		}
+	}
+	if _, err := m.pruneData(time.Now()); err != nil {
+		t.Fatalf("pruneData: %v", err)
+	}
+	if err := m.reclaimSpace(); err != nil {
+		t.Fatalf("reclaimSpace: %v", err)
+	}
+
+	var free int
+	if err := m.db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+		t.Fatalf("freelist_count: %v", err)
+	}
+	if free != 0 {
+		t.Errorf("%d free pages left after reclaiming, want 0", free)
+	}
+}
+
+// TestVerifyChainAfterPruning checks that readings deleted by retention are not
+// reported as tampering, while an edit to a remaining reading still is
+func TestVerifyChainAfterPruning(t *testing.T) {
+	m := newTestMonitor(t)
+	m.runner = healthyDrive
+	m.discovery = fixedDiscoverer{"/dev/sda"}
+	m.hashChain = true
+
+	var cutoff time.Time
+	for i := 0; i < 3; i++ {
+		if err := m.runMonitoringCycle(); err != nil {
+			t.Fatalf("runMonitoringCycle: %v", err)
+		}
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+			cutoff = time.Now()
+		}
+	}
+	if _, err := m.pruneData(cutoff); err != nil {
+		t.Fatalf("pruneData: %v", err)
+	}
+
+	check, err := m.verifyChain()
+	if err != nil {
+		t.Fatalf("verifyChain: %v", err)
+	}
+	if len(check.problems) > 0 || check.pruned != 1 || check.entries != 4 {
+		t.Fatalf("after pruning: %d entries, %d pruned, problems %v; want 4 entries (3 cycles and the prune), 1 pruned and none",
+			check.entries, check.pruned, check.problems)
+	}
+
+	m.writes.do("tamper", func() error {
+		_, err := m.db.Exec(`UPDATE smart_data SET raw_value = 0 WHERE id = (SELECT MAX(id) FROM smart_data)`)
+		return err
+	})
+	if check, err = m.verifyChain(); err != nil {
+		t.Fatalf("verifyChain: %v", err)
+	}
+	if len(check.problems) != 1 {
+		t.Errorf("after editing a reading: problems %v, want the last cycle reported", check.problems)
+	}
+}
+
+// countingCollector is an external collector that reports no drives and counts
+// its runs
+type countingCollector struct{ runs *int }
+
+func (c countingCollector) Name() string { return "counting" }
+
+func (c countingCollector) Collect() ([]collectedDrive, error) {
+	*c.runs++
+	return nil, nil
+}
+
+// TestAdaptivePollingSchedule checks that with adaptive polling a drive whose
+// identification fails is still scheduled on the normal interval, and that a
+// cycle woken early for warm drives leaves the fleet work to the -interval ones
+func TestAdaptivePollingSchedule(t *testing.T) {
+	m := newTestMonitor(t)
+	m.discovery = fixedDiscoverer{"/dev/sda", "/dev/sdb"}
+	m.runner = fakeSmartctl{} // every smartctl run fails
+	m.adaptiveWarm, m.adaptiveMin, m.pollInterval = 40, time.Minute, 5*time.Minute
+	var runs int
+	m.collectors = []collector{countingCollector{&runs}}
+
+	if err := m.runMonitoringCycle(); err != nil {
+		t.Fatalf("runMonitoringCycle: %v", err)
+	}
+	for _, device := range []string{"/dev/sda", "/dev/sdb"} {
+		p := m.polls[device]
+		if p == nil || p.interval != m.pollInterval {
+			t.Errorf("%s after a failed identification: poll %+v, want the %v interval", device, p, m.pollInterval)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("collector ran %d times in the first cycle, want 1", runs)
+	}
+
+	// A tick one -adaptive-min later: nothing is due and the fleet work waits
+	m.backoff["/dev/sdb"] = &deviceBackoff{failures: 3, skip: 2}
+	m.lastFleetCycle = time.Now().Add(-time.Minute)
+	if err := m.runMonitoringCycle(); err != nil {
+		t.Fatalf("runMonitoringCycle: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("collector ran on an adaptive tick")
+	}
+	if skip := m.backoff["/dev/sdb"].skip; skip != 2 {
+		t.Errorf("backoff skips left after an adaptive tick = %d, want 2", skip)
+	}
+
+	// Once -interval has passed the fleet work runs again
+	m.lastFleetCycle = time.Now().Add(-m.pollInterval)
+	if err := m.runMonitoringCycle(); err != nil {
+		t.Fatalf("runMonitoringCycle: %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("collector ran %d times after -interval, want 2", runs)
+	}
+	if skip := m.backoff["/dev/sdb"].skip; skip != 1 {
+		t.Errorf("backoff skips left after a fleet cycle = %d, want 1", skip)
+	}
+}
+
+func TestEventStreamAuthorization(t *testing.T) {
+	m := newTestMonitor(t)
+	server := httptest.NewServer(m.apiHandler("s3cret"))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	upgrade := func(path string, header map[string]string) *http.Response {
+		t.Helper()
+		conn, err := net.Dial("tcp", host)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		request := "GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+		for name, value := range header {
+			request += name + ": " + value + "\r\n"
+		}
+		if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{"no token", "/api/events", nil, http.StatusUnauthorized},
+		{"authorization header", "/api/events", map[string]string{"Authorization": "Bearer s3cret"}, http.StatusSwitchingProtocols},
+		{"subprotocol", "/api/events", map[string]string{"Sec-WebSocket-Protocol": "bearer.s3cret"}, http.StatusSwitchingProtocols},
+		{"wrong subprotocol", "/api/events", map[string]string{"Sec-WebSocket-Protocol": "bearer.guess"}, http.StatusUnauthorized},
+		{"query parameter", "/api/events?access_token=s3cret", nil, http.StatusSwitchingProtocols},
+		{"same origin", "/api/events?access_token=s3cret", map[string]string{"Origin": "http://" + host}, http.StatusSwitchingProtocols},
+		{"other origin", "/api/events?access_token=s3cret", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := upgrade(tt.path, tt.header)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if protocol := tt.header["Sec-WebSocket-Protocol"]; protocol != "" && tt.want == http.StatusSwitchingProtocols {
+				if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != protocol {
+					t.Errorf("Sec-WebSocket-Protocol = %q, want %q", got, protocol)
+				}
+			}
+		})
+	}
+
+	// The query parameter only stands in for the header on the event stream
+	resp, err := http.Get(server.URL + "/api/summary?access_token=s3cret")
+	if err != nil {
+		t.Fatalf("GET /api/summary: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/api/summary with a query token: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestCanonicalDevicesDeviceMapper(t *testing.T) {
+	m := newTestMonitor(t)
+	m.sysPath = t.TempDir()
+	volume := func(name, uuid string, members ...string) {
+		t.Helper()
+		dir := filepath.Join(m.sysPath, "block", name)
+		for _, member := range members {
+			if err := os.MkdirAll(filepath.Join(dir, "slaves", member), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "dm"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "dm", "name"), []byte(name+"-vol\n"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "dm", "uuid"), []byte(uuid+"\n"), 0644)
+	}
+	volume("dm-0", "LVM-Kx3Tq8", "sdc", "sdb", "md0")
+	volume("dm-1", "mpath-3600508b400105e210000900000490000", "sde", "sdd")
+
+	tests := []struct {
+		device string
+		want   []string
+	}{
+		{"/dev/dm-0", []string{"/dev/sdb", "/dev/sdc"}},
+		{"/dev/mapper/dm-0-vol", []string{"/dev/sdb", "/dev/sdc"}},
+		{"/dev/dm-1", []string{"/dev/sdd"}},
+		{"/dev/mapper/unknown", []string{"/dev/mapper/unknown"}},
+		{"/dev/nvme0n1p2", []string{"/dev/nvme0"}},
+	}
+	for _, tt := range tests {
+		if got := m.canonicalDevices(tt.device); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("canonicalDevices(%s) = %v, want %v", tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestAPIResources(t *testing.T) {
+	m := newTestMonitor(t)
+	server := httptest.NewServer(m.apiHandler(""))
+	defer server.Close()
+
+	for path, want := range map[string]int{
+		"/api/summary": http.StatusOK,
+		"/api/status":  http.StatusOK,
+		"/api/diff":    http.StatusOK,
+		"/api/config":  http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: status %d, want %d", path, resp.StatusCode, want)
+		} else if want == http.StatusOK && !json.Valid(body) {
+			t.Errorf("GET %s: invalid JSON %q", path, body)
+		}
+	}
+}
+
+// exitStatusSmartctl returns output together with an exit status error, as
+// smartctl does when it skips a drive for its power mode
+type exitStatusSmartctl string
+
+func (e exitStatusSmartctl) Run(args ...string) ([]byte, error) {
+	return []byte(e), fmt.Errorf("exit status 2")
+}
+
+func TestIsDeviceInStandby(t *testing.T) {
+	m := newTestMonitor(t)
+	for output, want := range map[string]bool{
+		"Device is in STANDBY mode, exit(2)": true,
+		"Device is in SLEEP mode, exit(2)":   true,
+		"Device is in IDLE_A mode":           false,
+		"":                                   false,
+	} {
+		m.runner = exitStatusSmartctl(output)
+		if got := m.isDeviceInStandby("/dev/sda"); got != want {
+			t.Errorf("isDeviceInStandby with output %q = %v, want %v", output, got, want)
+		}
+	}
+}
+
+// countingSmartctl counts the runs of each smartctl command line
+type countingSmartctl struct {
+	fakeSmartctl
+	mu   sync.Mutex
+	runs map[string]int
+}
+
+func (c *countingSmartctl) Run(args ...string) ([]byte, error) {
+	c.mu.Lock()
+	c.runs[strings.Join(args, " ")]++
+	c.mu.Unlock()
+	return c.fakeSmartctl.Run(args...)
+}
+
+func (c *countingSmartctl) count(command string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.runs[command]
+}
+
+func TestStandbyProbedOncePerCycle(t *testing.T) {
+	m := newTestMonitor(t)
+	m.discovery = fixedDiscoverer{"/dev/sda"}
+	m.parallel = 2
+	standby := fakeSmartctl{}
+	for args, output := range healthyDrive {
+		standby[args] = output
+	}
+	standby["--nocheck=standby -n standby"] = "Device is in STANDBY mode, exit(2)"
+	runner := &countingSmartctl{fakeSmartctl: standby, runs: make(map[string]int)}
+	m.runner = runner
+
+	for cycle := 1; cycle <= 2; cycle++ {
+		if err := m.runMonitoringCycle(); err != nil {
+			t.Fatalf("runMonitoringCycle: %v", err)
+		}
+		if n := runner.count("--nocheck=standby -n standby /dev/sda"); n != cycle {
+			t.Errorf("after %d cycles /dev/sda was probed %d times, want once per cycle", cycle, n)
+		}
+	}
+}
+
+func TestRawArchivePruning(t *testing.T) {
+	m := newTestMonitor(t)
+	m.rawArchiveDir = t.TempDir()
+	info := &DeviceInfo{Device: "/dev/sda", SerialNumber: "WD-WCC4E1234567"}
+
+	now := time.Now()
+	old := now.AddDate(0, 0, -40)
+	for _, at := range []time.Time{old, old.Add(time.Minute), now} {
+		if err := m.archiveRawJSON(info, []byte(`{"smartctl": {}}`), at); err != nil {
+			t.Fatalf("archiveRawJSON: %v", err)
+		}
+	}
+	exists := func(at time.Time) bool {
+		_, err := os.Stat(rawArchivePath(m.rawArchiveDir, info.ID(), at))
+		return err == nil
+	}
+
+	if _, err := m.pruneData(now.AddDate(0, 0, -30)); err != nil {
+		t.Fatalf("pruneData: %v", err)
+	}
+	if exists(old) {
+		t.Error("archive file older than the retention was kept")
+	}
+	if !exists(now) {
+		t.Error("current archive file was removed")
+	}
+	var rows int
+	m.db.QueryRow(`SELECT COUNT(*) FROM raw_archive`).Scan(&rows)
+	if rows != 1 {
+		t.Errorf("%d raw_archive rows after pruning, want 1", rows)
+	}
+
+	m.storeSmartData([]map[string]interface{}{testAttribute(5, "Reallocated_Sector_Ct", 0, 200, 140)}, info)
+	if _, err := m.purgeDevice(info.SerialNumber, ""); err != nil {
+		t.Fatalf("purgeDevice: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(rawArchivePath(m.rawArchiveDir, info.ID(), now))); !os.IsNotExist(err) {
+		t.Errorf("archive directory of a purged drive: %v, want it removed", err)
+	}
+}
+
+func TestAlertRetention(t *testing.T) {
+	m := newTestMonitor(t)
+	m.alertRetention = 30 * 24 * time.Hour
+	now := time.Now()
+	old := now.AddDate(0, 0, -60)
+
+	present := &DeviceInfo{Device: "/dev/sda", SerialNumber: "WD-PRESENT"}
+	removed := &DeviceInfo{Device: "/dev/sdb", SerialNumber: "WD-REMOVED"}
+	for _, info := range []*DeviceInfo{present, removed} {
+		if err := m.updateDeviceStatus(info); err != nil {
+			t.Fatalf("updateDeviceStatus: %v", err)
+		}
+	}
+	m.db.Exec(`UPDATE device_status SET last_seen = ? WHERE device_id = ?`, old, removed.ID())
+
+	insert := func(deviceID string, resolved bool, at time.Time) {
+		t.Helper()
+		_, err := m.db.Exec(`
+			INSERT INTO health_alerts (device, device_id, attribute_name, alert_type, severity, message, first_seen, timestamp, resolved)
+			VALUES ('/dev/sdx', ?, 'Reallocated_Sector_Ct', 'CRITICAL_VALUE', 'CRITICAL', 'test', ?, ?, ?)
+		`, deviceID, at, at, resolved)
+		if err != nil {
+			t.Fatalf("insert alert: %v", err)
+		}
+	}
+	insert(present.ID(), true, old)     // resolved long ago: pruned
+	insert(present.ID(), true, now)     // resolved recently: kept
+	insert(present.ID(), false, old)    // open on a present drive: kept
+	insert(removed.ID(), false, old)    // open on a drive gone as long: kept
+	insert("WD-NEVER-SEEN", false, old) // open on a drive with no status: kept
+
+	m.applyRetention()
+	var left int
+	m.db.QueryRow(`SELECT COUNT(*) FROM health_alerts`).Scan(&left)
+	if left != 4 {
+		t.Errorf("%d alerts left after retention, want 4", left)
+	}
+}
+
+func TestAlertEscalation(t *testing.T) {
+	m := newTestMonitor(t)
+	m.escalateCriticalAfter = time.Hour
+	first := time.Now().Add(-2 * time.Hour)
+	alert := HealthAlert{Device: "/dev/sda", AttributeName: "Temperature_Celsius", AlertType: "HIGH_TEMPERATURE",
+		Severity: SeverityWarn, Message: "hot", FirstSeen: first, Timestamp: first}
+	if _, notify, err := m.store.CreateAlert(alert); err != nil || !notify {
+		t.Fatalf("CreateAlert = %v, %v, want a new alert", notify, err)
+	}
+
+	alert.FirstSeen, alert.Timestamp = time.Now(), time.Now()
+	recorded, notify, err := m.store.CreateAlert(alert)
+	if err != nil {
+		t.Fatalf("CreateAlert: %v", err)
+	}
+	if !notify || recorded.Severity != SeverityCritical || recorded.EscalatedFrom != SeverityWarn {
+		t.Errorf("refreshed alert: notify %v, severity %s escalated from %q; want true, %s from %s",
+			notify, recorded.Severity, recorded.EscalatedFrom, SeverityCritical, SeverityWarn)
+	}
+}
+
+func TestParseWebhookURLs(t *testing.T) {
+	notifiers, err := parseWebhookURLs([]string{
+		"https://chat.example.com/hook?channels=ops,storage",
+		"CRITICAL=https://pager.example.com/hook",
+	})
+	if err != nil {
+		t.Fatalf("parseWebhookURLs: %v", err)
+	}
+	if len(notifiers) != 2 {
+		t.Fatalf("%d notifiers, want 2", len(notifiers))
+	}
+	if n, ok := notifiers[0].(*webhookNotifier); !ok || n.url != "https://chat.example.com/hook?channels=ops,storage" {
+		t.Errorf("first notifier = %#v, want the whole URL with its comma", notifiers[0])
+	}
+	if n, ok := notifiers[1].(severityNotifier); !ok || n.minSeverity != SeverityCritical {
+		t.Errorf("second notifier = %#v, want CRITICAL only", notifiers[1])
+	}
+
+	if _, err := parseWebhookURLs([]string{"chat.example.com/hook"}); err == nil {
+		t.Error("URL without a scheme accepted")
+	}
+}
+
+func TestVendorThresholdsReadOnce(t *testing.T) {
+	m := newTestMonitor(t)
+	m.discovery = fixedDiscoverer{"/dev/sda"}
+	// healthyDrive has no canned "-A -f brief" output, so every read fails
+	runner := &countingSmartctl{fakeSmartctl: healthyDrive, runs: make(map[string]int)}
+	m.runner = runner
+
+	for i := 0; i < 3; i++ {
+		if err := m.runMonitoringCycle(); err != nil {
+			t.Fatalf("runMonitoringCycle: %v", err)
+		}
+	}
+	if n := runner.count("-A -f brief /dev/sda"); n != 1 {
+		t.Errorf("threshold table read %d times over 3 cycles, want once", n)
+	}
+}
+
+func TestDevstatSkipsNonATADrives(t *testing.T) {
+	m := newTestMonitor(t)
+	m.discovery = fixedDiscoverer{"/dev/nvme0"}
+	nvme := fakeSmartctl{
+		"--nocheck=standby -n standby": "Device is in ACTIVE or IDLE mode",
+		"--nocheck=standby -i": "Model Number:     Samsung SSD 980 PRO 1TB\n" +
+			"Serial Number:    S5GXNF0R123456\n" +
+			"NVMe Version:     1.3\n",
+		"-A -c --json": `{"nvme_smart_health_information_log": {"critical_warning": 0, "temperature": 41}}`,
+		"-H --json":    `{"smart_status": {"passed": true}}`,
+	}
+	runner := &countingSmartctl{fakeSmartctl: nvme, runs: make(map[string]int)}
+	m.runner = runner
+
+	if err := m.runMonitoringCycle(); err != nil {
+		t.Fatalf("runMonitoringCycle: %v", err)
+	}
+	if n := runner.count("-l devstat --json /dev/nvme0"); n != 0 {
+		t.Errorf("device statistics read %d times from an NVMe drive, want 0", n)
+	}
+}
+
+func TestPurgeDevice(t *testing.T) {
+	m := newTestMonitor(t)
+	info := &DeviceInfo{Device: "/dev/sda", SerialNumber: "WD-WCC4E1234567"}
+	if _, err := m.storeSmartData([]map[string]interface{}{testAttribute(5, "Reallocated_Sector_Ct", 8, 199, 140)}, info); err != nil {
+		t.Fatalf("storeSmartData: %v", err)
+	}
+	if err := m.addNote(info.SerialNumber, "RMA 4711"); err != nil {
+		t.Fatalf("addNote: %v", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), purgeArchivePath(info.SerialNumber, "csv", time.Date(2024, 6, 1, 3, 10, 0, 0, time.UTC)))
+	if want := "purged_WD-WCC4E1234567_20240601-031000.csv.gz"; filepath.Base(archive) != want {
+		t.Errorf("archive file %s, want %s", filepath.Base(archive), want)
+	}
+	counts, err := m.purgeDevice(info.SerialNumber, archive)
+	if err != nil {
+		t.Fatalf("purgeDevice: %v", err)
+	}
+	if counts["smart_data"] != 1 {
+		t.Errorf("purged %d smart_data rows, want 1", counts["smart_data"])
+	}
+	if _, err := os.Stat(archive); err != nil {
+		t.Errorf("archive not written: %v", err)
+	}
+	var notes int
+	m.db.QueryRow(`SELECT COUNT(*) FROM device_notes WHERE serial_number = ?`, info.SerialNumber).Scan(&notes)
+	if notes != 1 {
+		t.Errorf("%d notes left after purging, want the 1 kept", notes)
+	}
+}
+
+func TestLevelWriterAtError(t *testing.T) {
+	defer func(level int) { logLevel = level }(logLevel)
+	logLevel = logLevels["error"]
+
+	for level, shown := range map[string]bool{"debug": false, "info": false, "warn": false, "error": true} {
+		if got := levelWriter(os.Stderr, level) == os.Stderr; got != shown {
+			t.Errorf("-log-level=error shows %s messages: %v, want %v", level, got, shown)
+		}
+	}
+}
+
+// suppressingStore is a Store that reports every alert as suppressed and
+// leaves the rest to the SQLite one
+type suppressingStore struct {
+	sqliteStore
+}
+
+func (suppressingStore) IsSuppressed(deviceID, attribute, alertType string) (bool, error) {
+	return true, nil
+}
+
+func TestAlertReadsSuppressionFromStore(t *testing.T) {
+	m := newTestMonitor(t)
+	m.store = suppressingStore{sqliteStore{m}}
+
+	m.recordAlert("/dev/sda", "Temperature_Celsius", "CRITICAL_VALUE", "test")
+
+	alerts, err := m.queryAlerts(`1`)
+	if err != nil {
+		t.Fatalf("queryAlerts: %v", err)
+	}
+	if len(alerts) != 1 || !alerts[0].Suppressed {
+		t.Fatalf("alerts = %+v, want one suppressed alert", alerts)
+	}
+}
+
+func TestAlertResolutionTime(t *testing.T) {
+	m := newTestMonitor(t)
+	now := time.Now().Truncate(time.Second)
+	first := now.Add(-3 * time.Hour)
+	for _, attribute := range []string{"Temperature_Celsius", "Reallocated_Sector_Ct"} {
+		alert := HealthAlert{Device: "/dev/sda", AttributeName: attribute, AlertType: "CRITICAL_VALUE",
+			Severity: SeverityWarn, Message: "test", FirstSeen: first, Timestamp: first}
+		if _, _, err := m.store.CreateAlert(alert); err != nil {
+			t.Fatalf("CreateAlert: %v", err)
+		}
+	}
+	// The temperature alert is raised again, so only the other resolves
+	if _, err := m.db.Exec(`UPDATE health_alerts SET timestamp = ? WHERE attribute_name = 'Temperature_Celsius'`, now); err != nil {
+		t.Fatalf("refresh alert: %v", err)
+	}
+	resolved := first.Add(2 * time.Hour)
+	if _, err := m.store.ResolveAlerts(m.deviceIDFor("/dev/sda"), resolved); err != nil {
+		t.Fatalf("ResolveAlerts: %v", err)
+	}
+
+	alerts, err := m.queryAlerts(`1`)
+	if err != nil {
+		t.Fatalf("queryAlerts: %v", err)
+	}
+	for _, a := range alerts {
+		switch a.AttributeName {
+		case "Reallocated_Sector_Ct":
+			if a.ResolvedAt == nil || !a.ResolvedAt.Equal(resolved) || a.Duration != 7200 {
+				t.Errorf("resolved alert: resolved_at %v, duration %v; want %v, 7200", a.ResolvedAt, a.Duration, resolved)
+			}
+		case "Temperature_Celsius":
+			if a.ResolvedAt != nil || a.Duration != 3*3600 {
+				t.Errorf("open alert: resolved_at %v, duration %v; want nil, 10800", a.ResolvedAt, a.Duration)
+			}
+		}
+	}
+
+	report, err := m.buildDigest(now)
+	if err != nil {
+		t.Fatalf("buildDigest: %v", err)
+	}
+	if len(report.ClearedAlerts) != 1 || report.ClearedAlerts[0].AttributeName != "Reallocated_Sector_Ct" {
+		t.Errorf("digest cleared %+v, want only the resolved alert", report.ClearedAlerts)
+	}
+}
+
+// sasDrive is the smartctl output of a Seagate SAS drive, whose smartctl -i
+// pads its values into a column and whose counters replace the attribute table
+var sasDrive = fakeSmartctl{
+	"--nocheck=standby -n standby": "Device is in ACTIVE or IDLE mode",
+	"--nocheck=standby -i": "=== START OF INFORMATION SECTION ===\n" +
+		"Vendor:               SEAGATE\n" +
+		"Product:              ST4000NM0023\n" +
+		"Revision:             0004\n" +
+		"User Capacity:        4,000,787,030,016 bytes [4.00 TB]\n" +
+		"Logical block size:   512 bytes\n" +
+		"Rotation Rate:        7200 rpm\n" +
+		"Logical Unit id:      0x5000c500583b3f2b\n" +
+		"Serial number:        Z1Z2ABCD\n" +
+		"Device type:          disk\n" +
+		"Transport protocol:   SAS (SPL-3)\n" +
+		"SMART support is:     Available - device has SMART capability.\n" +
+		"SMART support is:     Enabled\n",
+	"-A -c --json": `{
+  "json_format_version": [1, 0],
+  "smartctl": {"version": [7, 3]},
+  "device": {"name": "/dev/sda", "type": "scsi", "protocol": "SCSI"},
+  "temperature": {"current": 34, "drive_trip": 65},
+  "power_on_time": {"hours": 31050, "minutes": 12},
+  "scsi_start_stop_cycle_counter": {"accumulated_start_stop_cycles": 41, "accumulated_load_unload_cycles": 612},
+  "scsi_grown_defect_list": 3
+}`,
+	"-l error --json": `{
+  "device": {"name": "/dev/sda", "type": "scsi", "protocol": "SCSI"},
+  "scsi_error_counter_log": {
+    "read": {"total_errors_corrected": 120, "total_uncorrected_errors": 1},
+    "write": {"total_errors_corrected": 0, "total_uncorrected_errors": 0},
+    "verify": {"total_errors_corrected": 4, "total_uncorrected_errors": 2}
+  }
+}`,
+	"-H --json": `{"smart_status": {"passed": true}}`,
+}
+
+func TestSASDrive(t *testing.T) {
+	m := newTestMonitor(t)
+	m.runner = sasDrive
+
+	supported, err := m.checkSmartSupport("/dev/sda")
+	if err != nil || !supported {
+		t.Fatalf("checkSmartSupport = %v, %v; want true", supported, err)
+	}
+	info, err := m.getDeviceInfo("/dev/sda")
+	if err != nil {
+		t.Fatalf("getDeviceInfo: %v", err)
+	}
+	want := DeviceInfo{Device: "/dev/sda", SerialNumber: "Z1Z2ABCD", Model: "SEAGATE ST4000NM0023", WWN: "5000c500583b3f2b",
+		MediaType: "hdd", RotationRate: 7200, CapacityBytes: 4000787030016, LogicalSectorSize: 512}
+	if *info != want {
+		t.Errorf("getDeviceInfo = %+v, want %+v", *info, want)
+	}
+
+	m.discovery = fixedDiscoverer{"/dev/sda"}
+	if err := m.runMonitoringCycle(); err != nil {
+		t.Fatalf("runMonitoringCycle: %v", err)
+	}
+	m.writes.do("sync", func() error { return nil })
+
+	raw := map[int]int64{}
+	rows, err := m.db.Query(`SELECT attribute_id, raw_value FROM smart_data WHERE device_id = 'Z1Z2ABCD'`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var value int64
+		if err := rows.Scan(&id, &value); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		raw[id] = value
+	}
+	wantRaw := map[int]int64{4: 41, 5: 3, 9: 31050, 187: 3, 193: 612, 194: 34}
+	if !reflect.DeepEqual(raw, wantRaw) {
+		t.Errorf("stored SAS attributes %v, want %v", raw, wantRaw)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// defaultDiscoverer monitors drives with a mounted partition, so idle unmounted
+// disks are never touched
+func defaultDiscoverer(runner smartctlRunner) driveDiscoverer {
+	return mountsDiscoverer{path: "/proc/mounts"}
+}
+
+// freeDiskSpace returns the bytes available to unprivileged users on the filesystem holding path
+func freeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// startProcessGroup starts cmd in a process group of its own, so that
+// killProcessGroup also reaches anything it started
+func startProcessGroup(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd.Start()
+}
+
+// killProcessGroup kills a command started with startProcessGroup and its children
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// releaseProcessGroup has nothing to release: the group goes with its last process
+func releaseProcessGroup(cmd *exec.Cmd) {}
+
+// tryLockFile takes an exclusive lock on f without waiting, reporting false if
+// another process holds it. The kernel releases it when the process exits.
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// isPrivileged reports whether the process runs as root, which smartctl needs
+// to open drives
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// defaultDiscoverer lists the physical drives smartctl finds; Windows has no
+// mount table to narrow them down by
+func defaultDiscoverer(runner smartctlRunner) driveDiscoverer {
+	return scanDiscoverer{runner: runner, physicalDrives: true}
+}
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeDiskSpace returns the bytes available to the current user on the volume holding path
+func freeDiskSpace(path string) (uint64, error) {
+	dir, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+	ok, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(dir)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if ok == 0 {
+		return 0, err
+	}
+	return available, nil
+}
+
+var (
+	procCreateJobObject          = syscall.NewLazyDLL("kernel32.dll").NewProc("CreateJobObjectW")
+	procAssignProcessToJobObject = syscall.NewLazyDLL("kernel32.dll").NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = syscall.NewLazyDLL("kernel32.dll").NewProc("TerminateJobObject")
+)
+
+const (
+	processTerminate = 0x0001
+	processSetQuota  = 0x0100
+)
+
+// processJobs holds the job object of each command started with
+// startProcessGroup, keyed by the command
+var processJobs sync.Map
+
+// startProcessGroup starts cmd in a job object of its own, Windows' nearest
+// thing to a process group, so that killProcessGroup also reaches anything it
+// started. Without a job, e.g. when one cannot be created, only the command
+// itself is killed.
+func startProcessGroup(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	job, _, _ := procCreateJobObject.Call(0, 0)
+	if job == 0 {
+		return nil
+	}
+	process, err := syscall.OpenProcess(processTerminate|processSetQuota, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		syscall.CloseHandle(syscall.Handle(job))
+		return nil
+	}
+	ok, _, _ := procAssignProcessToJobObject.Call(job, uintptr(process))
+	syscall.CloseHandle(process)
+	if ok == 0 {
+		syscall.CloseHandle(syscall.Handle(job))
+		return nil
+	}
+	processJobs.Store(cmd, syscall.Handle(job))
+	return nil
+}
+
+// killProcessGroup kills a command started with startProcessGroup and the
+// processes in its job
+func killProcessGroup(cmd *exec.Cmd) {
+	if job, ok := processJobs.Load(cmd); ok {
+		procTerminateJobObject.Call(uintptr(job.(syscall.Handle)), 1)
+	}
+	cmd.Process.Kill()
+}
+
+// releaseProcessGroup closes the job of a command started with
+// startProcessGroup once it is done with; processes still in it keep running
+func releaseProcessGroup(cmd *exec.Cmd) {
+	if job, ok := processJobs.LoadAndDelete(cmd); ok {
+		syscall.CloseHandle(job.(syscall.Handle))
+	}
+}
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// tryLockFile takes an exclusive lock on f without waiting, reporting false if
+// another process holds it. Windows releases it when the process exits. The
+// locked byte lies past the end of the file, so its contents stay readable.
+func tryLockFile(f *os.File) (bool, error) {
+	overlapped := syscall.Overlapped{OffsetHigh: 1}
+	ok, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
+
+// isPrivileged reports true: there is no cheap check for an elevated process,
+// and smartctl's own error says when it is not
+func isPrivileged() bool {
+	return true
+}